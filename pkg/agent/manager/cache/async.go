@@ -0,0 +1,56 @@
+package cache
+
+import "sync"
+
+// asyncNotifier runs notification passes in a background goroutine, so
+// mutations don't wait for them. Passes requested while another one is
+// pending are coalesced, so the queue holds at most one entry per subscriber.
+// The goroutine only runs while there are pending passes.
+type asyncNotifier struct {
+	notify func(subs []*subscriber)
+
+	m       sync.Mutex
+	pending map[uint64]*subscriber
+	running bool
+}
+
+func newAsyncNotifier(notify func(subs []*subscriber)) *asyncNotifier {
+	return &asyncNotifier{
+		notify:  notify,
+		pending: make(map[uint64]*subscriber),
+	}
+}
+
+// enqueue requests a pass notifying subs, starting the goroutine if needed.
+func (n *asyncNotifier) enqueue(subs []*subscriber) {
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	for _, sub := range subs {
+		n.pending[sub.id] = sub
+	}
+	if !n.running {
+		n.running = true
+		go n.run()
+	}
+}
+
+// run notifies the pending subscribers until there are none left.
+func (n *asyncNotifier) run() {
+	for {
+		n.m.Lock()
+		if len(n.pending) == 0 {
+			n.running = false
+			n.m.Unlock()
+			return
+		}
+		subs := make([]*subscriber, 0, len(n.pending))
+		for _, sub := range n.pending {
+			subs = append(subs, sub)
+		}
+		n.pending = make(map[uint64]*subscriber)
+		n.m.Unlock()
+
+		n.notify(subs)
+	}
+}
@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// notifyBatcher holds notification passes until they are flushed, either
+// explicitly or when the subscriber's timer expires. Passes held for the same
+// subscriber are coalesced into a single pass delivering the latest state.
+type notifyBatcher struct {
+	clk   Clock
+	delay time.Duration
+	flush func(subs []*subscriber)
+
+	m       sync.Mutex
+	pending map[uint64]*subscriber
+	timers  map[uint64]Timer
+}
+
+func newNotifyBatcher(clk Clock, delay time.Duration, flush func(subs []*subscriber)) *notifyBatcher {
+	return &notifyBatcher{
+		clk:     clk,
+		delay:   delay,
+		flush:   flush,
+		pending: make(map[uint64]*subscriber),
+		timers:  make(map[uint64]Timer),
+	}
+}
+
+// hold holds a pass notifying subs, starting the timer of the subscribers
+// that weren't already pending.
+func (b *notifyBatcher) hold(subs []*subscriber) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	for _, sub := range subs {
+		b.pending[sub.id] = sub
+		if b.delay > 0 && b.timers[sub.id] == nil {
+			id := sub.id
+			b.timers[id] = b.clk.AfterFunc(b.delay, func() { b.flushSubscriber(id) })
+		}
+	}
+}
+
+// flushAll runs a single pass notifying all the pending subscribers.
+func (b *notifyBatcher) flushAll() {
+	b.m.Lock()
+	subs := make([]*subscriber, 0, len(b.pending))
+	for _, sub := range b.pending {
+		subs = append(subs, sub)
+	}
+	for _, timer := range b.timers {
+		timer.Stop()
+	}
+	b.pending = make(map[uint64]*subscriber)
+	b.timers = make(map[uint64]Timer)
+	b.m.Unlock()
+
+	if len(subs) > 0 {
+		b.flush(subs)
+	}
+}
+
+// flushSubscriber notifies the subscriber with the given ID, if pending.
+func (b *notifyBatcher) flushSubscriber(id uint64) {
+	b.m.Lock()
+	sub, ok := b.pending[id]
+	delete(b.pending, id)
+	delete(b.timers, id)
+	b.m.Unlock()
+
+	if ok {
+		b.flush([]*subscriber{sub})
+	}
+}
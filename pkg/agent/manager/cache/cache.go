@@ -1,15 +1,84 @@
 package cache
 
 import (
+	"bytes"
+	"context"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spiffe/spire/pkg/common/selector"
 	"github.com/spiffe/spire/proto/common"
 )
 
+// ErrConflict is returned by SetEntry, in strict mode, when the entry differs
+// from an entry with the same ID that wasn't read since it was set.
+var ErrConflict = errors.New("entry conflicts with an unread entry")
+
+// ErrInvalidEntry is returned by SetEntry when the entry has no registration
+// entry or its registration entry has no ID.
+var ErrInvalidEntry = errors.New("invalid entry")
+
+// ErrEntryNotFound is returned by EntryOrError when there is no entry with
+// the given ID.
+var ErrEntryNotFound = errors.New("entry not found")
+
+// ErrTooManySelectors is returned when an entry or subscription has more
+// selectors than allowed by WithMaxSelectors.
+var ErrTooManySelectors = errors.New("too many selectors")
+
+// ErrClosed is returned by the calls registering a subscriber once the cache
+// is closed.
+var ErrClosed = errors.New("cache is closed")
+
+// ErrNoAllowedRoots is returned by SetBundle when none of the bundle roots is
+// allowed.
+var ErrNoAllowedRoots = errors.New("bundle has no allowed roots")
+
+// ErrFrozen is returned by the calls modifying the entries or the bundle
+// while the cache is frozen.
+var ErrFrozen = errors.New("cache is frozen")
+
+// ErrTrustDomainMismatch is returned by SetEntry, when the cache was created
+// with WithTrustDomain, if the entry SVID doesn't have a single URI SAN with a
+// SPIFFE ID in the trust domain.
+var ErrTrustDomainMismatch = errors.New("SVID is not in the cache trust domain")
+
+// ValidationError is returned by Validate, describing every problem found.
+type ValidationError []error
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return "cache is invalid: " + strings.Join(msgs, "; ")
+}
+
+// InvalidSelectorError is returned by SetEntry and SubscribeSelectors when a
+// selector is nil or has no type or value.
+type InvalidSelectorError struct {
+	Selector *common.Selector
+}
+
+func (e *InvalidSelectorError) Error() string {
+	if e.Selector == nil {
+		return "invalid nil selector"
+	}
+	return fmt.Sprintf("invalid selector %q", e.Selector.Type+":"+e.Selector.Value)
+}
+
 type Selectors []*common.Selector
 
 // Entry holds the data of a single cache entry.
@@ -22,153 +91,2663 @@ type Entry struct {
 	// federated bundles. The registration entry
 	// only stores references to the keys here.
 	Bundles map[string][]byte
+
+	// FederatesWith holds the IDs of the trust domains the entry federates
+	// with, as set in the registration entry.
+	FederatesWith []string
+
+	// RotationThreshold is the fraction of the SVID lifetime after which the
+	// SVID must be rotated, e.g. 0.8 to rotate it when 80% of its lifetime
+	// has elapsed. Values outside (0, 1] mean the default threshold is used.
+	RotationThreshold float64
+
+	// IssuerKeyID and IssuerDN hold the authority key identifier and the
+	// issuer distinguished name of the SVID. They are set by the cache when
+	// the entry is set, and are empty if the SVID doesn't have them.
+	IssuerKeyID []byte
+	IssuerDN    string
+
+	// ValidFrom holds the time the SVID becomes valid, so SVIDs delivered
+	// ahead of time can be switched to when they do. It is set by the cache
+	// when the entry is set, and is zero if the entry has no SVID.
+	ValidFrom time.Time
+
+	// Deprecated is true when the entry was soft deleted and will be removed
+	// once its grace period elapses.
+	Deprecated bool
+
+	// ValidatedBundleSeq is the version of the bundle when the entry was
+	// delivered, increased on every bundle change. It is set by the cache in
+	// the entries of the updates sent to subscribers.
+	ValidatedBundleSeq uint64
+}
+
+// RotationTime returns the time the entry SVID must be rotated, according to
+// the entry RotationThreshold or, when unset, threshold before it expires.
+// The SVID must not be nil.
+func (e *Entry) RotationTime(threshold time.Duration) time.Time {
+	if e.RotationThreshold <= 0 || e.RotationThreshold > 1 {
+		return e.SVID.NotAfter.Add(-threshold)
+	}
+	lifetime := e.SVID.NotAfter.Sub(e.SVID.NotBefore)
+	return e.SVID.NotBefore.Add(time.Duration(float64(lifetime) * e.RotationThreshold))
+}
+
+// Equal returns true if both entries are equivalent. Entries are equivalent
+// when their registration entries have the same identity, selectors and
+// federated bundle references, their SVIDs have the same serial number and
+// expiration, they hold the same federated bundles, federate with the same
+// trust domains and are both deprecated or not. Nil entries are only equal to
+// other nil entries.
+func (e *Entry) Equal(other *Entry) bool {
+	if e == nil || other == nil {
+		return e == other
+	}
+	return regEntriesEqual(e.RegistrationEntry, other.RegistrationEntry) &&
+		svidsEqual(e.SVID, other.SVID) &&
+		bundlesEqual(e.Bundles, other.Bundles) &&
+		stringSetsEqual(e.FederatesWith, other.FederatesWith) &&
+		e.Deprecated == other.Deprecated
+}
+
+// TLSCertificate returns the entry SVID and private key as a TLS certificate.
+// It fails if the entry has no SVID or private key, or if they don't match.
+func (e *Entry) TLSCertificate() (tls.Certificate, error) {
+	if e.SVID == nil {
+		return tls.Certificate{}, errors.New("entry has no SVID")
+	}
+	if e.PrivateKey == nil {
+		return tls.Certificate{}, errors.New("entry has no private key")
+	}
+	publicKey, ok := e.SVID.PublicKey.(*ecdsa.PublicKey)
+	if !ok || publicKey.Curve != e.PrivateKey.Curve ||
+		publicKey.X.Cmp(e.PrivateKey.X) != 0 || publicKey.Y.Cmp(e.PrivateKey.Y) != 0 {
+		return tls.Certificate{}, errors.New("entry private key does not match the SVID")
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{e.SVID.Raw},
+		PrivateKey:  e.PrivateKey,
+		Leaf:        e.SVID,
+	}, nil
+}
+
+// withSVIDDetails returns a copy of the entry with the issuer and the start
+// of validity of its SVID set, or the same entry if it has no SVID.
+func withSVIDDetails(e *Entry) *Entry {
+	if e.SVID == nil {
+		return e
+	}
+	c := *e
+	c.IssuerKeyID = append([]byte(nil), e.SVID.AuthorityKeyId...)
+	c.IssuerDN = e.SVID.Issuer.String()
+	c.ValidFrom = e.SVID.NotBefore
+	return &c
+}
+
+// copyEntry returns a copy of the entry that can be modified without
+// affecting the original one. The SVID and private key are shared.
+func copyEntry(e *Entry) *Entry {
+	c := *e
+	if e.RegistrationEntry != nil {
+		regEntry := *e.RegistrationEntry
+		regEntry.Selectors = nil
+		for _, s := range e.RegistrationEntry.Selectors {
+			sel := *s
+			regEntry.Selectors = append(regEntry.Selectors, &sel)
+		}
+		regEntry.FbSpiffeIds = append([]string(nil), e.RegistrationEntry.FbSpiffeIds...)
+		c.RegistrationEntry = &regEntry
+	}
+	if e.Bundles != nil {
+		c.Bundles = make(map[string][]byte, len(e.Bundles))
+		for id, bundle := range e.Bundles {
+			c.Bundles[id] = append([]byte(nil), bundle...)
+		}
+	}
+	c.FederatesWith = append([]string(nil), e.FederatesWith...)
+	c.IssuerKeyID = append([]byte(nil), e.IssuerKeyID...)
+	return &c
+}
+
+// MatchExplanation describes whether a cache entry matches a set of selectors.
+type MatchExplanation struct {
+	// EntryID is the cache key of the entry, its entry ID by default.
+	EntryID string
+	Matched bool
+	// MissingSelectors holds the entry's selectors that are not present in
+	// the matched set of selectors. It is empty when the entry matched, and
+	// may be empty when a custom matcher rejected the entry.
+	MissingSelectors Selectors
+}
+
+// ReconcileResult reports the changes applied by Reconcile, as sorted entry
+// keys.
+type ReconcileResult struct {
+	Added     []string
+	Updated   []string
+	Removed   []string
+	Unchanged []string
 }
 
 type Cache interface {
 	// Entry gets the cache entry for the specified RegistrationEntry.
 	Entry(regEntry *common.RegistrationEntry) *Entry
-	// SetEntry puts a new cache entry for the entry's RegistrationEntry.
-	SetEntry(entry *Entry)
+	// EntryOrError gets the cache entry with the given key, the entry ID
+	// unless set with WithKeyFunc, or returns ErrEntryNotFound if there is
+	// none.
+	EntryOrError(entryID string) (*Entry, error)
+	// EntriesByIDs gets the cache entries for the given entry keys, the entry
+	// IDs unless set with WithKeyFunc, keyed by key. Keys without a cache
+	// entry are not present in the returned map.
+	EntriesByIDs(ids []string) map[string]*Entry
+	// EntriesByParentID returns the cache entries whose registration entry has
+	// the given parent ID, sorted by entry ID.
+	EntriesByParentID(parentID string) []*Entry
+	// EntriesBySPIFFEIDMap returns copies of the cache entries grouped by
+	// SPIFFE ID, each group sorted by entry ID.
+	EntriesBySPIFFEIDMap() map[string][]*Entry
+	// EntriesByDNSName returns the cache entries whose SVID has the given DNS
+	// name, sorted by entry ID. Wildcard DNS names only match literally
+	// unless the cache was created with WithDNSWildcardMatch.
+	EntriesByDNSName(name string) []*Entry
+	// PickSVID returns one of the cache entries with an SVID for the given
+	// SPIFFE ID, rotating through them in entry ID order on every call, or nil
+	// if there is none.
+	PickSVID(spiffeID string) *Entry
+	// SetEntry puts a new cache entry for the entry's RegistrationEntry. It
+	// returns ErrInvalidEntry if the entry has no RegistrationEntry or key,
+	// the insert policy error if the policy rejects it, an
+	// InvalidSelectorError if one of its selectors is nil or incomplete,
+	// ErrTooManySelectors if it has too many selectors and
+	// ErrTrustDomainMismatch if its SVID is in another trust domain. In strict
+	// mode it returns ErrConflict if the entry would replace a different
+	// entry that wasn't read since it was set. It returns ErrFrozen while the
+	// cache is frozen.
+	SetEntry(entry *Entry) error
 	// DeleteEntry removes the cache entry for the specified RegistrationEntry if it exists,
-	// returns true if it removed some entry or false otherwise.
-	DeleteEntry(regEntry *common.RegistrationEntry) bool
+	// returns true if it removed some entry or false otherwise. It returns
+	// ErrFrozen while the cache is frozen.
+	DeleteEntry(regEntry *common.RegistrationEntry) (bool, error)
+	// SweepExpired removes the entries whose SVID expired, according to the
+	// cache clock, notifying the subscribers once. It returns the number of
+	// entries removed, which is zero while the cache is frozen.
+	SweepExpired() int
+	// SoftDeleteEntry marks the entry with the given key, the entry ID unless
+	// set with WithKeyFunc, as deprecated and removes it once grace elapses,
+	// unless it is set again in the meantime or the cache is frozen by then.
+	// Deprecated entries are still delivered to subscribers. It returns
+	// ErrEntryNotFound if there is no such entry and ErrFrozen while the
+	// cache is frozen.
+	SoftDeleteEntry(entryID string, grace time.Duration) error
+	// Freeze makes the cache read-only until Unfreeze is called. While frozen,
+	// the calls modifying the entries or the bundle fail with ErrFrozen, or
+	// have no effect when they can't return an error. Reads and subscriptions
+	// keep working.
+	Freeze()
+	// Unfreeze makes a frozen cache modifiable again.
+	Unfreeze()
+	// Close unsubscribes all the subscribers. From then on, registering a
+	// subscriber fails with ErrClosed, and SubscribeDynamic and
+	// SubscribeSPIFFEID return a finished subscriber. Other calls keep
+	// working.
+	Close()
 	// Entries returns all the in force cached entries.
 	Entries() []*Entry
 	// IsEmpty returns true if this cache doesn't have any entry.
 	IsEmpty() bool
-	// Register a Subscriber and sends WorkloadUpdate on the subscriber's channel
-	Subscribe(sub *subscriber)
-	// Set the bundle
-	SetBundle([]*x509.Certificate)
-	// Retrieve the bundle
+	// NextRotation returns the earliest time an SVID must be rotated, and
+	// false if there are no SVIDs. SVIDs are rotated according to their entry
+	// RotationThreshold or, when unset, threshold before they expire.
+	NextRotation(threshold time.Duration) (time.Time, bool)
+	// PeekNextRotation returns the entry whose SVID must be rotated first
+	// along with its rotation time, and false if no rotation is scheduled.
+	// SVIDs are rotated according to their entry RotationThreshold or, when
+	// unset, the threshold set with WithRotationThreshold.
+	PeekNextRotation() (*Entry, time.Time, bool)
+	// PopRotated unschedules and returns the entries whose SVID must be
+	// rotated by now, in rotation order. An entry is scheduled again when
+	// it is set.
+	PopRotated(now time.Time) []*Entry
+	// PublishExpvar publishes the cache internals as an expvar map with the
+	// given name. Publishing again with the same name publishes this cache's
+	// internals instead.
+	PublishExpvar(prefix string)
+	// WriteMetrics writes the current cache metrics to w, in the OpenMetrics
+	// text format.
+	WriteMetrics(w io.Writer) error
+	// SuspendNotifications defers notifying subscribers until
+	// ResumeNotifications is called. Calls can be nested, notifications are
+	// resumed when every call is matched.
+	SuspendNotifications()
+	// ResumeNotifications resumes notifying subscribers, notifying in a single
+	// pass the subscribers whose notification was deferred.
+	ResumeNotifications()
+	// FlushNotifications notifies in a single pass the subscribers whose
+	// notification is held by WithManualFlush. It has no effect otherwise.
+	FlushNotifications()
+	// Generation returns a number increased on every change to the cache
+	// state. It is the version of the state sent to subscribers.
+	Generation() uint64
+	// WaitNonEmpty blocks until the cache has at least one entry or the
+	// context is done, in which case it returns the context error.
+	WaitNonEmpty(ctx context.Context) error
+	// HasMatch returns true if at least one cached entry matches the given selectors.
+	HasMatch(selectors Selectors) bool
+	// MissHints returns the channel where the sets of selectors that didn't
+	// match any entry, when checked with HasMatch or subscribed with, are
+	// sent. It is nil unless the cache was created with WithMissHints.
+	MissHints() <-chan Selectors
+	// ExplainMatch returns, for every cached entry, whether it matches the given
+	// selectors according to the cache matcher, and which entry selectors are
+	// missing otherwise.
+	ExplainMatch(selectors Selectors) []MatchExplanation
+	// Register a Subscriber and sends WorkloadUpdate on the subscriber's channel.
+	// Returns ErrTooManySelectors if the subscriber has too many selectors and
+	// ErrClosed if the cache is closed.
+	// Misses are not hinted for subscribers registered while paused, whose
+	// selectors may not be known yet.
+	Subscribe(sub *subscriber) error
+	// SubscribeSelectors creates a subscriber for the given selectors and
+	// registers it like Subscribe. It returns an InvalidSelectorError if a
+	// selector is nil or incomplete, ErrTooManySelectors if there are too
+	// many selectors and ErrClosed if the cache is closed.
+	SubscribeSelectors(selectors Selectors, opts ...SubscribeOption) (*subscriber, error)
+	// SubscribeFunc registers a subscription for the given selectors calling cb
+	// with every update, and returns a function canceling it. cb is called
+	// synchronously while notifying, so it must not block or call the cache.
+	// cb is not called after cancel returns.
+	SubscribeFunc(selectors Selectors, cb func(*WorkloadUpdate)) (cancel func(), err error)
+	// StreamTo calls send with every update received by the registered
+	// subscriber until the context is done, send fails or the subscriber is
+	// finished, and unsubscribes it. It returns the context error or the send
+	// error, or nil if the subscriber was finished.
+	StreamTo(ctx context.Context, sub *subscriber, send func(*WorkloadUpdate) error) error
+	// UpdateSubscription replaces the selectors of a registered subscriber and
+	// notifies it with the entries matching the new selectors. It has no
+	// effect if the subscriber is not registered. Returns ErrTooManySelectors
+	// if there are too many selectors.
+	UpdateSubscription(sub *subscriber, selectors Selectors) error
+	// SubscribeDynamic registers a subscriber whose selectors are updated,
+	// like with UpdateSubscription, with every set of selectors received on
+	// selCh. The subscriber is sent its first update once the first set of
+	// selectors is received, and is unsubscribed when selCh is closed or the
+	// context is done.
+	SubscribeDynamic(ctx context.Context, selCh <-chan Selectors) *subscriber
+	// SubscribeSPIFFEID registers a subscriber for the entries with the given
+	// SPIFFE ID, regardless of their selectors. It is notified whenever an
+	// entry with the SPIFFE ID is added, updated or removed.
+	SubscribeSPIFFEID(spiffeID string) *subscriber
+	// PauseSubscriber stops sending updates to the subscriber, without
+	// removing it, until ResumeSubscriber is called.
+	PauseSubscriber(sub *subscriber)
+	// ResumeSubscriber resumes sending updates to a paused subscriber,
+	// sending it a single update with the current state if the cache changed
+	// while it was paused.
+	ResumeSubscriber(sub *subscriber)
+	// Unsubscribe finishes the subscriber and removes it from the cache.
+	Unsubscribe(sub *subscriber)
+	// DeliveryHistory returns the last updates sent to the subscriber, the
+	// oldest first, without the entries' private keys. It is empty unless the
+	// cache was created with WithDeliveryHistory.
+	DeliveryHistory(sub *subscriber) []WorkloadUpdateView
+	// LastDelivered returns the last update sent to the subscriber, or nil if
+	// it wasn't sent any. The update must not be modified.
+	LastDelivered(sub *subscriber) *WorkloadUpdate
+	// SubscriberChannelDepth returns the number of updates sent to the
+	// subscriber and not read yet.
+	SubscriberChannelDepth(sub *subscriber) int
+	// SubscriberByID returns the registered subscriber with the given ID, or nil if there is none.
+	SubscriberByID(id uint64) *subscriber
+	// WouldNotify returns the sorted IDs of the subscribers that would be notified
+	// if the given entry was set, without modifying the cache. It returns no
+	// IDs for a nil entry or an entry without registration entry.
+	WouldNotify(entry *Entry) []uint64
+	// SubscribersForEntry returns the sorted IDs of the active subscribers
+	// matching the cached entry with the given key, the entry ID unless set
+	// with WithKeyFunc. It is empty if there is no such entry.
+	SubscribersForEntry(entryID string) []uint64
+	// Set the bundle. Roots not allowed by WithAllowedRoots are dropped, and
+	// ErrNoAllowedRoots is returned, leaving the bundle unchanged, if there
+	// are no roots left. It returns ErrFrozen while the cache is frozen.
+	SetBundle([]*x509.Certificate) error
+	// RemoveBundleRoot removes the given root from the bundle, returns true if
+	// it was present or false otherwise. It has no effect while the cache is
+	// frozen, or if the root is nil.
+	RemoveBundleRoot(cert *x509.Certificate) bool
+	// Retrieve the bundle. Certificates are always returned in the order
+	// defined by SortedBundle. The returned slice is shared and must not be
+	// modified.
 	Bundle() []*x509.Certificate
+	// BundlePEM returns the bundle roots as concatenated PEM blocks, in the
+	// order defined by SortedBundle.
+	BundlePEM() ([]byte, error)
+	// BundleCount returns the number of roots in the bundle.
+	BundleCount() int
+	// SetFederatedBundle sets the bundle of a federated trust domain. An empty
+	// bundle removes the trust domain's bundle. It has no effect while the
+	// cache is frozen.
+	SetFederatedBundle(trustDomain string, bundle []*x509.Certificate)
+	// FederatedBundle returns the bundle of a federated trust domain, or nil
+	// if there is none. Certificates are returned in the order defined by
+	// SortedBundle.
+	FederatedBundle(trustDomain string) []*x509.Certificate
+	// FederatedTrustDomains returns the sorted IDs of the federated trust
+	// domains with a bundle, excluding the cache trust domain.
+	FederatedTrustDomains() []string
+	// VerifyFederationRefs returns, keyed by entry ID, the sorted trust
+	// domains referenced by the entry Bundles that have no federated bundle
+	// in the cache. Entries without missing trust domains are not present in
+	// the returned map.
+	VerifyFederationRefs() map[string][]string
+	// TrustDomainBundlePEM returns the bundle of a federated trust domain as
+	// concatenated PEM blocks, in the order defined by SortedBundle, or nil if
+	// there is none.
+	TrustDomainBundlePEM(trustDomain string) ([]byte, error)
+	// TrustDomainBundleCounts returns the number of roots in the bundle of
+	// each federated trust domain, keyed by trust domain.
+	TrustDomainBundleCounts() map[string]int
+	// Reset atomically replaces all the cache entries and the bundle, and
+	// notifies all the subscribers once. Entries SetEntry would reject are
+	// ignored. Roots not allowed by WithAllowedRoots are dropped from the
+	// bundle. It has no effect while the cache is frozen.
+	Reset(entries []*Entry, bundle []*x509.Certificate)
+	// Reconcile makes the cache entries the given ones, adding, updating and
+	// removing entries in a single step, and notifies the subscribers of the
+	// changed entries once. Entries equal to the cached ones are left
+	// untouched. Entries SetEntry would reject are ignored. It has no effect
+	// while the cache is frozen.
+	Reconcile(authoritative []*Entry) ReconcileResult
+	// SetJWTBundle sets the JWT signing keys, keyed by key ID, for the given
+	// trust domain. An empty set of keys removes the trust domain's JWT bundle.
+	// It has no effect while the cache is frozen.
+	SetJWTBundle(trustDomain string, keys map[string]crypto.PublicKey)
+	// JWTBundle returns the JWT signing keys, keyed by key ID, for the given
+	// trust domain, or nil if there are none.
+	JWTBundle(trustDomain string) map[string]crypto.PublicKey
+	// SetBundleMetadata sets the bundle attributes delivered to subscribers,
+	// like the bundle sequence number. Subscribers are notified when the
+	// metadata changes. It has no effect while the cache is frozen.
+	SetBundleMetadata(metadata map[string]string)
+	// BundleMetadata returns the bundle attributes, or nil if there are none.
+	BundleMetadata() map[string]string
+	// SetDegraded marks the cache data as stale, or not, for the given reason.
+	// Subscribers are notified when the state changes. It has no effect while
+	// the cache is frozen.
+	SetDegraded(degraded bool, reason string)
+	// SetBootstrapComplete marks the initial sync of the cache as finished.
+	// Updates sent afterwards are flagged as bootstrapped, and subscribers
+	// are notified the first time it is called. It has no effect while the
+	// cache is frozen.
+	SetBootstrapComplete()
+	// SetSelectorNormalizer sets a function normalizing the selectors of the
+	// entries and subscribers added afterwards, before they are matched.
+	// Selectors normalized to nil are dropped. A nil normalizer disables
+	// normalization.
+	SetSelectorNormalizer(normalizer func(*common.Selector) *common.Selector)
+	// SetInsertPolicy sets a function called by SetEntry before inserting an
+	// entry. A non-nil error rejects the entry and is returned by SetEntry. A
+	// nil policy accepts every entry.
+	SetInsertPolicy(policy func(*Entry) error)
+	// SubscribeAndSnapshot registers a subscriber for the given selectors and
+	// returns it along with the current state for its selectors. Updates
+	// received by the subscriber only reflect changes made after the snapshot.
+	// Returns ErrTooManySelectors if there are too many selectors.
+	SubscribeAndSnapshot(selectors Selectors) (*WorkloadUpdate, *subscriber, error)
+	// UndeliveredEntries returns the cache entries that were never sent to a
+	// subscriber, sorted by entry ID.
+	UndeliveredEntries() []*Entry
+	// Validate checks that the cache is internally consistent and that every
+	// cached SVID is currently valid and chains to the bundle. It returns a
+	// ValidationError describing every problem found.
+	Validate() error
+	// EntryAccessCount returns the number of times the entry with the given
+	// key was looked up or delivered to a subscriber. It is always zero unless
+	// the cache was created with WithAccessCounting.
+	EntryAccessCount(entryID string) uint64
+	// EntryRotationCount returns the number of times the SVID of the entry
+	// with the given key was replaced by one with a different serial number,
+	// by SetEntry or Reset. It is zero for unknown entries.
+	EntryRotationCount(entryID string) uint64
+	// OldestEntryTime returns the time the oldest cached entry was inserted,
+	// and false if the cache is empty. Replacing an entry doesn't change its
+	// insertion time.
+	OldestEntryTime() (time.Time, bool)
+	// NewestEntryTime returns the time the newest cached entry was inserted,
+	// and false if the cache is empty.
+	NewestEntryTime() (time.Time, bool)
+	// EstimatedSizeBytes returns a rough estimate of the bytes held by the
+	// cached entries and bundles. It doesn't account for the memory overhead
+	// of the cache structures.
+	EstimatedSizeBytes() int64
+	// Fingerprint returns a SHA-256 hash of the cache entries and bundle,
+	// which is the same for caches with the same content regardless of the
+	// order it was set in.
+	Fingerprint() [32]byte
 }
 
 type cacheImpl struct {
-	// Map keyed by RegistrationEntry.EntryId holding Entry instances.
+	// Map keyed by the entry key holding Entry instances.
 	cache       map[string]*Entry
 	log         logrus.FieldLogger
-	m           sync.Mutex
+	clk         Clock
+	trustDomain string
+	m           sync.RWMutex
 	subscribers *subscribers
+	// nonEmpty is closed while the cache has entries.
+	nonEmpty    chan struct{}
 	bundle      []*x509.Certificate
 	notifyMutex sync.Mutex
+
+	// Map keyed by trust domain holding the bundles of federated trust domains.
+	federatedBundles map[string][]*x509.Certificate
+	// Map keyed by trust domain holding the JWT signing keys keyed by key ID.
+	jwtBundles map[string]map[string]crypto.PublicKey
+	// Bundle attributes set with SetBundleMetadata, nil if there are none.
+	bundleMetadata map[string]string
+
+	// Whether the entries and the bundle can't be modified.
+	frozen bool
+	// Whether subscribers can't be registered anymore.
+	closed bool
+
+	// Whether the cache data is stale and why.
+	degraded       bool
+	degradedReason string
+
+	// Whether the initial sync of the cache is finished.
+	bootstrapped bool
+
+	// keyFunc returns the key of an entry, its entry ID by default.
+	keyFunc func(*Entry) string
+	// matcher decides which entries are delivered to which subscribers.
+	matcher SelectorMatcher
+	// hasher creates the hashes of the content compared to detect changes.
+	hasher Hasher
+	// Whether only the entry with the latest SVID is kept for a SPIFFE ID.
+	dedupSPIFFEIDs bool
+	// Whether entries whose private key doesn't match their SVID are kept
+	// from being delivered.
+	keyCheck bool
+	// missHints emits the selectors that didn't match any entry, at most
+	// once per missHintInterval for the same selectors. Nil unless enabled
+	// with WithMissHints.
+	missHintsEnabled bool
+	missHintInterval time.Duration
+	missHints        *missHinter
+
+	// Map keyed by DNS name holding the keys of the entries whose SVID has
+	// the name, and whether wildcard names match the names they cover.
+	dnsIndex         map[string]map[string]bool
+	dnsWildcardMatch bool
+
+	normalizer func(*common.Selector) *common.Selector
+	// Function vetting the entries given to SetEntry, or nil if none.
+	insertPolicy func(*Entry) error
+	// Maximum number of selectors of entries and subscriptions, or zero if
+	// unlimited.
+	maxSelectors int
+
+	// version is increased on every change to the state sent to subscribers.
+	version uint64
+	// bundleVersion is increased on every change to the bundle.
+	bundleVersion uint64
+
+	// Time of the last notification pass, in Unix nanoseconds, and number of
+	// updates replaced before being received. Must be accessed atomically.
+	lastNotification int64
+	droppedUpdates   uint64
+
+	// Map keyed by entry ID holding the entry access counters, which must
+	// be accessed atomically. Nil when accesses are not counted.
+	accessCounts map[string]*uint64
+
+	// Map keyed by entry ID holding whether the entry was ever sent to a
+	// subscriber, which must be accessed atomically.
+	delivered map[string]*uint32
+
+	// Map keyed by entry ID holding the number of times the entry SVID was
+	// rotated.
+	rotationCounts map[string]uint64
+
+	// Map keyed by entry ID holding the time the entry was inserted.
+	// Replacing an entry doesn't change its insertion time.
+	insertedAt map[string]time.Time
+
+	// Rotation schedule of the entries with an SVID, and the time before
+	// expiration their SVIDs are rotated when their entry doesn't set a
+	// rotation threshold.
+	rotations         *rotationQueue
+	rotationThreshold time.Duration
+
+	// PEM encoding of the SVIDs and the bundle sent to the subscribers
+	// wanting it.
+	pems *pemCache
+
+	// Map keyed by entry ID holding whether the entry was read since it was
+	// set, which must be accessed atomically. Nil unless in strict mode.
+	acknowledged map[string]*uint32
+
+	// Set of DER encoded public keys of the allowed bundle roots. Nil when
+	// any root is allowed.
+	allowedRoots map[string]bool
+
+	notifyRate    float64
+	notifyBurst   int
+	notifyLimiter *notifyLimiter
+
+	asyncNotifier *asyncNotifier
+
+	// Number of updates recorded per subscriber, or zero if not recorded.
+	historySize int
+
+	manualFlush   bool
+	flushDelay    time.Duration
+	notifyBatcher *notifyBatcher
+
+	// Map keyed by SPIFFE ID holding the number of times PickSVID picked an
+	// entry for it.
+	pickMutex  sync.Mutex
+	pickCounts map[string]uint64
+
+	// Number of pending SuspendNotifications calls and subscribers to notify
+	// when notifications are resumed, keyed by ID.
+	suspendMutex  sync.Mutex
+	suspended     int
+	suspendedSubs map[uint64]*subscriber
+}
+
+// cacheState holds a copy of the cache state sent to subscribers.
+type cacheState struct {
+	version          uint64
+	entries          []*Entry
+	bundle           []*x509.Certificate
+	federatedBundles map[string][]*x509.Certificate
+	jwtBundles       map[string]map[string]crypto.PublicKey
+	bundleMetadata   map[string]string
+	bundleVersion    uint64
+	trustDomain      string
+	stale            bool
+	staleReason      string
+	bootstrapped     bool
+	accessCounts     map[string]*uint64
+	delivered        map[string]*uint32
+	keyFunc          func(*Entry) string
+	hasher           Hasher
+}
+
+// update returns the update holding the state with copies of the given
+// entries, so the receiver can't modify the cached ones. Its epoch is set by
+// seal, once the update holds what the subscriber is sent.
+func (s *cacheState) update(entries []*Entry) *WorkloadUpdate {
+	copies := make([]*Entry, 0, len(entries))
+	for _, e := range entries {
+		c := copyEntry(e)
+		c.ValidatedBundleSeq = s.bundleVersion
+		copies = append(copies, c)
+	}
+	update := &WorkloadUpdate{
+		TrustDomain: s.trustDomain,
+		Entries:     copies,
+		Bundle:      s.bundle,
+		JWTBundles:  s.jwtBundles,
+		Stale:       s.stale,
+		StaleReason: s.staleReason,
+
+		Bootstrapped:     s.bootstrapped,
+		FederatedBundles: s.federatedBundles,
+		RefreshHints:     s.refreshHints(entries),
+		BundleMetadata:   s.bundleMetadata,
+	}
+	return update
+}
+
+// seal sets the epoch of the update from its content.
+func (s *cacheState) seal(update *WorkloadUpdate) {
+	update.Epoch = updateEpoch(s.hasher, update)
+}
+
+// refreshHints returns the time the bundle of every federated trust domain the
+// entries federate with expires, which is when its first root expires.
+func (s *cacheState) refreshHints(entries []*Entry) map[string]time.Time {
+	hints := make(map[string]time.Time)
+	for _, e := range entries {
+		for _, td := range e.FederatesWith {
+			if _, ok := hints[td]; ok {
+				continue
+			}
+			bundle, ok := s.federatedBundles[td]
+			if !ok {
+				continue
+			}
+			var expiry time.Time
+			for _, root := range bundle {
+				if expiry.IsZero() || root.NotAfter.Before(expiry) {
+					expiry = root.NotAfter
+				}
+			}
+			hints[td] = expiry
+		}
+	}
+	return hints
+}
+
+// countDelivery records the given entries as delivered, counting an access
+// to each of them if accesses are counted.
+func (s *cacheState) countDelivery(entries []*Entry) {
+	for _, e := range entries {
+		key := s.keyFunc(e)
+		if delivered, ok := s.delivered[key]; ok {
+			atomic.StoreUint32(delivered, 1)
+		}
+		if count, ok := s.accessCounts[key]; ok {
+			atomic.AddUint64(count, 1)
+		}
+	}
 }
 
 // New creates a new Cache.
-func New(log logrus.FieldLogger, bundle []*x509.Certificate) *cacheImpl {
-	return &cacheImpl{
+func New(log logrus.FieldLogger, bundle []*x509.Certificate, opts ...Option) *cacheImpl {
+	c := &cacheImpl{
 		cache:       make(map[string]*Entry),
 		log:         log.WithField("subsystem_name", "cache"),
-		bundle:      bundle,
+		bundle:      SortedBundle(bundle),
+		jwtBundles:  make(map[string]map[string]crypto.PublicKey),
 		subscribers: NewSubscribers(),
+		nonEmpty:    make(chan struct{}),
+		pickCounts:  make(map[string]uint64),
+		keyFunc:     entryID,
+		dnsIndex:    make(map[string]map[string]bool),
+		delivered:   make(map[string]*uint32),
+		matcher:     subsetMatcher{},
+		hasher:      fnvHasher,
+		clk:         realClock{},
+		// Subscribers start at version zero, so they are sent the initial state.
+		version: 1,
+
+		federatedBundles: make(map[string][]*x509.Certificate),
+		rotationCounts:   make(map[string]uint64),
+		insertedAt:       make(map[string]time.Time),
+		rotations:        newRotationQueue(),
+		pems:             newPEMCache(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.bundle = c.allowedBundle(c.bundle)
+	if c.notifyRate > 0 {
+		c.notifyLimiter = newNotifyLimiter(c.clk, c.notifyRate, c.notifyBurst, c.notify)
+	}
+	if c.manualFlush {
+		c.notifyBatcher = newNotifyBatcher(c.clk, c.flushDelay, c.deliver)
+	}
+	if c.missHintsEnabled {
+		c.missHints = newMissHinter(c.clk, c.missHintInterval)
 	}
+	return c
 }
 
-func (c *cacheImpl) SetBundle(bundle []*x509.Certificate) {
+func (c *cacheImpl) SetBundle(bundle []*x509.Certificate) error {
+	bundle = c.allowedBundle(SortedBundle(bundle))
+	if c.allowedRoots != nil && len(bundle) == 0 {
+		return ErrNoAllowedRoots
+	}
+
 	c.m.Lock()
+	if c.frozen {
+		c.m.Unlock()
+		return ErrFrozen
+	}
 	c.bundle = bundle
+	c.version++
+	c.bundleVersion++
 	c.m.Unlock()
 
 	subs := c.subscribers.getAll()
 	c.notifySubscribers(subs)
+	return nil
 }
 
-func (c *cacheImpl) Bundle() (result []*x509.Certificate) {
-	c.m.Lock()
-	defer c.m.Unlock()
-	result = append(result, c.bundle...)
-	return result
+// allowedBundle returns the roots of bundle allowed by the allowlist, logging
+// the dropped ones.
+func (c *cacheImpl) allowedBundle(bundle []*x509.Certificate) []*x509.Certificate {
+	if c.allowedRoots == nil {
+		return bundle
+	}
+
+	allowed := []*x509.Certificate{}
+	for _, root := range bundle {
+		der, err := x509.MarshalPKIXPublicKey(root.PublicKey)
+		if err == nil && c.allowedRoots[string(der)] {
+			allowed = append(allowed, root)
+			continue
+		}
+		c.log.WithFields(logrus.Fields{
+			"subject":       root.Subject.String(),
+			"serial_number": root.SerialNumber,
+		}).Warn("Dropping bundle root not in the allowlist")
+	}
+	return allowed
 }
 
-func (c *cacheImpl) Entries() []*Entry {
+func (c *cacheImpl) RemoveBundleRoot(cert *x509.Certificate) (removed bool) {
+	if cert == nil {
+		return false
+	}
+
 	c.m.Lock()
-	defer c.m.Unlock()
-	entries := []*Entry{}
-	for _, e := range c.cache {
-		entries = append(entries, e)
+	if c.frozen {
+		c.m.Unlock()
+		c.log.Warn("Bundle root not removed, cache is frozen")
+		return false
 	}
-	return entries
+	bundle := []*x509.Certificate{}
+	for _, root := range c.bundle {
+		if bytes.Equal(root.Raw, cert.Raw) {
+			removed = true
+			continue
+		}
+		bundle = append(bundle, root)
+	}
+	if removed {
+		c.bundle = bundle
+		c.version++
+		c.bundleVersion++
+	}
+	c.m.Unlock()
+
+	if removed {
+		subs := c.subscribers.getAll()
+		c.notifySubscribers(subs)
+	}
+	return
 }
 
-func (c *cacheImpl) Subscribe(sub *subscriber) {
-	c.subscribers.add(sub)
-	c.notifySubscribers([]*subscriber{sub})
+func (c *cacheImpl) Bundle() []*x509.Certificate {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.sharedBundle()
 }
 
-func (c *cacheImpl) Entry(regEntry *common.RegistrationEntry) *Entry {
+// sharedBundle returns the bundle without copying it. The bundle is replaced,
+// and never modified in place, when it changes, so it can be shared. Its
+// capacity is limited so appending to it reallocates. Must be called with
+// the cache lock held.
+func (c *cacheImpl) sharedBundle() []*x509.Certificate {
+	if len(c.bundle) == 0 {
+		return nil
+	}
+	return c.bundle[:len(c.bundle):len(c.bundle)]
+}
+
+func (c *cacheImpl) BundlePEM() ([]byte, error) {
+	return encodeBundle(c.Bundle())
+}
+
+func (c *cacheImpl) BundleCount() int {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return len(c.bundle)
+}
+
+func (c *cacheImpl) SetFederatedBundle(trustDomain string, bundle []*x509.Certificate) {
+	bundle = SortedBundle(bundle)
+
 	c.m.Lock()
-	defer c.m.Unlock()
-	if entry, found := c.cache[regEntry.EntryId]; found {
-		return entry
+	if c.frozen {
+		c.m.Unlock()
+		c.log.Warn("Federated bundle not set, cache is frozen")
+		return
+	}
+	if len(bundle) == 0 {
+		delete(c.federatedBundles, trustDomain)
+	} else {
+		c.federatedBundles[trustDomain] = bundle
+	}
+	c.version++
+	c.m.Unlock()
+
+	subs := c.subscribers.getAll()
+	c.notifySubscribers(subs)
+}
+
+func (c *cacheImpl) FederatedBundle(trustDomain string) []*x509.Certificate {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if bundle, ok := c.federatedBundles[trustDomain]; ok {
+		return append([]*x509.Certificate(nil), bundle...)
 	}
 	return nil
 }
 
-func (c *cacheImpl) SetEntry(entry *Entry) {
+func (c *cacheImpl) FederatedTrustDomains() []string {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	tds := make([]string, 0, len(c.federatedBundles))
+	for td := range c.federatedBundles {
+		if td != c.trustDomain {
+			tds = append(tds, td)
+		}
+	}
+	sort.Strings(tds)
+	return tds
+}
+
+// federatedBundlesCopy returns a copy of all the federated bundles keyed by
+// trust domain. Must be called with the cache lock held.
+func (c *cacheImpl) federatedBundlesCopy() map[string][]*x509.Certificate {
+	bundles := make(map[string][]*x509.Certificate, len(c.federatedBundles))
+	for td, bundle := range c.federatedBundles {
+		bundles[td] = append([]*x509.Certificate(nil), bundle...)
+	}
+	return bundles
+}
+
+func (c *cacheImpl) VerifyFederationRefs() map[string][]string {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	missing := make(map[string][]string)
+	for id, entry := range c.cache {
+		for td := range entry.Bundles {
+			if _, ok := c.federatedBundles[td]; !ok {
+				missing[id] = append(missing[id], td)
+			}
+		}
+		sort.Strings(missing[id])
+	}
+	return missing
+}
+
+func (c *cacheImpl) TrustDomainBundlePEM(trustDomain string) ([]byte, error) {
+	return encodeBundle(c.FederatedBundle(trustDomain))
+}
+
+func (c *cacheImpl) TrustDomainBundleCounts() map[string]int {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	counts := make(map[string]int, len(c.federatedBundles))
+	for td, bundle := range c.federatedBundles {
+		counts[td] = len(bundle)
+	}
+	return counts
+}
+
+func (c *cacheImpl) SetJWTBundle(trustDomain string, keys map[string]crypto.PublicKey) {
 	c.m.Lock()
-	c.cache[entry.RegistrationEntry.EntryId] = entry
+	if c.frozen {
+		c.m.Unlock()
+		c.log.Warn("JWT bundle not set, cache is frozen")
+		return
+	}
+	if len(keys) == 0 {
+		delete(c.jwtBundles, trustDomain)
+	} else {
+		c.jwtBundles[trustDomain] = copyJWTKeys(keys)
+	}
+	c.version++
 	c.m.Unlock()
 
-	subs := c.subscribers.get(entry.RegistrationEntry.Selectors)
+	subs := c.subscribers.getAll()
 	c.notifySubscribers(subs)
 }
 
-func (c *cacheImpl) notifySubscribers(subs []*subscriber) {
-	if subs == nil {
+func (c *cacheImpl) JWTBundle(trustDomain string) map[string]crypto.PublicKey {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if keys, ok := c.jwtBundles[trustDomain]; ok {
+		return copyJWTKeys(keys)
+	}
+	return nil
+}
+
+// jwtBundlesCopy returns a copy of all the JWT bundles keyed by trust domain.
+// Must be called with the cache lock held.
+func (c *cacheImpl) jwtBundlesCopy() map[string]map[string]crypto.PublicKey {
+	bundles := make(map[string]map[string]crypto.PublicKey, len(c.jwtBundles))
+	for td, keys := range c.jwtBundles {
+		bundles[td] = copyJWTKeys(keys)
+	}
+	return bundles
+}
+
+func (c *cacheImpl) SetBundleMetadata(metadata map[string]string) {
+	if len(metadata) == 0 {
+		metadata = nil
+	}
+
+	c.m.Lock()
+	if c.frozen {
+		c.m.Unlock()
+		c.log.Warn("Bundle metadata not set, cache is frozen")
 		return
 	}
+	changed := !metadataEqual(c.bundleMetadata, metadata)
+	if changed {
+		c.bundleMetadata = copyMetadata(metadata)
+		c.version++
+	}
+	c.m.Unlock()
 
-	c.notifyMutex.Lock()
-	defer c.notifyMutex.Unlock()
+	if changed {
+		subs := c.subscribers.getAll()
+		c.notifySubscribers(subs)
+	}
+}
 
-	entries := c.Entries()
-	bundle := c.Bundle()
-	for _, sub := range subs {
-		sub.m.Lock()
-		// If subscriber is not active any more, remove it.
-		if !sub.active {
-			c.subscribers.remove(sub)
-			sub.m.Unlock()
-			continue
-		}
+func (c *cacheImpl) BundleMetadata() map[string]string {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return copyMetadata(c.bundleMetadata)
+}
 
-		if len(sub.c) > 0 {
-			close(sub.c)
-			sub.c = make(chan *WorkloadUpdate, 1)
+func copyMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	c := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		c[k] = v
+	}
+	return c
+}
+
+func metadataEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
 		}
-		subEntries := subscriberEntries(sub, entries)
-		sub.c <- &WorkloadUpdate{Entries: subEntries, Bundle: bundle}
-		sub.m.Unlock()
 	}
+	return true
 }
 
-func (c *cacheImpl) DeleteEntry(regEntry *common.RegistrationEntry) (deleted bool) {
+func (c *cacheImpl) SetDegraded(degraded bool, reason string) {
+	if !degraded {
+		reason = ""
+	}
+
 	c.m.Lock()
-	var subs []*subscriber
-	if entry, found := c.cache[regEntry.EntryId]; found {
-		subs = c.subscribers.get(entry.RegistrationEntry.Selectors)
-		delete(c.cache, regEntry.EntryId)
-		deleted = true
+	if c.frozen {
+		c.m.Unlock()
+		c.log.Warn("Degraded state not set, cache is frozen")
+		return
+	}
+	changed := c.degraded != degraded || c.degradedReason != reason
+	c.degraded = degraded
+	c.degradedReason = reason
+	if changed {
+		c.version++
 	}
 	c.m.Unlock()
 
-	if deleted {
+	if changed {
+		subs := c.subscribers.getAll()
 		c.notifySubscribers(subs)
 	}
-	return
 }
 
-func (c *cacheImpl) IsEmpty() bool {
+func (c *cacheImpl) SetBootstrapComplete() {
+	c.m.Lock()
+	if c.frozen {
+		c.m.Unlock()
+		c.log.Warn("Bootstrap not completed, cache is frozen")
+		return
+	}
+	changed := !c.bootstrapped
+	c.bootstrapped = true
+	if changed {
+		c.version++
+	}
+	c.m.Unlock()
+
+	if changed {
+		subs := c.subscribers.getAll()
+		c.notifySubscribers(subs)
+	}
+}
+
+func (c *cacheImpl) SetSelectorNormalizer(normalizer func(*common.Selector) *common.Selector) {
 	c.m.Lock()
 	defer c.m.Unlock()
-	return len(c.cache) == 0
+	c.normalizer = normalizer
 }
 
-func subscriberEntries(sub *subscriber, entries []*Entry) (subentries []*Entry) {
-	for _, e := range entries {
-		regEntrySelectors := selector.NewSetFromRaw(e.RegistrationEntry.Selectors)
-		if selector.NewSetFromRaw(sub.sel).IncludesSet(regEntrySelectors) {
-			subentries = append(subentries, e)
+func (c *cacheImpl) SetInsertPolicy(policy func(*Entry) error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.insertPolicy = policy
+}
+
+// normalizeSelectors returns the selectors normalized with the cache's
+// normalizer, or the same selectors if there is none.
+func (c *cacheImpl) normalizeSelectors(selectors Selectors) Selectors {
+	c.m.RLock()
+	normalizer := c.normalizer
+	c.m.RUnlock()
+	if normalizer == nil {
+		return selectors
+	}
+
+	normalized := Selectors{}
+	for _, s := range selectors {
+		if n := normalizer(s); n != nil {
+			normalized = append(normalized, n)
+		}
+	}
+	return normalized
+}
+
+// normalizeEntry returns a copy of entry with its registration entry
+// selectors normalized, or the same entry if there is no normalizer.
+func (c *cacheImpl) normalizeEntry(entry *Entry) *Entry {
+	c.m.RLock()
+	normalizer := c.normalizer
+	c.m.RUnlock()
+	if normalizer == nil {
+		return entry
+	}
+
+	regEntry := *entry.RegistrationEntry
+	regEntry.Selectors = c.normalizeSelectors(regEntry.Selectors)
+	normalized := *entry
+	normalized.RegistrationEntry = &regEntry
+	return &normalized
+}
+
+func (c *cacheImpl) Entries() []*Entry {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	entries := []*Entry{}
+	for id, e := range c.cache {
+		c.acknowledge(id)
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// state returns a consistent copy of the cache state.
+func (c *cacheImpl) state() *cacheState {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	state := &cacheState{
+		version:          c.version,
+		entries:          make([]*Entry, 0, len(c.cache)),
+		bundle:           c.sharedBundle(),
+		federatedBundles: c.federatedBundlesCopy(),
+		jwtBundles:       c.jwtBundlesCopy(),
+		bundleMetadata:   copyMetadata(c.bundleMetadata),
+		bundleVersion:    c.bundleVersion,
+		trustDomain:      c.trustDomain,
+		stale:            c.degraded,
+		staleReason:      c.degradedReason,
+		bootstrapped:     c.bootstrapped,
+		keyFunc:          c.keyFunc,
+		hasher:           c.hasher,
+	}
+	for _, e := range c.cache {
+		// Mismatched entries are logged once, when they are stored.
+		if c.keyCheck && !keyMatchesSVID(e) {
+			continue
+		}
+		state.entries = append(state.entries, e)
+	}
+	sortEntries(state.entries)
+	state.delivered = make(map[string]*uint32, len(c.delivered))
+	for id, delivered := range c.delivered {
+		state.delivered[id] = delivered
+	}
+	if c.accessCounts != nil {
+		state.accessCounts = make(map[string]*uint64, len(c.accessCounts))
+		for id, count := range c.accessCounts {
+			state.accessCounts[id] = count
+		}
+	}
+	return state
+}
+
+func (c *cacheImpl) Subscribe(sub *subscriber) error {
+	if c.tooManySelectors(sub.sel) {
+		return ErrTooManySelectors
+	}
+	sub.sel = c.normalizeSelectors(sub.sel)
+	if err := c.addSubscriber(sub); err != nil {
+		return err
+	}
+	c.notifySubscribers([]*subscriber{sub})
+	if !sub.paused {
+		c.checkMiss(sub.sel)
+	}
+	return nil
+}
+
+func (c *cacheImpl) SubscribeAndSnapshot(selectors Selectors) (*WorkloadUpdate, *subscriber, error) {
+	if c.tooManySelectors(selectors) {
+		return nil, nil, ErrTooManySelectors
+	}
+	sub := NewSubscriber(c.normalizeSelectors(selectors))
+
+	// Holding the notification lock keeps notification passes that read an
+	// older state from reaching the subscriber after the snapshot.
+	c.notifyMutex.Lock()
+	defer c.notifyMutex.Unlock()
+
+	if err := c.addSubscriber(sub); err != nil {
+		return nil, nil, err
+	}
+
+	state := c.state()
+	sub.m.Lock()
+	defer sub.m.Unlock()
+	update := state.update(subscriberEntries(c.matcher, sub, state.entries))
+	state.seal(update)
+	sub.version = state.version
+	c.recordDelivery(sub, update)
+	state.countDelivery(update.Entries)
+	if c.missHints != nil && len(update.Entries) == 0 {
+		c.missHints.miss(sub.sel)
+	}
+	return update, sub, nil
+}
+
+// invalidSelector returns the first selector that is nil or has no type or
+// value, and true if there is one.
+func invalidSelector(selectors Selectors) (*common.Selector, bool) {
+	for _, s := range selectors {
+		if s == nil || s.Type == "" || s.Value == "" {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// tooManySelectors returns true if there are more selectors than allowed.
+func (c *cacheImpl) tooManySelectors(selectors Selectors) bool {
+	return c.maxSelectors > 0 && len(selectors) > c.maxSelectors
+}
+
+func (c *cacheImpl) SubscribeSelectors(selectors Selectors, opts ...SubscribeOption) (*subscriber, error) {
+	if s, ok := invalidSelector(selectors); ok {
+		return nil, &InvalidSelectorError{Selector: s}
+	}
+	sub := NewSubscriber(selectors, opts...)
+	if err := c.Subscribe(sub); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (c *cacheImpl) StreamTo(ctx context.Context, sub *subscriber, send func(*WorkloadUpdate) error) error {
+	defer c.Unsubscribe(sub)
+	for {
+		select {
+		case update, ok := <-sub.Updates():
+			if !ok {
+				// The channel is closed when the subscriber is finished, and
+				// replaced when an unread update is.
+				sub.m.Lock()
+				active := sub.active
+				sub.m.Unlock()
+				if !active {
+					return nil
+				}
+				continue
+			}
+			if err := send(update); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *cacheImpl) SubscribeFunc(selectors Selectors, cb func(*WorkloadUpdate)) (func(), error) {
+	sub := NewSubscriber(selectors)
+	sub.callback = cb
+	if err := c.Subscribe(sub); err != nil {
+		return nil, err
+	}
+	return func() { c.Unsubscribe(sub) }, nil
+}
+
+func (c *cacheImpl) UpdateSubscription(sub *subscriber, selectors Selectors) error {
+	if c.tooManySelectors(selectors) {
+		return ErrTooManySelectors
+	}
+	selectors = c.normalizeSelectors(selectors)
+
+	sub.m.Lock()
+	if !sub.active || !c.subscribers.setSelectors(sub, selectors) {
+		sub.m.Unlock()
+		return nil
+	}
+	// Resend the current state, which may have been sent for the previous
+	// selectors.
+	sub.version = 0
+	c.subscriberLog(sub).Debug("Subscriber updated")
+	sub.m.Unlock()
+
+	c.notifySubscribers([]*subscriber{sub})
+	c.checkMiss(selectors)
+	return nil
+}
+
+func (c *cacheImpl) SubscribeDynamic(ctx context.Context, selCh <-chan Selectors) *subscriber {
+	sub := NewSubscriber(nil)
+	// Hold the updates until the subscriber has selectors. Misses are only
+	// checked for the selectors received, not for the empty initial ones.
+	sub.paused = true
+	if err := c.addSubscriber(sub); err != nil {
+		sub.Finish()
+		return sub
+	}
+
+	go func() {
+		defer c.Unsubscribe(sub)
+		first := true
+		for {
+			select {
+			case selectors, ok := <-selCh:
+				if !ok {
+					return
+				}
+				if err := c.UpdateSubscription(sub, selectors); err != nil {
+					c.subscriberLog(sub).WithError(err).Warn("Subscriber selectors not updated")
+					continue
+				}
+				if first {
+					c.ResumeSubscriber(sub)
+					first = false
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return sub
+}
+
+func (c *cacheImpl) SubscribeSPIFFEID(spiffeID string) *subscriber {
+	sub := NewSubscriber(nil)
+	sub.spiffeID = spiffeID
+	if err := c.addSubscriber(sub); err != nil {
+		sub.Finish()
+		return sub
+	}
+	c.notifySubscribers([]*subscriber{sub})
+	return sub
+}
+
+// addSubscriber registers sub, or returns ErrClosed if the cache is closed.
+func (c *cacheImpl) addSubscriber(sub *subscriber) error {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if c.closed {
+		return ErrClosed
+	}
+	c.subscribers.add(sub)
+	c.subscriberLog(sub).Debug("Subscriber added")
+	return nil
+}
+
+func (c *cacheImpl) PauseSubscriber(sub *subscriber) {
+	sub.m.Lock()
+	defer sub.m.Unlock()
+	sub.paused = true
+}
+
+func (c *cacheImpl) ResumeSubscriber(sub *subscriber) {
+	sub.m.Lock()
+	paused := sub.paused
+	sub.paused = false
+	sub.m.Unlock()
+
+	if paused {
+		c.notifySubscribers([]*subscriber{sub})
+	}
+}
+
+func (c *cacheImpl) Unsubscribe(sub *subscriber) {
+	sub.Finish()
+	c.subscribers.remove(sub)
+	c.subscriberLog(sub).Debug("Subscriber removed")
+}
+
+// recordDelivery records the update as sent to the subscriber. Must be called
+// with the subscriber lock held.
+func (c *cacheImpl) recordDelivery(sub *subscriber, update *WorkloadUpdate) {
+	sub.lastUpdate = update
+	if c.historySize > 0 {
+		sub.recordDelivery(update, c.clk.Now(), c.historySize)
+	}
+}
+
+func (c *cacheImpl) DeliveryHistory(sub *subscriber) []WorkloadUpdateView {
+	sub.m.Lock()
+	defer sub.m.Unlock()
+	return sub.deliveryHistory()
+}
+
+func (c *cacheImpl) LastDelivered(sub *subscriber) *WorkloadUpdate {
+	sub.m.Lock()
+	defer sub.m.Unlock()
+	return sub.lastUpdate
+}
+
+func (c *cacheImpl) SubscriberChannelDepth(sub *subscriber) int {
+	sub.m.Lock()
+	defer sub.m.Unlock()
+	return len(sub.c)
+}
+
+func (c *cacheImpl) SubscriberByID(id uint64) *subscriber {
+	return c.subscribers.getByID(id)
+}
+
+func (c *cacheImpl) Entry(regEntry *common.RegistrationEntry) *Entry {
+	return c.entryByKey(c.regEntryKey(regEntry))
+}
+
+func (c *cacheImpl) EntryOrError(key string) (*Entry, error) {
+	if entry := c.entryByKey(key); entry != nil {
+		return entry, nil
+	}
+	return nil, ErrEntryNotFound
+}
+
+// entryByKey gets the cache entry with the given key, or nil if there is none.
+func (c *cacheImpl) entryByKey(key string) *Entry {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if entry, found := c.cache[key]; found {
+		c.countAccess(key)
+		c.acknowledge(key)
+		return entry
+	}
+	return nil
+}
+
+// regEntryKey returns the key of the cache entry for the given registration
+// entry.
+func (c *cacheImpl) regEntryKey(regEntry *common.RegistrationEntry) string {
+	return c.keyFunc(c.normalizeEntry(&Entry{RegistrationEntry: regEntry}))
+}
+
+func (c *cacheImpl) EntriesByIDs(ids []string) map[string]*Entry {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	entries := make(map[string]*Entry)
+	for _, id := range ids {
+		if entry, found := c.cache[id]; found {
+			c.countAccess(id)
+			c.acknowledge(id)
+			entries[id] = entry
+		}
+	}
+	return entries
+}
+
+func (c *cacheImpl) EntriesByParentID(parentID string) []*Entry {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	entries := []*Entry{}
+	for id, entry := range c.cache {
+		if entry.RegistrationEntry.ParentId == parentID {
+			c.countAccess(id)
+			c.acknowledge(id)
+			entries = append(entries, entry)
+		}
+	}
+	sortEntries(entries)
+	return entries
+}
+
+func (c *cacheImpl) EntriesBySPIFFEIDMap() map[string][]*Entry {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	groups := make(map[string][]*Entry)
+	for id, entry := range c.cache {
+		c.countAccess(id)
+		c.acknowledge(id)
+		spiffeID := entry.RegistrationEntry.SpiffeId
+		groups[spiffeID] = append(groups[spiffeID], copyEntry(entry))
+	}
+	for _, entries := range groups {
+		sortEntries(entries)
+	}
+	return groups
+}
+
+func (c *cacheImpl) EntriesByDNSName(name string) []*Entry {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	keys := c.dnsIndex[name]
+	if c.dnsWildcardMatch {
+		if i := strings.Index(name, "."); i > 0 {
+			wildcardKeys := c.dnsIndex["*"+name[i:]]
+			if len(wildcardKeys) > 0 {
+				union := make(map[string]bool, len(keys)+len(wildcardKeys))
+				for key := range keys {
+					union[key] = true
+				}
+				for key := range wildcardKeys {
+					union[key] = true
+				}
+				keys = union
+			}
+		}
+	}
+
+	entries := []*Entry{}
+	for key := range keys {
+		c.countAccess(key)
+		c.acknowledge(key)
+		entries = append(entries, c.cache[key])
+	}
+	sortEntries(entries)
+	return entries
+}
+
+// indexDNSNames indexes the entry stored under key by its SVID DNS names.
+// Must be called with the cache lock held.
+func (c *cacheImpl) indexDNSNames(key string, entry *Entry) {
+	if entry.SVID == nil {
+		return
+	}
+	for _, name := range entry.SVID.DNSNames {
+		if c.dnsIndex[name] == nil {
+			c.dnsIndex[name] = make(map[string]bool)
+		}
+		c.dnsIndex[name][key] = true
+	}
+}
+
+// unindexDNSNames removes the entry stored under key from the DNS name index.
+// Must be called with the cache lock held.
+func (c *cacheImpl) unindexDNSNames(key string, entry *Entry) {
+	if entry.SVID == nil {
+		return
+	}
+	for _, name := range entry.SVID.DNSNames {
+		delete(c.dnsIndex[name], key)
+		if len(c.dnsIndex[name]) == 0 {
+			delete(c.dnsIndex, name)
+		}
+	}
+}
+
+func (c *cacheImpl) PickSVID(spiffeID string) *Entry {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	entries := []*Entry{}
+	for _, entry := range c.cache {
+		if entry.SVID != nil && entry.RegistrationEntry.SpiffeId == spiffeID {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	sortEntries(entries)
+
+	c.pickMutex.Lock()
+	picked := entries[c.pickCounts[spiffeID]%uint64(len(entries))]
+	c.pickCounts[spiffeID]++
+	c.pickMutex.Unlock()
+
+	c.countAccess(c.keyFunc(picked))
+	c.acknowledge(c.keyFunc(picked))
+	return picked
+}
+
+func (c *cacheImpl) SetEntry(entry *Entry) error {
+	entry, err := c.vetEntry(entry)
+	if err != nil {
+		return err
+	}
+	id := c.keyFunc(entry)
+
+	c.m.Lock()
+	if c.frozen {
+		c.m.Unlock()
+		return ErrFrozen
+	}
+	var duplicates []string
+	if c.dedupSPIFFEIDs {
+		var fresher bool
+		duplicates, fresher = c.duplicates(id, entry)
+		if fresher {
+			c.m.Unlock()
+			c.log.WithField("entry_id", id).Debug("Entry with an older SVID than a duplicate dropped")
+			return nil
+		}
+	}
+	if c.acknowledged != nil {
+		current, ok := c.cache[id]
+		switch {
+		case !ok:
+			c.acknowledged[id] = new(uint32)
+		case !current.Equal(entry):
+			if atomic.LoadUint32(c.acknowledged[id]) == 0 {
+				c.m.Unlock()
+				c.log.WithField("entry_id", id).Debug("Conflicting entry rejected")
+				return ErrConflict
+			}
+			c.acknowledged[id] = new(uint32)
+		}
+	}
+	previous := c.cache[id]
+	c.storeEntry(id, entry)
+	var subs []*subscriber
+	for _, key := range duplicates {
+		c.log.WithField("entry_id", key).Debug("Entry with an older SVID than a duplicate evicted")
+		subs = append(subs, c.removeEntry(key, c.cache[key])...)
+	}
+	c.m.Unlock()
+
+	// The subscribers of the previous entry, by selectors or SPIFFE ID, may
+	// lose it.
+	if previous != nil {
+		subs = append(subs, c.entrySubscribers(previous)...)
+	}
+	subs = append(subs, c.entrySubscribers(entry)...)
+	c.notifySubscribers(subs)
+	return nil
+}
+
+// vetEntry returns the entry normalized and with its SVID details set, or an
+// error if it can't be cached.
+func (c *cacheImpl) vetEntry(entry *Entry) (*Entry, error) {
+	if entry == nil || entry.RegistrationEntry == nil {
+		return nil, ErrInvalidEntry
+	}
+	c.m.RLock()
+	policy := c.insertPolicy
+	c.m.RUnlock()
+	if policy != nil {
+		if err := policy(entry); err != nil {
+			return nil, err
+		}
+	}
+	if s, ok := invalidSelector(entry.RegistrationEntry.Selectors); ok {
+		return nil, &InvalidSelectorError{Selector: s}
+	}
+	if c.tooManySelectors(entry.RegistrationEntry.Selectors) {
+		return nil, ErrTooManySelectors
+	}
+	if c.trustDomain != "" && entry.SVID != nil && !inTrustDomain(entry.SVID, c.trustDomain) {
+		return nil, ErrTrustDomainMismatch
+	}
+	entry = withSVIDDetails(c.normalizeEntry(entry))
+	if c.keyFunc(entry) == "" {
+		return nil, ErrInvalidEntry
+	}
+	return entry, nil
+}
+
+// inTrustDomain returns true if the SVID has a single URI SAN, with a SPIFFE
+// ID in the given trust domain.
+func inTrustDomain(svid *x509.Certificate, trustDomain string) bool {
+	if len(svid.URIs) != 1 {
+		return false
+	}
+	id := svid.URIs[0]
+	return strings.EqualFold(id.Scheme, "spiffe") &&
+		strings.EqualFold(id.Host, strings.TrimPrefix(trustDomain, "spiffe://"))
+}
+
+// checkDeliveryKey logs that the entry stored under key won't be delivered if
+// the delivery key check is enabled and its private key doesn't match its
+// SVID. Must be called with the cache lock held.
+func (c *cacheImpl) checkDeliveryKey(key string, entry *Entry) {
+	if c.keyCheck && !keyMatchesSVID(entry) {
+		c.log.WithField("entry_id", key).Warn("Entry won't be delivered, its private key doesn't match its SVID")
+	}
+}
+
+// storeEntry stores the entry under key, replacing the current one if any.
+// Must be called with the cache lock held.
+func (c *cacheImpl) storeEntry(key string, entry *Entry) {
+	c.checkDeliveryKey(key, entry)
+	if current, ok := c.cache[key]; ok {
+		c.unindexDNSNames(key, current)
+		if svidRotated(current, entry) {
+			c.rotationCounts[key]++
+		}
+	} else {
+		c.insertedAt[key] = c.clk.Now()
+	}
+	c.cache[key] = entry
+	c.indexDNSNames(key, entry)
+	c.scheduleRotation(key, entry)
+	c.version++
+	c.signalNonEmpty()
+	if c.delivered[key] == nil {
+		c.delivered[key] = new(uint32)
+	}
+	if c.accessCounts != nil && c.accessCounts[key] == nil {
+		c.accessCounts[key] = new(uint64)
+	}
+}
+
+// duplicates returns the keys of the entries, other than the one stored under
+// key, with the same SPIFFE ID as entry, and true if any of them has an SVID
+// issued after the entry's one. Must be called with the cache lock held.
+func (c *cacheImpl) duplicates(key string, entry *Entry) (keys []string, fresher bool) {
+	for k, e := range c.cache {
+		if k == key || e.RegistrationEntry.SpiffeId != entry.RegistrationEntry.SpiffeId {
+			continue
+		}
+		if svidNotBefore(e).After(svidNotBefore(entry)) {
+			fresher = true
+		}
+		keys = append(keys, k)
+	}
+	return keys, fresher
+}
+
+// dedupEntries removes from entries, keyed by entry key, the ones with the same
+// SPIFFE ID as another entry with an SVID issued after, or with an SVID issued
+// at the same time and a lower key.
+func dedupEntries(entries map[string]*Entry) {
+	kept := make(map[string]string)
+	for key, entry := range entries {
+		spiffeID := entry.RegistrationEntry.SpiffeId
+		keptKey, ok := kept[spiffeID]
+		if !ok {
+			kept[spiffeID] = key
+			continue
+		}
+		keptNotBefore, notBefore := svidNotBefore(entries[keptKey]), svidNotBefore(entry)
+		if notBefore.After(keptNotBefore) || (notBefore.Equal(keptNotBefore) && key < keptKey) {
+			delete(entries, keptKey)
+			kept[spiffeID] = key
+		} else {
+			delete(entries, key)
+		}
+	}
+}
+
+func (c *cacheImpl) WouldNotify(entry *Entry) []uint64 {
+	if entry == nil || entry.RegistrationEntry == nil {
+		return []uint64{}
+	}
+	entry = c.normalizeEntry(entry)
+	return activeSubscriberIDs(c.entrySubscribers(entry))
+}
+
+func (c *cacheImpl) SubscribersForEntry(key string) []uint64 {
+	c.m.RLock()
+	entry, found := c.cache[key]
+	c.m.RUnlock()
+	if !found {
+		return []uint64{}
+	}
+	return activeSubscriberIDs(c.entrySubscribers(entry))
+}
+
+// activeSubscriberIDs returns the sorted IDs of the active subscribers.
+func activeSubscriberIDs(subs []*subscriber) []uint64 {
+	ids := []uint64{}
+	for _, sub := range subs {
+		sub.m.Lock()
+		if sub.active {
+			ids = append(ids, sub.id)
+		}
+		sub.m.Unlock()
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// entrySubscribers returns the subscribers to notify when the given entry
+// changes. The subscriber index only supports the default matcher, other
+// matchers are checked against every subscriber.
+func (c *cacheImpl) entrySubscribers(entry *Entry) []*subscriber {
+	subs := c.subscribers.getBySPIFFEID(entry.RegistrationEntry.SpiffeId)
+	if _, ok := c.matcher.(subsetMatcher); ok {
+		return append(subs, c.subscribers.get(entry.RegistrationEntry.Selectors)...)
+	}
+
+	entrySelectors := selector.NewSetFromRaw(entry.RegistrationEntry.Selectors)
+	for _, sub := range c.subscribers.getAll() {
+		if sub.spiffeID != "" {
+			continue
+		}
+		sub.m.Lock()
+		subSelectors := selector.NewSetFromRaw(sub.sel)
+		sub.m.Unlock()
+		if c.matcher.Matches(entrySelectors, subSelectors) {
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}
+
+func (c *cacheImpl) notifySubscribers(subs []*subscriber) {
+	if subs == nil {
+		return
+	}
+
+	c.suspendMutex.Lock()
+	if c.suspended > 0 {
+		for _, sub := range subs {
+			c.suspendedSubs[sub.id] = sub
+		}
+		c.suspendMutex.Unlock()
+		return
+	}
+	c.suspendMutex.Unlock()
+
+	if c.notifyBatcher != nil {
+		c.notifyBatcher.hold(subs)
+		return
+	}
+	c.deliver(subs)
+}
+
+// deliver runs a notification pass for subs, in the background if notifying
+// asynchronously.
+func (c *cacheImpl) deliver(subs []*subscriber) {
+	if c.asyncNotifier != nil {
+		c.asyncNotifier.enqueue(subs)
+		return
+	}
+	c.limitedNotify(subs)
+}
+
+func (c *cacheImpl) FlushNotifications() {
+	if c.notifyBatcher != nil {
+		c.notifyBatcher.flushAll()
+	}
+}
+
+func (c *cacheImpl) SuspendNotifications() {
+	c.suspendMutex.Lock()
+	defer c.suspendMutex.Unlock()
+	if c.suspended == 0 {
+		c.suspendedSubs = make(map[uint64]*subscriber)
+	}
+	c.suspended++
+}
+
+func (c *cacheImpl) ResumeNotifications() {
+	c.suspendMutex.Lock()
+	if c.suspended == 0 {
+		c.suspendMutex.Unlock()
+		return
+	}
+	c.suspended--
+	if c.suspended > 0 {
+		c.suspendMutex.Unlock()
+		return
+	}
+	var subs []*subscriber
+	for _, sub := range c.suspendedSubs {
+		subs = append(subs, sub)
+	}
+	c.suspendedSubs = nil
+	c.suspendMutex.Unlock()
+
+	c.notifySubscribers(subs)
+}
+
+// limitedNotify runs a notification pass for subs, unless the rate limit
+// defers it.
+func (c *cacheImpl) limitedNotify(subs []*subscriber) {
+	if c.notifyLimiter != nil && !c.notifyLimiter.allow(subs) {
+		return
+	}
+	c.notify(subs)
+}
+
+// notify runs a notification pass, sending the current state to subs.
+func (c *cacheImpl) notify(subs []*subscriber) {
+	c.notifyMutex.Lock()
+	defer c.notifyMutex.Unlock()
+
+	state := c.state()
+	now := c.clk.Now()
+	atomic.StoreInt64(&c.lastNotification, now.UnixNano())
+	// Subscribers with the same selectors match the same entries, so matching
+	// is done once per distinct set of selectors during this pass.
+	matches := make(map[string][]*Entry)
+	for _, sub := range subs {
+		sub.m.Lock()
+		// If subscriber is not active any more, remove it.
+		if !sub.active {
+			c.subscribers.remove(sub)
+			c.subscriberLog(sub).Debug("Inactive subscriber removed")
+			sub.m.Unlock()
+			continue
+		}
+		// Skip paused subscribers and subscribers that already got this state.
+		if sub.paused || sub.version >= state.version {
+			sub.m.Unlock()
+			continue
+		}
+
+		key := sub.matchKey()
+		subEntries, ok := matches[key]
+		if !ok {
+			subEntries = subscriberEntries(c.matcher, sub, state.entries)
+			matches[key] = subEntries
+		}
+		subEntries = sub.freshEntries(subEntries, now)
+		if sub.expiryOnly && !sub.expiryChanged(subEntries, state.keyFunc) {
+			sub.version = state.version
+			sub.m.Unlock()
+			continue
+		}
+
+		received := len(sub.c) == 0
+		if !received {
+			atomic.AddUint64(&c.droppedUpdates, 1)
+			close(sub.c)
+			sub.c = make(chan *WorkloadUpdate, 1)
+		}
+		update := state.update(subEntries)
+		// The epoch covers the fields the subscriber is sent, and the whole
+		// content delta updates bring it to.
+		sub.keepLastBundle(update)
+		sub.filterFields(update)
+		state.seal(update)
+		if sub.delta {
+			sub.setDelta(update, received, state.keyFunc)
+		}
+		if sub.expirySort {
+			sortEntriesByExpiry(update.Entries)
+		}
+		if sub.pem {
+			c.pems.setPEM(update, state.keyFunc)
+		}
+		sub.version = state.version
+		c.recordDelivery(sub, update)
+		if sub.wants(WantEntries) {
+			state.countDelivery(subEntries)
+		}
+		if sub.callback != nil {
+			sub.callback(update)
+		} else {
+			sub.c <- update
+		}
+		sub.m.Unlock()
+	}
+}
+
+func (c *cacheImpl) DeleteEntry(regEntry *common.RegistrationEntry) (deleted bool, err error) {
+	key := c.regEntryKey(regEntry)
+
+	c.m.Lock()
+	if c.frozen {
+		c.m.Unlock()
+		return false, ErrFrozen
+	}
+	var subs []*subscriber
+	if entry, found := c.cache[key]; found {
+		subs = c.removeEntry(key, entry)
+		deleted = true
+	}
+	c.m.Unlock()
+
+	if deleted {
+		c.notifySubscribers(subs)
+	}
+	return deleted, nil
+}
+
+func (c *cacheImpl) SweepExpired() int {
+	now := c.clk.Now()
+
+	c.m.Lock()
+	if c.frozen {
+		c.m.Unlock()
+		c.log.Warn("Expired entries not swept, cache is frozen")
+		return 0
+	}
+	var subs []*subscriber
+	var removed int
+	for key, entry := range c.cache {
+		if entry.SVID != nil && now.After(entry.SVID.NotAfter) {
+			subs = append(subs, c.removeEntry(key, entry)...)
+			removed++
+		}
+	}
+	c.m.Unlock()
+
+	if removed > 0 {
+		c.log.WithField("count", removed).Debug("Expired entries swept")
+		c.notifySubscribers(subs)
+	}
+	return removed
+}
+
+func (c *cacheImpl) SoftDeleteEntry(key string, grace time.Duration) error {
+	c.m.Lock()
+	if c.frozen {
+		c.m.Unlock()
+		return ErrFrozen
+	}
+	entry, found := c.cache[key]
+	if !found {
+		c.m.Unlock()
+		return ErrEntryNotFound
+	}
+	deprecated := *entry
+	deprecated.Deprecated = true
+	c.cache[key] = &deprecated
+	c.version++
+	subs := c.entrySubscribers(entry)
+	c.m.Unlock()
+
+	c.clk.AfterFunc(grace, func() {
+		c.m.Lock()
+		// The entry may have been set again or deleted during the grace period.
+		if c.cache[key] != &deprecated {
+			c.m.Unlock()
+			return
+		}
+		if c.frozen {
+			c.m.Unlock()
+			c.log.WithField("entry_id", key).Warn("Deprecated entry not removed, cache is frozen")
+			return
+		}
+		subs := c.removeEntry(key, &deprecated)
+		c.m.Unlock()
+		c.notifySubscribers(subs)
+	})
+
+	c.notifySubscribers(subs)
+	return nil
+}
+
+// removeEntry removes the entry stored under key and returns the subscribers
+// to notify. Must be called with the cache lock held.
+func (c *cacheImpl) removeEntry(key string, entry *Entry) []*subscriber {
+	delete(c.cache, key)
+	c.unindexDNSNames(key, entry)
+	c.version++
+	c.signalNonEmpty()
+	delete(c.delivered, key)
+	delete(c.rotationCounts, key)
+	delete(c.insertedAt, key)
+	c.rotations.remove(key)
+	c.pems.forget(key)
+	if c.accessCounts != nil {
+		delete(c.accessCounts, key)
+	}
+	if c.acknowledged != nil {
+		delete(c.acknowledged, key)
+	}
+	return c.entrySubscribers(entry)
+}
+
+func (c *cacheImpl) Reset(entries []*Entry, bundle []*x509.Certificate) {
+	cache := make(map[string]*Entry, len(entries))
+	for _, entry := range entries {
+		entry, err := c.vetEntry(entry)
+		if err != nil {
+			c.log.WithError(err).Warn("Entry ignored by reset")
+			continue
+		}
+		cache[c.keyFunc(entry)] = entry
+	}
+	if c.dedupSPIFFEIDs {
+		dedupEntries(cache)
+	}
+	bundle = c.allowedBundle(SortedBundle(bundle))
+
+	c.m.Lock()
+	if c.frozen {
+		c.m.Unlock()
+		c.log.Warn("Cache not reset, cache is frozen")
+		return
+	}
+	now := c.clk.Now()
+	rotationCounts := make(map[string]uint64, len(cache))
+	insertedAt := make(map[string]time.Time, len(cache))
+	for id, entry := range cache {
+		current, ok := c.cache[id]
+		if !ok {
+			insertedAt[id] = now
+			continue
+		}
+		insertedAt[id] = c.insertedAt[id]
+		rotationCounts[id] = c.rotationCounts[id]
+		if svidRotated(current, entry) {
+			rotationCounts[id]++
+		}
+	}
+	c.rotationCounts = rotationCounts
+	c.insertedAt = insertedAt
+	c.cache = cache
+	c.dnsIndex = make(map[string]map[string]bool)
+	c.rotations = newRotationQueue()
+	c.pems.retain(cache)
+	for key, entry := range cache {
+		c.checkDeliveryKey(key, entry)
+		c.indexDNSNames(key, entry)
+		c.scheduleRotation(key, entry)
+	}
+	c.bundle = bundle
+	c.version++
+	c.bundleVersion++
+	c.signalNonEmpty()
+	// Keep the delivery state and counts of the entries still present.
+	delivered := make(map[string]*uint32, len(cache))
+	for id := range cache {
+		if d, ok := c.delivered[id]; ok {
+			delivered[id] = d
+		} else {
+			delivered[id] = new(uint32)
+		}
+	}
+	c.delivered = delivered
+	if c.accessCounts != nil {
+		accessCounts := make(map[string]*uint64, len(cache))
+		for id := range cache {
+			if count, ok := c.accessCounts[id]; ok {
+				accessCounts[id] = count
+			} else {
+				accessCounts[id] = new(uint64)
+			}
+		}
+		c.accessCounts = accessCounts
+	}
+	if c.acknowledged != nil {
+		c.acknowledged = make(map[string]*uint32, len(cache))
+		for id := range cache {
+			c.acknowledged[id] = new(uint32)
+		}
+	}
+	c.m.Unlock()
+
+	subs := c.subscribers.getAll()
+	c.notifySubscribers(subs)
+}
+
+func (c *cacheImpl) Reconcile(authoritative []*Entry) ReconcileResult {
+	entries := make(map[string]*Entry, len(authoritative))
+	for _, entry := range authoritative {
+		entry, err := c.vetEntry(entry)
+		if err != nil {
+			c.log.WithError(err).Warn("Entry ignored by reconciliation")
+			continue
+		}
+		entries[c.keyFunc(entry)] = entry
+	}
+	if c.dedupSPIFFEIDs {
+		dedupEntries(entries)
+	}
+
+	var result ReconcileResult
+	c.m.Lock()
+	if c.frozen {
+		c.m.Unlock()
+		c.log.Warn("Cache not reconciled, cache is frozen")
+		return result
+	}
+	var subs []*subscriber
+	for key, current := range c.cache {
+		if _, ok := entries[key]; !ok {
+			subs = append(subs, c.removeEntry(key, current)...)
+			result.Removed = append(result.Removed, key)
+		}
+	}
+	for key, entry := range entries {
+		current, ok := c.cache[key]
+		switch {
+		case !ok:
+			result.Added = append(result.Added, key)
+		case current.Equal(entry):
+			result.Unchanged = append(result.Unchanged, key)
+			continue
+		default:
+			result.Updated = append(result.Updated, key)
+			subs = append(subs, c.entrySubscribers(current)...)
+		}
+		c.storeEntry(key, entry)
+		if c.acknowledged != nil {
+			c.acknowledged[key] = new(uint32)
+		}
+		subs = append(subs, c.entrySubscribers(entry)...)
+	}
+	c.m.Unlock()
+
+	sort.Strings(result.Added)
+	sort.Strings(result.Updated)
+	sort.Strings(result.Removed)
+	sort.Strings(result.Unchanged)
+	c.notifySubscribers(subs)
+	return result
+}
+
+func (c *cacheImpl) Freeze() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.frozen = true
+}
+
+func (c *cacheImpl) Unfreeze() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.frozen = false
+}
+
+func (c *cacheImpl) Close() {
+	c.m.Lock()
+	c.closed = true
+	c.m.Unlock()
+
+	for _, sub := range c.subscribers.getAll() {
+		c.Unsubscribe(sub)
+	}
+}
+
+func (c *cacheImpl) UndeliveredEntries() []*Entry {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	entries := []*Entry{}
+	for id, entry := range c.cache {
+		if atomic.LoadUint32(c.delivered[id]) == 0 {
+			entries = append(entries, entry)
+		}
+	}
+	sortEntries(entries)
+	return entries
+}
+
+func (c *cacheImpl) EntryAccessCount(entryID string) uint64 {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if count, ok := c.accessCounts[entryID]; ok {
+		return atomic.LoadUint64(count)
+	}
+	return 0
+}
+
+func (c *cacheImpl) EntryRotationCount(entryID string) uint64 {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.rotationCounts[entryID]
+}
+
+func (c *cacheImpl) OldestEntryTime() (oldest time.Time, ok bool) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	for _, t := range c.insertedAt {
+		if !ok || t.Before(oldest) {
+			oldest, ok = t, true
+		}
+	}
+	return oldest, ok
+}
+
+func (c *cacheImpl) NewestEntryTime() (newest time.Time, ok bool) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	for _, t := range c.insertedAt {
+		if !ok || t.After(newest) {
+			newest, ok = t, true
+		}
+	}
+	return newest, ok
+}
+
+// keyMatchesSVID returns true if the entry private key is the one of its SVID
+// public key, or if the entry lacks either of them.
+func keyMatchesSVID(e *Entry) bool {
+	if e.PrivateKey == nil || e.SVID == nil {
+		return true
+	}
+	svidKey, err := x509.MarshalPKIXPublicKey(e.SVID.PublicKey)
+	if err != nil {
+		return false
+	}
+	key, err := x509.MarshalPKIXPublicKey(e.PrivateKey.Public())
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(svidKey, key)
+}
+
+// svidRotated returns true if next holds an SVID with a different serial
+// number than the one of current.
+func svidRotated(current, next *Entry) bool {
+	switch {
+	case next.SVID == nil:
+		return false
+	case current.SVID == nil:
+		return true
+	case current.SVID.SerialNumber == nil || next.SVID.SerialNumber == nil:
+		return current.SVID.SerialNumber != next.SVID.SerialNumber
+	}
+	return current.SVID.SerialNumber.Cmp(next.SVID.SerialNumber) != 0
+}
+
+// countAccess counts an access to the entry with the given ID, if accesses
+// are counted. Must be called with the cache lock held.
+func (c *cacheImpl) countAccess(entryID string) {
+	if count, ok := c.accessCounts[entryID]; ok {
+		atomic.AddUint64(count, 1)
+	}
+}
+
+func (c *cacheImpl) NextRotation(threshold time.Duration) (next time.Time, ok bool) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	for _, e := range c.cache {
+		if e.SVID == nil {
+			continue
+		}
+		if rotation := e.RotationTime(threshold); !ok || rotation.Before(next) {
+			next = rotation
+			ok = true
+		}
+	}
+	return next, ok
+}
+
+func (c *cacheImpl) Generation() uint64 {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.version
+}
+
+func (c *cacheImpl) WaitNonEmpty(ctx context.Context) error {
+	c.m.RLock()
+	nonEmpty := c.nonEmpty
+	c.m.RUnlock()
+
+	// Checked first, so a done context doesn't win over existing entries.
+	select {
+	case <-nonEmpty:
+		return nil
+	default:
+	}
+
+	select {
+	case <-nonEmpty:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// signalNonEmpty closes the nonEmpty channel when the cache gets entries, and
+// replaces it when the cache gets empty. Must be called with the cache lock
+// held.
+func (c *cacheImpl) signalNonEmpty() {
+	select {
+	case <-c.nonEmpty:
+		if len(c.cache) == 0 {
+			c.nonEmpty = make(chan struct{})
+		}
+	default:
+		if len(c.cache) > 0 {
+			close(c.nonEmpty)
+		}
+	}
+}
+
+// acknowledge records that the entry with the given ID was read, if in strict
+// mode. Must be called with the cache lock held.
+func (c *cacheImpl) acknowledge(entryID string) {
+	if ack, ok := c.acknowledged[entryID]; ok {
+		atomic.StoreUint32(ack, 1)
+	}
+}
+
+func (c *cacheImpl) IsEmpty() bool {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return len(c.cache) == 0
+}
+
+func (c *cacheImpl) HasMatch(selectors Selectors) bool {
+	selectors = c.normalizeSelectors(selectors)
+	if c.hasMatch(selectors) {
+		return true
+	}
+	if c.missHints != nil {
+		c.missHints.miss(selectors)
+	}
+	return false
+}
+
+func (c *cacheImpl) MissHints() <-chan Selectors {
+	if c.missHints == nil {
+		return nil
+	}
+	return c.missHints.c
+}
+
+// checkMiss emits a miss hint for the normalized selectors if they don't
+// match any entry and miss hints are enabled.
+func (c *cacheImpl) checkMiss(selectors Selectors) {
+	if c.missHints != nil && !c.hasMatch(selectors) {
+		c.missHints.miss(selectors)
+	}
+}
+
+// hasMatch returns true if at least one cached entry matches the normalized
+// selectors.
+func (c *cacheImpl) hasMatch(selectors Selectors) bool {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	set := selector.NewSetFromRaw(selectors)
+	for _, e := range c.cache {
+		if c.matcher.Matches(selector.NewSetFromRaw(e.RegistrationEntry.Selectors), set) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cacheImpl) ExplainMatch(selectors Selectors) []MatchExplanation {
+	selectors = c.normalizeSelectors(selectors)
+
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	set := selector.NewSetFromRaw(selectors)
+	explanations := []MatchExplanation{}
+	for key, e := range c.cache {
+		explanation := MatchExplanation{
+			EntryID: key,
+			Matched: c.matcher.Matches(selector.NewSetFromRaw(e.RegistrationEntry.Selectors), set),
+		}
+		if !explanation.Matched {
+			explanation.MissingSelectors = missingSelectors(set, e)
+		}
+		explanations = append(explanations, explanation)
+	}
+	sort.Slice(explanations, func(i, j int) bool {
+		return explanations[i].EntryID < explanations[j].EntryID
+	})
+	return explanations
+}
+
+func (c *cacheImpl) Validate() error {
+	var problems ValidationError
+	if err := c.checkInvariants(); err != nil {
+		problems = append(problems, err)
+	}
+	problems = append(problems, c.verifyChains()...)
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// verifyChains returns an error for every cached SVID that is not currently
+// valid or doesn't chain to the bundle, sorted by entry ID.
+func (c *cacheImpl) verifyChains() (errs []error) {
+	c.m.RLock()
+	roots := x509.NewCertPool()
+	for _, root := range c.bundle {
+		roots.AddCert(root)
+	}
+	ids := make([]string, 0, len(c.cache))
+	svids := make(map[string]*x509.Certificate, len(c.cache))
+	for id, e := range c.cache {
+		if e != nil && e.SVID != nil {
+			ids = append(ids, id)
+			svids[id] = e.SVID
+		}
+	}
+	c.m.RUnlock()
+	sort.Strings(ids)
+
+	now := c.clk.Now()
+	for _, id := range ids {
+		svid := svids[id]
+		switch {
+		case now.After(svid.NotAfter):
+			errs = append(errs, fmt.Errorf("entry %q SVID expired at %v", id, svid.NotAfter))
+		case now.Before(svid.NotBefore):
+			errs = append(errs, fmt.Errorf("entry %q SVID is not valid before %v", id, svid.NotBefore))
+		default:
+			_, err := svid.Verify(x509.VerifyOptions{
+				Roots:       roots,
+				CurrentTime: now,
+				KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+			})
+			if err != nil {
+				errs = append(errs, fmt.Errorf("entry %q SVID does not chain to the bundle: %v", id, err))
+			}
+		}
+	}
+	return errs
+}
+
+// checkInvariants verifies the consistency of the cache internal state,
+// returning an error describing the first violation found.
+func (c *cacheImpl) checkInvariants() error {
+	if err := c.checkEntryInvariants(); err != nil {
+		return err
+	}
+	return c.subscribers.checkInvariants()
+}
+
+// checkEntryInvariants checks that the entries are stored under their key,
+// and that the DNS name index, the rotation schedule, the insertion times and
+// the rotation counts agree with them.
+func (c *cacheImpl) checkEntryInvariants() error {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	for id, entry := range c.cache {
+		if entry == nil || entry.RegistrationEntry == nil {
+			return fmt.Errorf("entry %q has no registration entry", id)
+		}
+		if key := c.keyFunc(entry); key != id {
+			return fmt.Errorf("entry %q is stored under ID %q", key, id)
+		}
+		if _, ok := c.insertedAt[id]; !ok {
+			return fmt.Errorf("entry %q has no insertion time", id)
+		}
+		if entry.SVID != nil {
+			for _, name := range entry.SVID.DNSNames {
+				if !c.dnsIndex[name][id] {
+					return fmt.Errorf("entry %q is not indexed under DNS name %q", id, name)
+				}
+			}
+		}
+	}
+	for id := range c.insertedAt {
+		if _, ok := c.cache[id]; !ok {
+			return fmt.Errorf("insertion time of unknown entry %q", id)
+		}
+	}
+	for id := range c.rotationCounts {
+		if _, ok := c.cache[id]; !ok {
+			return fmt.Errorf("rotation count of unknown entry %q", id)
+		}
+	}
+	for name, keys := range c.dnsIndex {
+		if len(keys) == 0 {
+			return fmt.Errorf("DNS name index bucket %s is empty", name)
+		}
+		for key := range keys {
+			if entry, ok := c.cache[key]; !ok || !hasDNSName(entry, name) {
+				return fmt.Errorf("DNS name index bucket %s references entry %q without the name", name, key)
+			}
+		}
+	}
+	return c.rotations.checkInvariants(c.cache, c.rotationThreshold)
+}
+
+// hasDNSName returns true if the entry SVID has the given DNS name.
+func hasDNSName(entry *Entry, name string) bool {
+	if entry.SVID == nil {
+		return false
+	}
+	for _, n := range entry.SVID.DNSNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cacheImpl) subscriberLog(sub *subscriber) logrus.FieldLogger {
+	if sub.spiffeID != "" {
+		return c.log.WithFields(logrus.Fields{
+			"subscriber_id": sub.id,
+			"spiffe_id":     sub.spiffeID,
+		})
+	}
+	return c.log.WithFields(logrus.Fields{
+		"subscriber_id": sub.id,
+		"selectors":     selector.NewSetFromRaw(sub.sel).String(),
+	})
+}
+
+func subscriberEntries(matcher SelectorMatcher, sub *subscriber, entries []*Entry) (subentries []*Entry) {
+	if sub.spiffeID != "" {
+		for _, e := range entries {
+			if e.RegistrationEntry.SpiffeId == sub.spiffeID {
+				subentries = append(subentries, e)
+			}
+		}
+		return
+	}
+	subSelectors := selector.NewSetFromRaw(sub.sel)
+	for _, e := range entries {
+		regEntrySelectors := selector.NewSetFromRaw(e.RegistrationEntry.Selectors)
+		if matcher.Matches(regEntrySelectors, subSelectors) {
+			subentries = append(subentries, e)
+		}
+	}
+	return
+}
+
+// SortedBundle returns a copy of bundle sorted by the certificates' DER bytes,
+// so the same set of certificates always yields the same ordering.
+func SortedBundle(bundle []*x509.Certificate) []*x509.Certificate {
+	sorted := append([]*x509.Certificate(nil), bundle...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].Raw, sorted[j].Raw) < 0
+	})
+	return sorted
+}
+
+// encodeBundle returns the bundle certificates as concatenated PEM blocks, or
+// nil if there are none.
+func encodeBundle(bundle []*x509.Certificate) ([]byte, error) {
+	if len(bundle) == 0 {
+		return nil, nil
+	}
+	buf := new(bytes.Buffer)
+	for _, cert := range bundle {
+		if err := pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func copyJWTKeys(keys map[string]crypto.PublicKey) map[string]crypto.PublicKey {
+	copied := make(map[string]crypto.PublicKey, len(keys))
+	for kid, key := range keys {
+		copied[kid] = key
+	}
+	return copied
+}
+
+// svidNotBefore returns the time the entry SVID was issued, or the zero time
+// if it has no SVID.
+func svidNotBefore(e *Entry) time.Time {
+	if e.SVID == nil {
+		return time.Time{}
+	}
+	return e.SVID.NotBefore
+}
+
+// entryID returns the entry ID of the entry, the default entry key.
+func entryID(e *Entry) string {
+	return e.RegistrationEntry.EntryId
+}
+
+func regEntriesEqual(a, b *common.RegistrationEntry) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.EntryId == b.EntryId &&
+		a.ParentId == b.ParentId &&
+		a.SpiffeId == b.SpiffeId &&
+		selectorsKey(a.Selectors) == selectorsKey(b.Selectors) &&
+		stringSetsEqual(a.FbSpiffeIds, b.FbSpiffeIds)
+}
+
+func svidsEqual(a, b *x509.Certificate) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.SerialNumber == nil || b.SerialNumber == nil {
+		if a.SerialNumber != b.SerialNumber {
+			return false
+		}
+	} else if a.SerialNumber.Cmp(b.SerialNumber) != 0 {
+		return false
+	}
+	return a.NotAfter.Equal(b.NotAfter)
+}
+
+func bundlesEqual(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id, bundle := range a {
+		other, ok := b[id]
+		if !ok || !bytes.Equal(bundle, other) {
+			return false
+		}
+	}
+	return true
+}
+
+func stringSetsEqual(a, b []string) bool {
+	setA, setB := stringSet(a), stringSet(b)
+	if len(setA) != len(setB) {
+		return false
+	}
+	for s := range setA {
+		if !setB[s] {
+			return false
+		}
+	}
+	return true
+}
+
+func stringSet(strs []string) map[string]bool {
+	set := make(map[string]bool, len(strs))
+	for _, s := range strs {
+		set[s] = true
+	}
+	return set
+}
+
+// selectorsKey returns a string uniquely identifying the set of selectors,
+// regardless of their order or duplicates.
+func selectorsKey(selectors Selectors) string {
+	keys := []string{}
+	for _, s := range selector.NewSetFromRaw(selectors).Array() {
+		keys = append(keys, s.Type+":"+s.Value)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "\x00")
+}
+
+// missingSelectors returns the entry's selectors that are not included in set.
+// The entry matches the set when no selectors are missing.
+func missingSelectors(set selector.Set, e *Entry) (missing Selectors) {
+	for _, s := range e.RegistrationEntry.Selectors {
+		if !set.IncludesSet(selector.NewSet(selector.New(s))) {
+			missing = append(missing, s)
 		}
 	}
 	return
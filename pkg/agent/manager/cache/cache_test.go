@@ -1,12 +1,21 @@
 package cache
 
 import (
+	"context"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc64"
+	"math/big"
+	"net/url"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,6 +28,7 @@ import (
 	"github.com/spiffe/spire/proto/common"
 	"github.com/spiffe/spire/test/util"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var (
@@ -43,6 +53,7 @@ func TestCacheImpl_Valid(t *testing.T) {
 					Selectors: Selectors{&common.Selector{Type: "testtype", Value: "testValue"}},
 					ParentId:  "spiffe:parent",
 					SpiffeId:  "spiffe:test",
+					EntryId:   "00000000-0000-0000-0000-000000000000",
 				},
 				SVID:       &x509.Certificate{},
 				PrivateKey: privateKey,
@@ -55,7 +66,8 @@ func TestCacheImpl_Valid(t *testing.T) {
 						&common.Selector{Type: "testtype1", Value: "testValue2"},
 						&common.Selector{Type: "testtype1", Value: "testValue3"}},
 					ParentId: "spiffe:parent",
-					SpiffeId: "spiffe:test"},
+					SpiffeId: "spiffe:test",
+					EntryId:  "00000000-0000-0000-0000-000000000001"},
 				SVID:       &x509.Certificate{},
 				PrivateKey: privateKey,
 			}}}
@@ -64,6 +76,7 @@ func TestCacheImpl_Valid(t *testing.T) {
 			cache.SetEntry(test.ce)
 			actual := cache.Entry(test.ce.RegistrationEntry)
 			assert.Equal(t, actual, test.ce)
+			assert.NoError(t, cache.checkInvariants())
 
 		})
 	}
@@ -122,7 +135,8 @@ func TestCacheImpl_DeleteEntry(t *testing.T) {
 				RegistrationEntry: &common.RegistrationEntry{
 					Selectors: Selectors{&common.Selector{Type: "testtype", Value: "testValue"}},
 					ParentId:  "spiffe:parent",
-					SpiffeId:  "spiffe:test"},
+					SpiffeId:  "spiffe:test",
+					EntryId:   "00000000-0000-0000-0000-000000000000"},
 				SVID:       &x509.Certificate{},
 				PrivateKey: privateKey,
 			}},
@@ -134,19 +148,23 @@ func TestCacheImpl_DeleteEntry(t *testing.T) {
 						&common.Selector{Type: "testtype2", Value: "testValue2"},
 						&common.Selector{Type: "testtype1", Value: "testValue3"}},
 					ParentId: "spiffe:parent",
-					SpiffeId: "spiffe:test"},
+					SpiffeId: "spiffe:test",
+					EntryId:  "00000000-0000-0000-0000-000000000001"},
 				SVID:       &x509.Certificate{},
 				PrivateKey: privateKey,
 			}}}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			cache.SetEntry(test.ce)
-			deleted := cache.DeleteEntry(test.ce.RegistrationEntry)
+			deleted, err := cache.DeleteEntry(test.ce.RegistrationEntry)
+			assert.NoError(t, err)
 			assert.True(t, deleted)
 			entry := cache.Entry(test.ce.RegistrationEntry)
 			assert.Empty(t, entry)
-			deleted = cache.DeleteEntry(test.ce.RegistrationEntry)
+			deleted, err = cache.DeleteEntry(test.ce.RegistrationEntry)
+			assert.NoError(t, err)
 			assert.False(t, deleted)
+			assert.NoError(t, cache.checkInvariants())
 
 		})
 	}
@@ -183,11 +201,8 @@ func TestNotifySubscribersDoesntBlockOnSubscriberWrite(t *testing.T) {
 	}
 	cache.SetEntry(e2)
 
-	sub1, err := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}})
-	assert.Nil(t, err)
-
-	sub2, err := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1000"}})
-	assert.Nil(t, err)
+	sub1 := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}})
+	sub2 := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1000"}})
 
 	cache.notifySubscribers([]*subscriber{sub1, sub2})
 
@@ -221,8 +236,7 @@ func TestNotifySubscribersDoesntPileUpGoroutines(t *testing.T) {
 	}
 	cache.SetEntry(e2)
 
-	sub1, err := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}})
-	assert.Nil(t, err)
+	sub1 := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}})
 
 	util.RunWithTimeout(t, 5*time.Second, func() {
 		ng := runtime.NumGoroutine()
@@ -236,8 +250,7 @@ func TestNotifySubscribersDoesntPileUpGoroutines(t *testing.T) {
 func TestNotifySubscribersNotifiesLatestUpdatesToSlowSubscriber(t *testing.T) {
 	cache := New(logger, nil)
 
-	sub, err := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}})
-	assert.Nil(t, err)
+	sub := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}})
 
 	cache.Subscribe(sub)
 
@@ -303,8 +316,7 @@ func TestNotifySubscribersNotifiesLatestUpdatesToSlowSubscriber(t *testing.T) {
 func TestSubscriberFinish(t *testing.T) {
 	cache := New(logger, nil)
 
-	sub, err := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}})
-	assert.Nil(t, err)
+	sub := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}})
 
 	cache.Subscribe(sub)
 
@@ -337,4 +349,3767 @@ func TestSubscriberFinish(t *testing.T) {
 		wu := <-sub.Updates()
 		assert.Nil(t, wu)
 	})
+	assert.NoError(t, cache.checkInvariants())
+}
+
+func TestHasMatch(t *testing.T) {
+	cache := New(logger, nil)
+
+	// Empty cache doesn't match anything.
+	assert.False(t, cache.HasMatch(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}))
+
+	cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			Selectors: Selectors{
+				&common.Selector{Type: "unix", Value: "uid:1111"},
+				&common.Selector{Type: "unix", Value: "gid:2222"},
+			},
+			ParentId: "spiffe:parent",
+			SpiffeId: "spiffe:test",
+			EntryId:  "00000000-0000-0000-0000-000000000001",
+		},
+		SVID:       &x509.Certificate{},
+		PrivateKey: privateKey,
+	})
+
+	tests := []struct {
+		name      string
+		selectors Selectors
+		match     bool
+	}{
+		{name: "exact_selectors",
+			selectors: Selectors{
+				&common.Selector{Type: "unix", Value: "uid:1111"},
+				&common.Selector{Type: "unix", Value: "gid:2222"},
+			},
+			match: true},
+		{name: "superset_selectors",
+			selectors: Selectors{
+				&common.Selector{Type: "unix", Value: "uid:1111"},
+				&common.Selector{Type: "unix", Value: "gid:2222"},
+				&common.Selector{Type: "k8s", Value: "ns:default"},
+			},
+			match: true},
+		{name: "subset_selectors",
+			selectors: Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}},
+			match:     false},
+		{name: "unrelated_selectors",
+			selectors: Selectors{&common.Selector{Type: "unix", Value: "uid:3333"}},
+			match:     false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.match, cache.HasMatch(test.selectors))
+		})
+	}
+}
+
+func TestSubscriberLifecycleLogging(t *testing.T) {
+	log, hook := testlog.NewNullLogger()
+	log.Level = logrus.DebugLevel
+	cache := New(log, nil)
+
+	sub := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}})
+
+	cache.Subscribe(sub)
+	cache.Unsubscribe(sub)
+
+	entries := hook.AllEntries()
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "Subscriber added", entries[0].Message)
+	assert.Equal(t, "Subscriber removed", entries[1].Message)
+	for _, entry := range entries {
+		assert.Equal(t, logrus.DebugLevel, entry.Level)
+		assert.Equal(t, sub.id, entry.Data["subscriber_id"])
+		assert.Equal(t, "[unix:uid:1111]", entry.Data["selectors"])
+	}
+
+	// Subscriber no longer receives updates and Finish after Unsubscribe is a no-op.
+	assert.Empty(t, cache.subscribers.getAll())
+	sub.Finish()
+}
+
+func TestInactiveSubscriberRemovalLogging(t *testing.T) {
+	log, hook := testlog.NewNullLogger()
+	log.Level = logrus.DebugLevel
+	cache := New(log, nil)
+
+	sub := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}})
+
+	cache.Subscribe(sub)
+	sub.Finish()
+	cache.SetBundle(nil)
+
+	entry := hook.LastEntry()
+	assert.Equal(t, "Inactive subscriber removed", entry.Message)
+	assert.Equal(t, sub.id, entry.Data["subscriber_id"])
+	assert.Empty(t, cache.subscribers.getAll())
+}
+
+func TestSubscriberID(t *testing.T) {
+	cache := New(logger, nil)
+
+	sub1 := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}})
+	sub2 := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}})
+
+	// IDs are unique, assigned in increasing order and stable.
+	assert.NotEqual(t, sub1.ID(), sub2.ID())
+	assert.True(t, sub1.ID() < sub2.ID())
+	id := sub1.ID()
+
+	// Subscribers aren't found until they are subscribed.
+	assert.Nil(t, cache.SubscriberByID(sub1.ID()))
+
+	cache.Subscribe(sub1)
+	cache.Subscribe(sub2)
+	assert.Equal(t, id, sub1.ID())
+	assert.Equal(t, sub1, cache.SubscriberByID(sub1.ID()))
+	assert.Equal(t, sub2, cache.SubscriberByID(sub2.ID()))
+
+	cache.Unsubscribe(sub1)
+	assert.Nil(t, cache.SubscriberByID(sub1.ID()))
+	assert.Equal(t, sub2, cache.SubscriberByID(sub2.ID()))
+	assert.NoError(t, cache.checkInvariants())
+}
+
+func TestRemoveBundleRoot(t *testing.T) {
+	root1 := &x509.Certificate{Raw: []byte("root1")}
+	root2 := &x509.Certificate{Raw: []byte("root2")}
+	root3 := &x509.Certificate{Raw: []byte("root3")}
+	cache := New(logger, []*x509.Certificate{root1, root2})
+
+	sub := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}})
+	cache.Subscribe(sub)
+	// Consume the update sent by Subscribe function.
+	<-sub.Updates()
+
+	// Removing a root that isn't in the bundle is a no-op.
+	assert.False(t, cache.RemoveBundleRoot(root3))
+	assert.False(t, cache.RemoveBundleRoot(nil))
+	assert.Equal(t, []*x509.Certificate{root1, root2}, cache.Bundle())
+	assert.Equal(t, 0, len(sub.Updates()))
+
+	// Roots are compared by their DER bytes.
+	assert.True(t, cache.RemoveBundleRoot(&x509.Certificate{Raw: []byte("root1")}))
+	assert.Equal(t, []*x509.Certificate{root2}, cache.Bundle())
+
+	util.RunWithTimeout(t, 5*time.Second, func() {
+		wu := <-sub.Updates()
+		assert.Equal(t, []*x509.Certificate{root2}, wu.Bundle)
+	})
+}
+
+func TestReset(t *testing.T) {
+	oldRoot := &x509.Certificate{Raw: []byte("old")}
+	newRoot := &x509.Certificate{Raw: []byte("new")}
+	cache := New(logger, []*x509.Certificate{oldRoot})
+
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	oldEntry := &Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			Selectors: selectors,
+			ParentId:  "spiffe:parent",
+			SpiffeId:  "spiffe:old",
+			EntryId:   "00000000-0000-0000-0000-000000000001",
+		},
+		SVID:       &x509.Certificate{},
+		PrivateKey: privateKey,
+	}
+	newEntry := &Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			Selectors: selectors,
+			ParentId:  "spiffe:parent",
+			SpiffeId:  "spiffe:new",
+			EntryId:   "00000000-0000-0000-0000-000000000002",
+		},
+		SVID:       &x509.Certificate{},
+		PrivateKey: privateKey,
+	}
+	cache.SetEntry(oldEntry)
+
+	sub := NewSubscriber(selectors)
+	cache.Subscribe(sub)
+	// Consume the update sent by Subscribe function.
+	<-sub.Updates()
+
+	cache.Reset([]*Entry{newEntry}, []*x509.Certificate{newRoot})
+
+	assert.Nil(t, cache.Entry(oldEntry.RegistrationEntry))
+	assert.Equal(t, newEntry, cache.Entry(newEntry.RegistrationEntry))
+	assert.Equal(t, []*x509.Certificate{newRoot}, cache.Bundle())
+	assert.NoError(t, cache.checkInvariants())
+
+	// A single update carrying both the new entries and the new bundle is sent.
+	util.RunWithTimeout(t, 5*time.Second, func() {
+		wu := <-sub.Updates()
+		assert.Equal(t, []*Entry{deliveredEntry(newEntry, 1)}, wu.Entries)
+		assert.Equal(t, []*x509.Certificate{newRoot}, wu.Bundle)
+	})
+	assert.Equal(t, 0, len(sub.Updates()))
+}
+
+func TestExplainMatch(t *testing.T) {
+	cache := New(logger, nil)
+
+	matching := &Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			Selectors: Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}},
+			ParentId:  "spiffe:parent",
+			SpiffeId:  "spiffe:matching",
+			EntryId:   "00000000-0000-0000-0000-000000000001",
+		},
+		SVID:       &x509.Certificate{},
+		PrivateKey: privateKey,
+	}
+	nearMiss := &Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			Selectors: Selectors{
+				&common.Selector{Type: "unix", Value: "uid:1111"},
+				&common.Selector{Type: "unix", Value: "gid:2222"},
+			},
+			ParentId: "spiffe:parent",
+			SpiffeId: "spiffe:near_miss",
+			EntryId:  "00000000-0000-0000-0000-000000000002",
+		},
+		SVID:       &x509.Certificate{},
+		PrivateKey: privateKey,
+	}
+	cache.SetEntry(matching)
+	cache.SetEntry(nearMiss)
+
+	explanations := cache.ExplainMatch(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}})
+	assert.Equal(t, []MatchExplanation{
+		{
+			EntryID: "00000000-0000-0000-0000-000000000001",
+			Matched: true,
+		},
+		{
+			EntryID:          "00000000-0000-0000-0000-000000000002",
+			Matched:          false,
+			MissingSelectors: Selectors{&common.Selector{Type: "unix", Value: "gid:2222"}},
+		},
+	}, explanations)
+}
+
+func TestBundleIsSorted(t *testing.T) {
+	root1 := &x509.Certificate{Raw: []byte("root1")}
+	root2 := &x509.Certificate{Raw: []byte("root2")}
+	root3 := &x509.Certificate{Raw: []byte("root3")}
+
+	cache1 := New(logger, []*x509.Certificate{root3, root1, root2})
+	cache2 := New(logger, nil)
+	cache2.SetBundle([]*x509.Certificate{root2, root3, root1})
+
+	expected := []*x509.Certificate{root1, root2, root3}
+	assert.Equal(t, expected, cache1.Bundle())
+	assert.Equal(t, expected, cache2.Bundle())
+
+	cache1.RemoveBundleRoot(root2)
+	cache1.SetBundle(append(cache1.Bundle(), root2))
+	assert.Equal(t, expected, cache1.Bundle())
+}
+
+func TestJWTBundle(t *testing.T) {
+	cache := New(logger, nil)
+	key1, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	key2, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	sub := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}})
+	cache.Subscribe(sub)
+	// Consume the update sent by Subscribe function.
+	<-sub.Updates()
+
+	assert.Nil(t, cache.JWTBundle("spiffe://example.org"))
+
+	// Set the bundle for a trust domain.
+	cache.SetJWTBundle("spiffe://example.org", map[string]crypto.PublicKey{"kid1": key1.Public()})
+	assert.Equal(t, map[string]crypto.PublicKey{"kid1": key1.Public()}, cache.JWTBundle("spiffe://example.org"))
+	assert.Nil(t, cache.JWTBundle("spiffe://other.org"))
+	util.RunWithTimeout(t, 5*time.Second, func() {
+		wu := <-sub.Updates()
+		assert.Equal(t, map[string]map[string]crypto.PublicKey{
+			"spiffe://example.org": {"kid1": key1.Public()},
+		}, wu.JWTBundles)
+	})
+
+	// Overwrite it and set another trust domain's bundle.
+	cache.SetJWTBundle("spiffe://example.org", map[string]crypto.PublicKey{"kid2": key2.Public()})
+	cache.SetJWTBundle("spiffe://other.org", map[string]crypto.PublicKey{"kid1": key1.Public()})
+	assert.Equal(t, map[string]crypto.PublicKey{"kid2": key2.Public()}, cache.JWTBundle("spiffe://example.org"))
+	util.RunWithTimeout(t, 5*time.Second, func() {
+		wu := <-sub.Updates()
+		assert.Equal(t, map[string]map[string]crypto.PublicKey{
+			"spiffe://example.org": {"kid2": key2.Public()},
+			"spiffe://other.org":   {"kid1": key1.Public()},
+		}, wu.JWTBundles)
+	})
+
+	// Returned keys are a copy.
+	cache.JWTBundle("spiffe://example.org")["kid3"] = key1.Public()
+	assert.Equal(t, map[string]crypto.PublicKey{"kid2": key2.Public()}, cache.JWTBundle("spiffe://example.org"))
+
+	// Setting no keys removes the bundle.
+	cache.SetJWTBundle("spiffe://other.org", nil)
+	assert.Nil(t, cache.JWTBundle("spiffe://other.org"))
+}
+
+func TestCheckInvariants(t *testing.T) {
+	entry := &Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			Selectors: Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}},
+			ParentId:  "spiffe:parent",
+			SpiffeId:  "spiffe:test",
+			EntryId:   "00000000-0000-0000-0000-000000000001",
+		},
+		SVID:       &x509.Certificate{DNSNames: []string{"foo.example.org"}},
+		PrivateKey: privateKey,
+	}
+	id := entry.RegistrationEntry.EntryId
+
+	tests := []struct {
+		name    string
+		corrupt func(c *cacheImpl, sub *subscriber)
+		err     string
+	}{
+		{name: "entry_under_wrong_id",
+			corrupt: func(c *cacheImpl, sub *subscriber) {
+				c.cache["other"] = entry
+			},
+			err: `entry "00000000-0000-0000-0000-000000000001" is stored under ID "other"`},
+		{name: "entry_without_registration_entry",
+			corrupt: func(c *cacheImpl, sub *subscriber) {
+				c.cache["other"] = &Entry{}
+			},
+			err: `entry "other" has no registration entry`},
+		{name: "dns_name_not_indexed",
+			corrupt: func(c *cacheImpl, sub *subscriber) {
+				delete(c.dnsIndex, "foo.example.org")
+			},
+			err: `entry "00000000-0000-0000-0000-000000000001" is not indexed under DNS name "foo.example.org"`},
+		{name: "empty_dns_index_bucket",
+			corrupt: func(c *cacheImpl, sub *subscriber) {
+				c.dnsIndex["bar.example.org"] = map[string]bool{}
+			},
+			err: "DNS name index bucket bar.example.org is empty"},
+		{name: "dns_index_references_unknown_entry",
+			corrupt: func(c *cacheImpl, sub *subscriber) {
+				c.dnsIndex["foo.example.org"]["other"] = true
+			},
+			err: `DNS name index bucket foo.example.org references entry "other" without the name`},
+		{name: "missing_insertion_time",
+			corrupt: func(c *cacheImpl, sub *subscriber) {
+				delete(c.insertedAt, id)
+			},
+			err: `entry "00000000-0000-0000-0000-000000000001" has no insertion time`},
+		{name: "insertion_time_of_unknown_entry",
+			corrupt: func(c *cacheImpl, sub *subscriber) {
+				c.insertedAt["other"] = time.Now()
+			},
+			err: `insertion time of unknown entry "other"`},
+		{name: "rotation_count_of_unknown_entry",
+			corrupt: func(c *cacheImpl, sub *subscriber) {
+				c.rotationCounts["other"] = 1
+			},
+			err: `rotation count of unknown entry "other"`},
+		{name: "rotation_of_unknown_entry",
+			corrupt: func(c *cacheImpl, sub *subscriber) {
+				c.rotations.set("other", time.Now())
+			},
+			err: `rotation of entry "other" is scheduled without SVID`},
+		{name: "rotation_at_wrong_time",
+			corrupt: func(c *cacheImpl, sub *subscriber) {
+				c.rotations.set(id, time.Now())
+			},
+			err: `rotation of entry "00000000-0000-0000-0000-000000000001" is scheduled at`},
+		{name: "rotation_at_wrong_index",
+			corrupt: func(c *cacheImpl, sub *subscriber) {
+				c.rotations.items[0].index = 1
+			},
+			err: `rotation of entry "00000000-0000-0000-0000-000000000001" is at index 1, expected 0`},
+		{name: "rotation_not_indexed",
+			corrupt: func(c *cacheImpl, sub *subscriber) {
+				delete(c.rotations.byKey, id)
+			},
+			err: "rotation queue holds 1 items but indexes 0"},
+		{name: "orphaned_index_bucket",
+			corrupt: func(c *cacheImpl, sub *subscriber) {
+				c.subscribers.selMap["unix:uid:2222"] = []uint64{}
+			},
+			err: "selector index bucket unix:uid:2222 is empty"},
+		{name: "index_references_unknown_subscriber",
+			corrupt: func(c *cacheImpl, sub *subscriber) {
+				delete(c.subscribers.sidMap, sub.id)
+			},
+			err: "selector index bucket unix:uid:1111 references unknown subscriber"},
+		{name: "subscriber_missing_from_index",
+			corrupt: func(c *cacheImpl, sub *subscriber) {
+				delete(c.subscribers.selMap, "unix:uid:1111")
+			},
+			err: "is indexed under 0 selector sets, expected 1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := New(logger, nil)
+			cache.SetEntry(entry)
+			sub := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}})
+			cache.Subscribe(sub)
+			assert.NoError(t, cache.checkInvariants())
+
+			test.corrupt(cache, sub)
+			err := cache.checkInvariants()
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), test.err)
+			}
+		})
+	}
+}
+
+func BenchmarkNotifySubscribersSharedSelectors(b *testing.B) {
+	cache := New(logger, nil)
+	for i := 0; i < 100; i++ {
+		cache.SetEntry(&Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: Selectors{
+					&common.Selector{Type: "unix", Value: fmt.Sprintf("uid:%d", i%5)},
+					&common.Selector{Type: "unix", Value: fmt.Sprintf("gid:%d", i)},
+				},
+				ParentId: "spiffe:parent",
+				SpiffeId: fmt.Sprintf("spiffe:test%d", i),
+				EntryId:  fmt.Sprintf("00000000-0000-0000-0000-%012d", i),
+			},
+			SVID:       &x509.Certificate{},
+			PrivateKey: privateKey,
+		})
+	}
+
+	// 1000 subscribers sharing 5 distinct selector sets.
+	subs := []*subscriber{}
+	for i := 0; i < 1000; i++ {
+		subs = append(subs, NewSubscriber(Selectors{
+			&common.Selector{Type: "unix", Value: fmt.Sprintf("uid:%d", i%5)},
+			&common.Selector{Type: "unix", Value: fmt.Sprintf("gid:%d", i%5)},
+		}))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.notifySubscribers(subs)
+	}
+}
+
+func TestNotifySubscribersSharedSelectors(t *testing.T) {
+	cache := New(logger, nil)
+	e1 := &Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			Selectors: Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}},
+			ParentId:  "spiffe:parent",
+			SpiffeId:  "spiffe:test1",
+			EntryId:   "00000000-0000-0000-0000-000000000001",
+		},
+		SVID:       &x509.Certificate{},
+		PrivateKey: privateKey,
+	}
+	cache.SetEntry(e1)
+
+	sub1 := NewSubscriber(Selectors{
+		&common.Selector{Type: "unix", Value: "uid:1111"},
+		&common.Selector{Type: "unix", Value: "gid:2222"},
+	})
+	// Same selectors as sub1 in a different order.
+	sub2 := NewSubscriber(Selectors{
+		&common.Selector{Type: "unix", Value: "gid:2222"},
+		&common.Selector{Type: "unix", Value: "uid:1111"},
+	})
+	sub3 := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:2222"}})
+	assert.Equal(t, selectorsKey(sub1.sel), selectorsKey(sub2.sel))
+	assert.NotEqual(t, selectorsKey(sub1.sel), selectorsKey(sub3.sel))
+
+	cache.notifySubscribers([]*subscriber{sub1, sub2, sub3})
+	wu1 := <-sub1.Updates()
+	wu2 := <-sub2.Updates()
+	wu3 := <-sub3.Updates()
+	assert.Equal(t, []*Entry{e1}, wu1.Entries)
+	assert.Equal(t, []*Entry{e1}, wu2.Entries)
+	assert.Empty(t, wu3.Entries)
+
+	// Appending to a delivered slice doesn't affect other subscribers.
+	wu1.Entries = append(wu1.Entries, &Entry{})
+	assert.Equal(t, []*Entry{e1}, wu2.Entries)
+}
+
+func TestEntryEqual(t *testing.T) {
+	notAfter := time.Now().Add(time.Hour)
+	newEntry := func() *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: Selectors{
+					&common.Selector{Type: "unix", Value: "uid:1111"},
+					&common.Selector{Type: "unix", Value: "gid:2222"},
+				},
+				ParentId:    "spiffe:parent",
+				SpiffeId:    "spiffe:test",
+				EntryId:     "00000000-0000-0000-0000-000000000001",
+				FbSpiffeIds: []string{"spiffe://a.org", "spiffe://b.org"},
+			},
+			SVID:       &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: notAfter},
+			PrivateKey: privateKey,
+			Bundles:    map[string][]byte{"spiffe://a.org": []byte("a")},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(e *Entry)
+		equal  bool
+	}{
+		{name: "identical", modify: func(e *Entry) {}, equal: true},
+		{name: "selectors_reordered",
+			modify: func(e *Entry) {
+				sels := e.RegistrationEntry.Selectors
+				e.RegistrationEntry.Selectors = Selectors{sels[1], sels[0]}
+			},
+			equal: true},
+		{name: "federated_refs_reordered",
+			modify: func(e *Entry) {
+				e.RegistrationEntry.FbSpiffeIds = []string{"spiffe://b.org", "spiffe://a.org"}
+			},
+			equal: true},
+		{name: "different_private_key",
+			modify: func(e *Entry) { e.PrivateKey = nil },
+			equal:  true},
+		{name: "different_entry_id",
+			modify: func(e *Entry) { e.RegistrationEntry.EntryId = "other" }},
+		{name: "different_parent_id",
+			modify: func(e *Entry) { e.RegistrationEntry.ParentId = "spiffe:other" }},
+		{name: "different_spiffe_id",
+			modify: func(e *Entry) { e.RegistrationEntry.SpiffeId = "spiffe:other" }},
+		{name: "different_selectors",
+			modify: func(e *Entry) {
+				e.RegistrationEntry.Selectors = Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+			}},
+		{name: "different_federated_refs",
+			modify: func(e *Entry) { e.RegistrationEntry.FbSpiffeIds = []string{"spiffe://a.org"} }},
+		{name: "nil_registration_entry",
+			modify: func(e *Entry) { e.RegistrationEntry = nil }},
+		{name: "different_svid_serial",
+			modify: func(e *Entry) { e.SVID.SerialNumber = big.NewInt(2) }},
+		{name: "nil_svid_serial",
+			modify: func(e *Entry) { e.SVID.SerialNumber = nil }},
+		{name: "different_svid_expiration",
+			modify: func(e *Entry) { e.SVID.NotAfter = notAfter.Add(time.Second) }},
+		{name: "nil_svid",
+			modify: func(e *Entry) { e.SVID = nil }},
+		{name: "different_bundle",
+			modify: func(e *Entry) { e.Bundles["spiffe://a.org"] = []byte("b") }},
+		{name: "extra_bundle",
+			modify: func(e *Entry) { e.Bundles["spiffe://b.org"] = []byte("b") }},
+		{name: "nil_bundles",
+			modify: func(e *Entry) { e.Bundles = nil }},
+		{name: "different_federates_with",
+			modify: func(e *Entry) { e.FederatesWith = []string{"spiffe://b.org"} }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e1 := newEntry()
+			e2 := newEntry()
+			test.modify(e2)
+			assert.Equal(t, test.equal, e1.Equal(e2))
+			assert.Equal(t, test.equal, e2.Equal(e1))
+		})
+	}
+
+	var nilEntry *Entry
+	assert.True(t, nilEntry.Equal(nil))
+	assert.False(t, nilEntry.Equal(newEntry()))
+	assert.False(t, newEntry().Equal(nil))
+	assert.True(t, (&Entry{}).Equal(&Entry{}))
+}
+
+func TestSetEntryChangesSelectors(t *testing.T) {
+	cache := New(logger, nil)
+	uid := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	gid := Selectors{&common.Selector{Type: "unix", Value: "gid:2222"}}
+	newEntry := func(selectors Selectors) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "1"},
+		}
+	}
+	require.NoError(t, cache.SetEntry(newEntry(uid)))
+
+	uidSub := NewSubscriber(uid)
+	require.NoError(t, cache.Subscribe(uidSub))
+	defer cache.Unsubscribe(uidSub)
+	gidSub := NewSubscriber(gid)
+	require.NoError(t, cache.Subscribe(gidSub))
+	defer cache.Unsubscribe(gidSub)
+	assert.Equal(t, []string{"1"}, entryIDs((<-uidSub.Updates()).Entries))
+	assert.Empty(t, (<-gidSub.Updates()).Entries)
+
+	// The subscribers of the previous selectors lose the entry.
+	require.NoError(t, cache.SetEntry(newEntry(gid)))
+	require.Len(t, uidSub.Updates(), 1)
+	assert.Empty(t, (<-uidSub.Updates()).Entries)
+	assert.Equal(t, []string{"1"}, entryIDs((<-gidSub.Updates()).Entries))
+	assert.Empty(t, cache.LastDelivered(uidSub).Entries)
+
+	// Moving the entry to other selectors and another SPIFFE ID notifies
+	// the subscribers of both.
+	idSub := cache.SubscribeSPIFFEID("spiffe://example.org/a")
+	defer cache.Unsubscribe(idSub)
+	<-idSub.Updates()
+	moved := newEntry(gid)
+	moved.RegistrationEntry.SpiffeId = "spiffe://example.org/a"
+	require.NoError(t, cache.SetEntry(moved))
+	assert.Equal(t, []string{"1"}, entryIDs((<-idSub.Updates()).Entries))
+	<-gidSub.Updates()
+	require.NoError(t, cache.SetEntry(newEntry(uid)))
+	require.Len(t, idSub.Updates(), 1)
+	require.Len(t, gidSub.Updates(), 1)
+	assert.Empty(t, (<-idSub.Updates()).Entries)
+	assert.Empty(t, (<-gidSub.Updates()).Entries)
+	assert.Equal(t, []string{"1"}, entryIDs((<-uidSub.Updates()).Entries))
+}
+
+func TestWouldNotify(t *testing.T) {
+	cache := New(logger, nil)
+
+	entry := &Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			Selectors: Selectors{
+				&common.Selector{Type: "unix", Value: "uid:1111"},
+				&common.Selector{Type: "unix", Value: "gid:2222"},
+			},
+			ParentId: "spiffe:parent",
+			SpiffeId: "spiffe:test",
+			EntryId:  "00000000-0000-0000-0000-000000000001",
+		},
+		SVID:       &x509.Certificate{},
+		PrivateKey: privateKey,
+	}
+
+	exact := NewSubscriber(Selectors{
+		&common.Selector{Type: "unix", Value: "gid:2222"},
+		&common.Selector{Type: "unix", Value: "uid:1111"},
+	})
+	superset := NewSubscriber(Selectors{
+		&common.Selector{Type: "unix", Value: "uid:1111"},
+		&common.Selector{Type: "unix", Value: "gid:2222"},
+		&common.Selector{Type: "k8s", Value: "ns:default"},
+	})
+	subset := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}})
+	unrelated := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:3333"}})
+	finished := NewSubscriber(Selectors{
+		&common.Selector{Type: "unix", Value: "uid:1111"},
+		&common.Selector{Type: "unix", Value: "gid:2222"},
+	})
+	subs := []*subscriber{exact, superset, subset, unrelated, finished}
+	for _, sub := range subs {
+		cache.Subscribe(sub)
+		// Consume the update sent by Subscribe function.
+		<-sub.Updates()
+	}
+	finished.Finish()
+
+	ids := cache.WouldNotify(entry)
+	assert.Equal(t, []uint64{exact.ID(), superset.ID()}, ids)
+
+	// The cache wasn't modified and no one was notified.
+	assert.True(t, cache.IsEmpty())
+	for _, sub := range []*subscriber{exact, superset, subset, unrelated} {
+		assert.Equal(t, 0, len(sub.Updates()))
+	}
+
+	// Setting the entry notifies the same subscribers.
+	cache.SetEntry(entry)
+	notified := []uint64{}
+	for _, sub := range []*subscriber{exact, superset, subset, unrelated} {
+		if len(sub.Updates()) > 0 {
+			notified = append(notified, sub.ID())
+		}
+	}
+	assert.Equal(t, ids, notified)
+
+	// Invalid entries notify no one.
+	assert.Equal(t, []uint64{}, cache.WouldNotify(nil))
+	assert.Equal(t, []uint64{}, cache.WouldNotify(&Entry{}))
+}
+
+func TestNotifyRateLimit(t *testing.T) {
+	clk := newFakeClock()
+	cache := New(logger, nil, WithClock(clk), WithNotifyRateLimit(1, 2))
+
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	newEntry := func(i int) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: selectors,
+				ParentId:  "spiffe:parent",
+				SpiffeId:  fmt.Sprintf("spiffe:test_%d", i),
+				EntryId:   "00000000-0000-0000-0000-000000000001",
+			},
+			SVID:       &x509.Certificate{},
+			PrivateKey: privateKey,
+		}
+	}
+
+	// The first two passes use the burst.
+	sub := NewSubscriber(selectors)
+	cache.Subscribe(sub)
+	<-sub.Updates()
+	cache.SetEntry(newEntry(0))
+	wu := <-sub.Updates()
+	assert.Equal(t, "spiffe:test_0", wu.Entries[0].RegistrationEntry.SpiffeId)
+
+	// Passes over the limit are coalesced until a token is available.
+	for i := 1; i <= 10; i++ {
+		cache.SetEntry(newEntry(i))
+	}
+	assert.Equal(t, 0, len(sub.Updates()))
+	clk.Add(500 * time.Millisecond)
+	assert.Equal(t, 0, len(sub.Updates()))
+
+	// The latest state is delivered in a single pass.
+	clk.Add(500 * time.Millisecond)
+	assert.Equal(t, 1, len(sub.Updates()))
+	wu = <-sub.Updates()
+	assert.Equal(t, "spiffe:test_10", wu.Entries[0].RegistrationEntry.SpiffeId)
+
+	// Further updates converge to the final state.
+	for i := 11; i <= 20; i++ {
+		cache.SetEntry(newEntry(i))
+		clk.Add(300 * time.Millisecond)
+	}
+	clk.Add(time.Second)
+	wu = <-sub.Updates()
+	assert.Equal(t, "spiffe:test_20", wu.Entries[0].RegistrationEntry.SpiffeId)
+	assert.Equal(t, 0, len(sub.Updates()))
+}
+
+func TestEntriesByIDs(t *testing.T) {
+	cache := New(logger, nil)
+	entries := map[string]*Entry{}
+	for _, id := range []string{"1", "2", "3"} {
+		entries[id] = &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: Selectors{&common.Selector{Type: "unix", Value: "uid:" + id}},
+				ParentId:  "spiffe:parent",
+				SpiffeId:  "spiffe:test" + id,
+				EntryId:   id,
+			},
+			SVID:       &x509.Certificate{},
+			PrivateKey: privateKey,
+		}
+		cache.SetEntry(entries[id])
+	}
+
+	tests := []struct {
+		name     string
+		ids      []string
+		expected map[string]*Entry
+	}{
+		{name: "all_present",
+			ids:      []string{"1", "3"},
+			expected: map[string]*Entry{"1": entries["1"], "3": entries["3"]}},
+		{name: "partial",
+			ids:      []string{"2", "4"},
+			expected: map[string]*Entry{"2": entries["2"]}},
+		{name: "none_present",
+			ids:      []string{"4", "5"},
+			expected: map[string]*Entry{}},
+		{name: "no_ids",
+			expected: map[string]*Entry{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, cache.EntriesByIDs(test.ids))
+		})
+	}
+}
+
+func TestSetDegraded(t *testing.T) {
+	cache := New(logger, nil)
+
+	sub := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}})
+	cache.Subscribe(sub)
+	wu := <-sub.Updates()
+	assert.False(t, wu.Stale)
+	assert.Empty(t, wu.StaleReason)
+
+	cache.SetDegraded(true, "server unreachable")
+	util.RunWithTimeout(t, 5*time.Second, func() {
+		wu := <-sub.Updates()
+		assert.True(t, wu.Stale)
+		assert.Equal(t, "server unreachable", wu.StaleReason)
+	})
+
+	// Setting the same state again doesn't notify.
+	cache.SetDegraded(true, "server unreachable")
+	assert.Equal(t, 0, len(sub.Updates()))
+
+	// Later updates keep carrying the flag.
+	cache.SetBundle(nil)
+	wu = <-sub.Updates()
+	assert.True(t, wu.Stale)
+
+	cache.SetDegraded(false, "")
+	util.RunWithTimeout(t, 5*time.Second, func() {
+		wu := <-sub.Updates()
+		assert.False(t, wu.Stale)
+		assert.Empty(t, wu.StaleReason)
+	})
+}
+
+func TestSetBootstrapComplete(t *testing.T) {
+	cache := New(logger, nil)
+
+	sub := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}})
+	cache.Subscribe(sub)
+	wu := <-sub.Updates()
+	assert.False(t, wu.Bootstrapped)
+	epoch := wu.Epoch
+
+	cache.SetBootstrapComplete()
+	util.RunWithTimeout(t, 5*time.Second, func() {
+		wu := <-sub.Updates()
+		assert.True(t, wu.Bootstrapped)
+		assert.NotEqual(t, epoch, wu.Epoch)
+	})
+
+	// Completing the bootstrap again doesn't notify.
+	cache.SetBootstrapComplete()
+	assert.Equal(t, 0, len(sub.Updates()))
+
+	// Later updates keep carrying the flag.
+	cache.SetBundle(nil)
+	wu = <-sub.Updates()
+	assert.True(t, wu.Bootstrapped)
+}
+
+func TestDeltaUpdates(t *testing.T) {
+	cache := New(logger, nil)
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	newEntry := func(id string, serial int64) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: selectors,
+				ParentId:  "spiffe:parent",
+				SpiffeId:  "spiffe:test" + id,
+				EntryId:   id,
+			},
+			SVID:       &x509.Certificate{SerialNumber: big.NewInt(serial)},
+			PrivateKey: privateKey,
+		}
+	}
+	e1 := newEntry("1", 1)
+	cache.SetEntry(e1)
+
+	sub := NewSubscriber(selectors, WithDeltaUpdates())
+	cache.Subscribe(sub)
+
+	// The first update holds all the entries.
+	wu := <-sub.Updates()
+	assert.False(t, wu.Delta)
+	assert.Equal(t, []*Entry{e1}, wu.Entries)
+
+	// Added entry.
+	e2 := newEntry("2", 1)
+	cache.SetEntry(e2)
+	wu = <-sub.Updates()
+	assert.True(t, wu.Delta)
+	assert.Empty(t, wu.Entries)
+	assert.Equal(t, []*Entry{e2}, wu.AddedEntries)
+	assert.Empty(t, wu.ChangedEntries)
+	assert.Empty(t, wu.RemovedEntryIDs)
+
+	// Changed entry.
+	e1Rotated := newEntry("1", 2)
+	cache.SetEntry(e1Rotated)
+	wu = <-sub.Updates()
+	assert.Empty(t, wu.AddedEntries)
+	assert.Equal(t, []*Entry{e1Rotated}, wu.ChangedEntries)
+	assert.Empty(t, wu.RemovedEntryIDs)
+
+	// Removed entry.
+	cache.DeleteEntry(e2.RegistrationEntry)
+	wu = <-sub.Updates()
+	assert.Empty(t, wu.AddedEntries)
+	assert.Empty(t, wu.ChangedEntries)
+	assert.Equal(t, []string{"2"}, wu.RemovedEntryIDs)
+
+	// Unchanged state yields an empty delta.
+	cache.SetBundle(nil)
+	wu = <-sub.Updates()
+	assert.True(t, wu.Delta)
+	assert.Empty(t, wu.AddedEntries)
+	assert.Empty(t, wu.ChangedEntries)
+	assert.Empty(t, wu.RemovedEntryIDs)
+
+	// Updates replaced before being received are folded into the next delta.
+	e3 := newEntry("3", 1)
+	cache.SetEntry(e3)
+	cache.DeleteEntry(e1.RegistrationEntry)
+	wu = <-sub.Updates()
+	assert.Equal(t, []*Entry{deliveredEntry(e3, 1)}, wu.AddedEntries)
+	assert.Empty(t, wu.ChangedEntries)
+	assert.Equal(t, []string{"1"}, wu.RemovedEntryIDs)
+
+	// Regular subscribers keep receiving all their entries.
+	regular := NewSubscriber(selectors)
+	cache.Subscribe(regular)
+	<-regular.Updates()
+	cache.SetBundle(nil)
+	wu = <-regular.Updates()
+	assert.False(t, wu.Delta)
+	assert.Equal(t, []*Entry{deliveredEntry(e3, 2)}, wu.Entries)
+}
+
+func TestSelectorNormalizer(t *testing.T) {
+	cache := New(logger, nil)
+	cache.SetSelectorNormalizer(func(s *common.Selector) *common.Selector {
+		return &common.Selector{
+			Type:  s.Type,
+			Value: strings.TrimSuffix(strings.ToLower(s.Value), "/"),
+		}
+	})
+
+	entry := &Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			Selectors: Selectors{&common.Selector{Type: "windows", Value: "SID:S-1-5-21/"}},
+			ParentId:  "spiffe:parent",
+			SpiffeId:  "spiffe:test",
+			EntryId:   "00000000-0000-0000-0000-000000000001",
+		},
+		SVID:       &x509.Certificate{},
+		PrivateKey: privateKey,
+	}
+	cache.SetEntry(entry)
+
+	// The caller's entry is left untouched.
+	assert.Equal(t, "SID:S-1-5-21/", entry.RegistrationEntry.Selectors[0].Value)
+	assert.Equal(t, "sid:s-1-5-21", cache.Entry(entry.RegistrationEntry).RegistrationEntry.Selectors[0].Value)
+
+	selectors := Selectors{&common.Selector{Type: "windows", Value: "sid:S-1-5-21"}}
+	assert.True(t, cache.HasMatch(selectors))
+
+	sub := NewSubscriber(selectors)
+	cache.Subscribe(sub)
+	wu := <-sub.Updates()
+	assert.Equal(t, 1, len(wu.Entries))
+
+	// Entries set by Reset are normalized too.
+	cache.Reset(nil, nil)
+	<-sub.Updates()
+	assert.False(t, cache.HasMatch(selectors))
+	cache.Reset([]*Entry{entry}, nil)
+	assert.True(t, cache.HasMatch(selectors))
+	wu = <-sub.Updates()
+	assert.Equal(t, 1, len(wu.Entries))
+	assert.Equal(t, "SID:S-1-5-21/", entry.RegistrationEntry.Selectors[0].Value)
+
+	// Without normalization the selectors don't match.
+	cache.SetSelectorNormalizer(nil)
+	assert.False(t, cache.HasMatch(selectors))
+	cache.SetEntry(entry)
+	assert.Equal(t, "SID:S-1-5-21/", cache.Entry(entry.RegistrationEntry).RegistrationEntry.Selectors[0].Value)
+}
+
+func TestInsertPolicy(t *testing.T) {
+	cache := New(logger, nil)
+	errOutsidePrefix := errors.New("outside allowed prefix")
+	cache.SetInsertPolicy(func(e *Entry) error {
+		if !strings.HasPrefix(e.RegistrationEntry.SpiffeId, "spiffe://example.org/allowed/") {
+			return errOutsidePrefix
+		}
+		return nil
+	})
+
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	rejected := &Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "1", SpiffeId: "spiffe://example.org/other"},
+	}
+	accepted := &Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "2", SpiffeId: "spiffe://example.org/allowed/a"},
+	}
+	assert.Equal(t, errOutsidePrefix, cache.SetEntry(rejected))
+	assert.Nil(t, cache.Entry(rejected.RegistrationEntry))
+	require.NoError(t, cache.SetEntry(accepted))
+	assert.NotNil(t, cache.Entry(accepted.RegistrationEntry))
+
+	// Rejected entries are not cached by Reconcile and Reset either.
+	result := cache.Reconcile([]*Entry{rejected, accepted})
+	assert.Empty(t, result.Added)
+	assert.Equal(t, []string{"2"}, result.Unchanged)
+	assert.Nil(t, cache.Entry(rejected.RegistrationEntry))
+	cache.Reset([]*Entry{rejected, accepted}, nil)
+	assert.Nil(t, cache.Entry(rejected.RegistrationEntry))
+	assert.NotNil(t, cache.Entry(accepted.RegistrationEntry))
+
+	// Without a policy every entry is accepted.
+	cache.SetInsertPolicy(nil)
+	require.NoError(t, cache.SetEntry(rejected))
+	assert.NotNil(t, cache.Entry(rejected.RegistrationEntry))
+}
+
+func TestBundleCounts(t *testing.T) {
+	root1 := &x509.Certificate{Raw: []byte("root1")}
+	root2 := &x509.Certificate{Raw: []byte("root2")}
+	root3 := &x509.Certificate{Raw: []byte("root3")}
+	cache := New(logger, []*x509.Certificate{root1, root2})
+
+	assert.Equal(t, 2, cache.BundleCount())
+	assert.Equal(t, map[string]int{}, cache.TrustDomainBundleCounts())
+
+	cache.RemoveBundleRoot(root1)
+	assert.Equal(t, 1, cache.BundleCount())
+	cache.SetBundle([]*x509.Certificate{root1, root2, root3})
+	assert.Equal(t, 3, cache.BundleCount())
+
+	cache.SetFederatedBundle("spiffe://a.org", []*x509.Certificate{root1})
+	cache.SetFederatedBundle("spiffe://b.org", []*x509.Certificate{root2, root3})
+	assert.Equal(t, map[string]int{"spiffe://a.org": 1, "spiffe://b.org": 2}, cache.TrustDomainBundleCounts())
+
+	cache.SetFederatedBundle("spiffe://a.org", []*x509.Certificate{root1, root2, root3})
+	cache.SetFederatedBundle("spiffe://b.org", nil)
+	assert.Equal(t, map[string]int{"spiffe://a.org": 3}, cache.TrustDomainBundleCounts())
+	assert.Equal(t, 3, cache.BundleCount())
+}
+
+func TestFederatedBundle(t *testing.T) {
+	root1 := &x509.Certificate{Raw: []byte("root1")}
+	root2 := &x509.Certificate{Raw: []byte("root2")}
+	cache := New(logger, nil)
+
+	sub := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}})
+	cache.Subscribe(sub)
+	<-sub.Updates()
+
+	assert.Nil(t, cache.FederatedBundle("spiffe://a.org"))
+	cache.SetFederatedBundle("spiffe://a.org", []*x509.Certificate{root2, root1})
+	assert.Equal(t, []*x509.Certificate{root1, root2}, cache.FederatedBundle("spiffe://a.org"))
+
+	util.RunWithTimeout(t, 5*time.Second, func() {
+		wu := <-sub.Updates()
+		assert.Equal(t, map[string][]*x509.Certificate{
+			"spiffe://a.org": {root1, root2},
+		}, wu.FederatedBundles)
+	})
+
+	cache.SetFederatedBundle("spiffe://a.org", nil)
+	assert.Nil(t, cache.FederatedBundle("spiffe://a.org"))
+}
+
+func TestSubscribeAndSnapshot(t *testing.T) {
+	cache := New(logger, nil)
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	newEntry := func(i int) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: selectors,
+				ParentId:  "spiffe:parent",
+				SpiffeId:  fmt.Sprintf("spiffe:test%d", i),
+				EntryId:   fmt.Sprintf("%d", i),
+			},
+		}
+	}
+
+	const numEntries = 100
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < numEntries; i++ {
+			cache.SetEntry(newEntry(i))
+		}
+	}()
+
+	snapshot, sub, err := cache.SubscribeAndSnapshot(selectors)
+	require.NoError(t, err)
+	defer cache.Unsubscribe(sub)
+
+	// Every update must hold more entries than the snapshot and the previous
+	// update, until all the entries are received.
+	received := len(snapshot.Entries)
+	timeout := time.After(5 * time.Second)
+	for received < numEntries {
+		select {
+		case wu, ok := <-sub.Updates():
+			if !ok {
+				// The channel was replaced by a newer update.
+				continue
+			}
+			assert.True(t, len(wu.Entries) > received, "update with %d entries after %d", len(wu.Entries), received)
+			received = len(wu.Entries)
+		case <-timeout:
+			t.Fatalf("received %d entries out of %d", received, numEntries)
+		}
+	}
+	<-done
+
+	// No duplicate update is sent after the last change.
+	select {
+	case wu, ok := <-sub.Updates():
+		if ok {
+			t.Fatalf("unexpected update with %d entries", len(wu.Entries))
+		}
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.NoError(t, cache.checkInvariants())
+}
+
+func TestEntryAccessCount(t *testing.T) {
+	cache := New(logger, nil, WithAccessCounting())
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	entry := &Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			Selectors: selectors,
+			ParentId:  "spiffe:parent",
+			SpiffeId:  "spiffe:test",
+			EntryId:   "1",
+		},
+	}
+	cache.SetEntry(entry)
+	assert.Equal(t, uint64(0), cache.EntryAccessCount("1"))
+
+	// Lookups are counted.
+	cache.Entry(entry.RegistrationEntry)
+	cache.EntriesByIDs([]string{"1", "2"})
+	assert.Equal(t, uint64(2), cache.EntryAccessCount("1"))
+	assert.Equal(t, uint64(0), cache.EntryAccessCount("2"))
+
+	// Deliveries are counted.
+	sub := NewSubscriber(selectors)
+	cache.Subscribe(sub)
+	<-sub.Updates()
+	assert.Equal(t, uint64(3), cache.EntryAccessCount("1"))
+	entry.SVID = &x509.Certificate{SerialNumber: big.NewInt(2)}
+	cache.SetEntry(entry)
+	<-sub.Updates()
+	assert.Equal(t, uint64(4), cache.EntryAccessCount("1"))
+	cache.Unsubscribe(sub)
+
+	// Counts survive a reset that keeps the entry and are dropped otherwise.
+	cache.Reset([]*Entry{entry}, nil)
+	assert.Equal(t, uint64(4), cache.EntryAccessCount("1"))
+	cache.DeleteEntry(entry.RegistrationEntry)
+	assert.Equal(t, uint64(0), cache.EntryAccessCount("1"))
+
+	// Accesses are not counted by default.
+	cache = New(logger, nil)
+	cache.SetEntry(entry)
+	cache.Entry(entry.RegistrationEntry)
+	assert.Equal(t, uint64(0), cache.EntryAccessCount("1"))
+}
+
+func TestStrictMode(t *testing.T) {
+	newEntry := func(serial int64) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}},
+				ParentId:  "spiffe:parent",
+				SpiffeId:  "spiffe:test",
+				EntryId:   "1",
+			},
+			SVID: &x509.Certificate{SerialNumber: big.NewInt(serial)},
+		}
+	}
+
+	// By default the last entry set wins.
+	cache := New(logger, nil)
+	assert.NoError(t, cache.SetEntry(newEntry(1)))
+	assert.NoError(t, cache.SetEntry(newEntry(2)))
+	assert.Equal(t, newEntry(2), cache.EntriesByIDs([]string{"1"})["1"])
+
+	cache = New(logger, nil, WithStrictMode())
+	assert.NoError(t, cache.SetEntry(newEntry(1)))
+	// Setting an equal entry is not a conflict.
+	assert.NoError(t, cache.SetEntry(newEntry(1)))
+	// A different entry conflicts with the unread one.
+	assert.Equal(t, ErrConflict, cache.SetEntry(newEntry(2)))
+	assert.Equal(t, newEntry(1), cache.Entry(newEntry(1).RegistrationEntry))
+	// Once read, it can be replaced.
+	assert.NoError(t, cache.SetEntry(newEntry(2)))
+	assert.Equal(t, ErrConflict, cache.SetEntry(newEntry(3)))
+	cache.Entries()
+	assert.NoError(t, cache.SetEntry(newEntry(3)))
+
+	// Reset entries are unread.
+	cache.Reset([]*Entry{newEntry(4)}, nil)
+	assert.Equal(t, ErrConflict, cache.SetEntry(newEntry(5)))
+
+	// Deleted entries don't conflict.
+	cache.DeleteEntry(newEntry(4).RegistrationEntry)
+	assert.NoError(t, cache.SetEntry(newEntry(5)))
+}
+
+func TestWaitNonEmpty(t *testing.T) {
+	entry := &Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			Selectors: Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}},
+			ParentId:  "spiffe:parent",
+			SpiffeId:  "spiffe:test",
+			EntryId:   "1",
+		},
+	}
+
+	// The context is done before the cache gets entries.
+	cache := New(logger, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, cache.WaitNonEmpty(ctx))
+
+	// The cache gets an entry while waiting.
+	done := make(chan error, 1)
+	go func() {
+		done <- cache.WaitNonEmpty(context.Background())
+	}()
+	cache.SetEntry(entry)
+	util.RunWithTimeout(t, time.Second, func() {
+		assert.NoError(t, <-done)
+	})
+
+	// The cache already has entries.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	assert.NoError(t, cache.WaitNonEmpty(ctx))
+
+	// The cache gets empty again.
+	cache.DeleteEntry(entry.RegistrationEntry)
+	assert.Equal(t, context.Canceled, cache.WaitNonEmpty(ctx))
+	cache.Reset([]*Entry{entry}, nil)
+	assert.NoError(t, cache.WaitNonEmpty(ctx))
+}
+
+func TestAllowedRoots(t *testing.T) {
+	ca, caKey, err := util.LoadCAFixture()
+	require.NoError(t, err)
+	other, _, err := util.LoadSVIDFixture()
+	require.NoError(t, err)
+
+	cache := New(logger, nil, WithAllowedRoots([]crypto.PublicKey{caKey.Public()}))
+
+	// Only allowed roots.
+	assert.NoError(t, cache.SetBundle([]*x509.Certificate{ca}))
+	assert.Equal(t, []*x509.Certificate{ca}, cache.Bundle())
+
+	// Roots not allowed are dropped.
+	assert.NoError(t, cache.SetBundle([]*x509.Certificate{other, ca}))
+	assert.Equal(t, []*x509.Certificate{ca}, cache.Bundle())
+
+	// No allowed roots leave the bundle unchanged.
+	assert.Equal(t, ErrNoAllowedRoots, cache.SetBundle([]*x509.Certificate{other}))
+	assert.Equal(t, []*x509.Certificate{ca}, cache.Bundle())
+
+	cache.Reset(nil, []*x509.Certificate{other})
+	assert.Empty(t, cache.Bundle())
+
+	// Any root is allowed by default.
+	cache = New(logger, nil)
+	assert.NoError(t, cache.SetBundle([]*x509.Certificate{other}))
+	assert.Equal(t, []*x509.Certificate{other}, cache.Bundle())
+}
+
+func TestFederatesWith(t *testing.T) {
+	cache := New(logger, nil)
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	entry := &Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			Selectors:   selectors,
+			ParentId:    "spiffe:parent",
+			SpiffeId:    "spiffe:test",
+			FbSpiffeIds: []string{"spiffe://a.org", "spiffe://b.org"},
+			EntryId:     "1",
+		},
+		FederatesWith: []string{"spiffe://a.org", "spiffe://b.org"},
+	}
+	cache.SetEntry(entry)
+
+	sub := NewSubscriber(selectors)
+	cache.Subscribe(sub)
+	defer cache.Unsubscribe(sub)
+	wu := <-sub.Updates()
+	if assert.Len(t, wu.Entries, 1) {
+		assert.Equal(t, []string{"spiffe://a.org", "spiffe://b.org"}, wu.Entries[0].FederatesWith)
+	}
+
+	// Changing the federation relationships notifies the subscriber.
+	entry = &Entry{
+		RegistrationEntry: entry.RegistrationEntry,
+		FederatesWith:     []string{"spiffe://a.org"},
+	}
+	cache.SetEntry(entry)
+	wu = <-sub.Updates()
+	if assert.Len(t, wu.Entries, 1) {
+		assert.Equal(t, []string{"spiffe://a.org"}, wu.Entries[0].FederatesWith)
+	}
+}
+
+func TestSetInvalidEntry(t *testing.T) {
+	cache := New(logger, nil)
+	assert.Equal(t, ErrInvalidEntry, cache.SetEntry(nil))
+	assert.Equal(t, ErrInvalidEntry, cache.SetEntry(&Entry{}))
+	assert.Equal(t, ErrInvalidEntry, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{SpiffeId: "spiffe:test"},
+	}))
+	assert.True(t, cache.IsEmpty())
+}
+
+func TestNextRotation(t *testing.T) {
+	cache := New(logger, nil)
+	_, ok := cache.NextRotation(time.Minute)
+	assert.False(t, ok)
+
+	now := time.Now()
+	newEntry := func(id string, svid *x509.Certificate) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}},
+				ParentId:  "spiffe:parent",
+				SpiffeId:  "spiffe:test" + id,
+				EntryId:   id,
+			},
+			SVID: svid,
+		}
+	}
+	// Entries without SVID are skipped.
+	cache.SetEntry(newEntry("1", nil))
+	_, ok = cache.NextRotation(time.Minute)
+	assert.False(t, ok)
+
+	cache.SetEntry(newEntry("2", &x509.Certificate{NotAfter: now.Add(time.Hour)}))
+	cache.SetEntry(newEntry("3", &x509.Certificate{NotAfter: now.Add(10 * time.Minute)}))
+	cache.SetEntry(newEntry("4", &x509.Certificate{NotAfter: now.Add(30 * time.Minute)}))
+	next, ok := cache.NextRotation(time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(9*time.Minute), next)
+	next, ok = cache.NextRotation(0)
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(10*time.Minute), next)
+}
+
+func TestDeliveredEntriesAreCopies(t *testing.T) {
+	cache := New(logger, nil)
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	entry := &Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			Selectors:   Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}},
+			ParentId:    "spiffe:parent",
+			SpiffeId:    "spiffe:test",
+			FbSpiffeIds: []string{"spiffe://a.org"},
+			EntryId:     "1",
+		},
+		SVID:          &x509.Certificate{Raw: []byte("svid")},
+		PrivateKey:    privateKey,
+		Bundles:       map[string][]byte{"spiffe://a.org": []byte("a")},
+		FederatesWith: []string{"spiffe://a.org"},
+	}
+	cache.SetEntry(entry)
+	expected := copyEntry(entry)
+
+	sub := NewSubscriber(selectors)
+	cache.Subscribe(sub)
+	defer cache.Unsubscribe(sub)
+	wu := <-sub.Updates()
+	if !assert.Len(t, wu.Entries, 1) {
+		return
+	}
+
+	// The copy is equal to the cached entry and shares the SVID and key.
+	delivered := wu.Entries[0]
+	assert.Equal(t, expected, delivered)
+	assert.True(t, delivered.SVID == entry.SVID)
+	assert.True(t, delivered.PrivateKey == entry.PrivateKey)
+
+	// Modifying the delivered entry doesn't affect the cache.
+	delivered.RegistrationEntry.Selectors[0].Value = "uid:2222"
+	delivered.RegistrationEntry.Selectors = append(delivered.RegistrationEntry.Selectors, &common.Selector{Type: "unix", Value: "gid:1"})
+	delivered.RegistrationEntry.FbSpiffeIds[0] = "spiffe://b.org"
+	delivered.Bundles["spiffe://a.org"][0] = 'b'
+	delivered.Bundles["spiffe://b.org"] = []byte("b")
+	delivered.FederatesWith[0] = "spiffe://b.org"
+
+	assert.Equal(t, expected, cache.Entry(entry.RegistrationEntry))
+	assert.True(t, cache.HasMatch(selectors))
+	assert.NoError(t, cache.checkInvariants())
+	snapshot, snapshotSub, err := cache.SubscribeAndSnapshot(selectors)
+	require.NoError(t, err)
+	defer cache.Unsubscribe(snapshotSub)
+	assert.Equal(t, []*Entry{expected}, snapshot.Entries)
+}
+
+func TestRotationThreshold(t *testing.T) {
+	cache := New(logger, nil)
+	now := time.Now()
+	newEntry := func(id string, lifetime time.Duration, threshold float64) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}},
+				ParentId:  "spiffe:parent",
+				SpiffeId:  "spiffe:test" + id,
+				EntryId:   id,
+			},
+			SVID:              &x509.Certificate{NotBefore: now, NotAfter: now.Add(lifetime)},
+			RotationThreshold: threshold,
+		}
+	}
+
+	// Rotated at 80% of its lifetime, in 80 minutes.
+	e1 := newEntry("1", 100*time.Minute, 0.8)
+	assert.Equal(t, now.Add(80*time.Minute), e1.RotationTime(time.Minute))
+	cache.SetEntry(e1)
+	next, ok := cache.NextRotation(time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(80*time.Minute), next)
+
+	// Rotated at 50% of its lifetime, in 60 minutes.
+	e2 := newEntry("2", 120*time.Minute, 0.5)
+	cache.SetEntry(e2)
+	next, _ = cache.NextRotation(time.Minute)
+	assert.Equal(t, now.Add(60*time.Minute), next)
+
+	// Without threshold, rotated a minute before expiring, in 59 minutes.
+	e3 := newEntry("3", 60*time.Minute, 0)
+	assert.Equal(t, now.Add(59*time.Minute), e3.RotationTime(time.Minute))
+	cache.SetEntry(e3)
+	next, _ = cache.NextRotation(time.Minute)
+	assert.Equal(t, now.Add(59*time.Minute), next)
+
+	// Invalid thresholds are ignored.
+	e4 := newEntry("4", 60*time.Minute, 1.5)
+	assert.Equal(t, now.Add(50*time.Minute), e4.RotationTime(10*time.Minute))
+}
+
+func TestBundleIsShared(t *testing.T) {
+	root1 := &x509.Certificate{Raw: []byte("root1")}
+	root2 := &x509.Certificate{Raw: []byte("root2")}
+	cache := New(logger, []*x509.Certificate{root1})
+
+	// Appending to the returned bundle doesn't affect the cached one.
+	bundle := cache.Bundle()
+	_ = append(bundle, root2)
+	assert.Equal(t, []*x509.Certificate{root1}, cache.Bundle())
+
+	// Bundles returned before a change are not modified by it.
+	cache.SetBundle([]*x509.Certificate{root2})
+	assert.Equal(t, []*x509.Certificate{root1}, bundle)
+	cache.RemoveBundleRoot(root2)
+	assert.Nil(t, cache.Bundle())
+}
+
+func TestUpdateBundleIsShared(t *testing.T) {
+	root1 := &x509.Certificate{Raw: []byte("root1")}
+	root2 := &x509.Certificate{Raw: []byte("root2")}
+	cache := New(logger, []*x509.Certificate{root1})
+	sub := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}})
+	require.NoError(t, cache.Subscribe(sub))
+	defer cache.Unsubscribe(sub)
+
+	// The update shares the cached bundle, which appending doesn't affect.
+	wu := <-sub.Updates()
+	require.Equal(t, []*x509.Certificate{root1}, wu.Bundle)
+	assert.True(t, &wu.Bundle[0] == &cache.Bundle()[0])
+	_ = append(wu.Bundle, root2)
+	assert.Equal(t, []*x509.Certificate{root1}, cache.Bundle())
+
+	// Updates sent before a change are not modified by it.
+	require.NoError(t, cache.SetBundle([]*x509.Certificate{root2}))
+	assert.Equal(t, []*x509.Certificate{root1}, wu.Bundle)
+	assert.Equal(t, []*x509.Certificate{root2}, (<-sub.Updates()).Bundle)
+}
+
+func BenchmarkBundle(b *testing.B) {
+	bundle := make([]*x509.Certificate, 1000)
+	for i := range bundle {
+		bundle[i] = &x509.Certificate{Raw: []byte(strconv.Itoa(i))}
+	}
+	cache := New(logger, bundle)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Bundle()
+	}
+}
+
+func TestMaxSelectors(t *testing.T) {
+	newSelectors := func(n int) Selectors {
+		selectors := Selectors{}
+		for i := 0; i < n; i++ {
+			selectors = append(selectors, &common.Selector{Type: "unix", Value: fmt.Sprintf("gid:%d", i)})
+		}
+		return selectors
+	}
+	newEntry := func(n int) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: newSelectors(n),
+				ParentId:  "spiffe:parent",
+				SpiffeId:  "spiffe:test",
+				EntryId:   strconv.Itoa(n),
+			},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		selectors int
+		err       error
+	}{
+		{name: "within_limit", selectors: 2},
+		{name: "at_limit", selectors: 3},
+		{name: "over_limit", selectors: 4, err: ErrTooManySelectors},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := New(logger, nil, WithMaxSelectors(3))
+			assert.Equal(t, test.err, cache.SetEntry(newEntry(test.selectors)))
+			assert.Equal(t, test.err == nil, !cache.IsEmpty())
+
+			sub := NewSubscriber(newSelectors(test.selectors))
+			assert.Equal(t, test.err, cache.Subscribe(sub))
+			assert.Equal(t, test.err == nil, cache.SubscriberByID(sub.ID()) != nil)
+
+			_, _, err := cache.SubscribeAndSnapshot(newSelectors(test.selectors))
+			assert.Equal(t, test.err, err)
+
+			cache.Reset([]*Entry{newEntry(test.selectors)}, nil)
+			assert.Equal(t, test.err == nil, !cache.IsEmpty())
+			cache.Reset(nil, nil)
+			result := cache.Reconcile([]*Entry{newEntry(test.selectors)})
+			assert.Equal(t, test.err == nil, len(result.Added) == 1)
+			assert.Equal(t, test.err == nil, !cache.IsEmpty())
+		})
+	}
+
+	// The number of selectors is not limited by default.
+	cache := New(logger, nil)
+	assert.NoError(t, cache.SetEntry(newEntry(100)))
+	assert.NoError(t, cache.Subscribe(NewSubscriber(newSelectors(10))))
+}
+
+func TestAsyncNotify(t *testing.T) {
+	cache := New(logger, nil, WithAsyncNotify())
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	sub := NewSubscriber(selectors)
+	cache.Subscribe(sub)
+	defer cache.Unsubscribe(sub)
+	util.RunWithTimeout(t, time.Second, func() {
+		<-sub.Updates()
+	})
+
+	// Hold the notification lock, as an in-flight pass would. Mutations
+	// return without waiting for it.
+	cache.notifyMutex.Lock()
+	util.RunWithTimeout(t, time.Second, func() {
+		for i := 0; i < 3; i++ {
+			cache.SetEntry(&Entry{
+				RegistrationEntry: &common.RegistrationEntry{
+					Selectors: selectors,
+					ParentId:  "spiffe:parent",
+					SpiffeId:  fmt.Sprintf("spiffe:test%d", i),
+					EntryId:   strconv.Itoa(i),
+				},
+			})
+		}
+	})
+	cache.notifyMutex.Unlock()
+
+	// The latest state is eventually delivered.
+	util.RunWithTimeout(t, time.Second, func() {
+		for {
+			wu, ok := <-sub.Updates()
+			if ok && len(wu.Entries) == 3 {
+				return
+			}
+		}
+	})
+}
+
+func TestEntriesByParentID(t *testing.T) {
+	cache := New(logger, nil)
+	newEntry := func(id, parentID string) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}},
+				ParentId:  parentID,
+				SpiffeId:  "spiffe:test" + id,
+				EntryId:   id,
+			},
+		}
+	}
+	e1 := newEntry("1", "spiffe:parent1")
+	e2 := newEntry("2", "spiffe:parent2")
+	e3 := newEntry("3", "spiffe:parent1")
+	e4 := newEntry("4", "spiffe:parent1")
+	for _, e := range []*Entry{e4, e2, e1, e3} {
+		cache.SetEntry(e)
+	}
+
+	assert.Equal(t, []*Entry{e1, e3, e4}, cache.EntriesByParentID("spiffe:parent1"))
+	assert.Equal(t, []*Entry{e2}, cache.EntriesByParentID("spiffe:parent2"))
+	assert.Empty(t, cache.EntriesByParentID("spiffe:parent3"))
+}
+
+func TestSuspendNotifications(t *testing.T) {
+	cache := New(logger, nil)
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	sub := NewSubscriber(selectors)
+	cache.Subscribe(sub)
+	defer cache.Unsubscribe(sub)
+	<-sub.Updates()
+
+	cache.SuspendNotifications()
+	cache.SuspendNotifications()
+	for i := 0; i < 3; i++ {
+		cache.SetEntry(&Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: selectors,
+				ParentId:  "spiffe:parent",
+				SpiffeId:  fmt.Sprintf("spiffe:test%d", i),
+				EntryId:   strconv.Itoa(i),
+			},
+		})
+	}
+	cache.SetBundle([]*x509.Certificate{{Raw: []byte("root1")}})
+	assert.Len(t, sub.Updates(), 0)
+
+	// Notifications resume when every suspension is matched.
+	cache.ResumeNotifications()
+	assert.Len(t, sub.Updates(), 0)
+	cache.ResumeNotifications()
+
+	// A single pass delivers the latest state.
+	assert.Len(t, sub.Updates(), 1)
+	wu := <-sub.Updates()
+	assert.Len(t, wu.Entries, 3)
+	assert.Len(t, wu.Bundle, 1)
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&cache.droppedUpdates))
+
+	// Unmatched resumes have no effect.
+	cache.ResumeNotifications()
+	cache.SetBundle(nil)
+	assert.Len(t, sub.Updates(), 1)
+}
+
+func TestEntryTLSCertificate(t *testing.T) {
+	svid, key, err := util.LoadSVIDFixture()
+	require.NoError(t, err)
+	ca, caKey, err := util.LoadCAFixture()
+	require.NoError(t, err)
+
+	entry := &Entry{SVID: svid, PrivateKey: key}
+	cert, err := entry.TLSCertificate()
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{svid.Raw}, cert.Certificate)
+	assert.Equal(t, key, cert.PrivateKey)
+
+	// The certificate validates against the bundle.
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:       roots,
+		CurrentTime: leaf.NotBefore.Add(time.Minute),
+	})
+	assert.NoError(t, err)
+
+	_, err = (&Entry{PrivateKey: key}).TLSCertificate()
+	assert.EqualError(t, err, "entry has no SVID")
+	_, err = (&Entry{SVID: svid}).TLSCertificate()
+	assert.EqualError(t, err, "entry has no private key")
+	_, err = (&Entry{SVID: svid, PrivateKey: caKey}).TLSCertificate()
+	assert.EqualError(t, err, "entry private key does not match the SVID")
+}
+
+func TestEntryOrError(t *testing.T) {
+	cache := New(logger, nil)
+	entry := &Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			Selectors: Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}},
+			ParentId:  "spiffe:parent",
+			SpiffeId:  "spiffe:test",
+			EntryId:   "1",
+		},
+	}
+	cache.SetEntry(entry)
+
+	actual, err := cache.EntryOrError("1")
+	assert.NoError(t, err)
+	assert.Equal(t, entry, actual)
+
+	actual, err = cache.EntryOrError("2")
+	assert.Equal(t, ErrEntryNotFound, err)
+	assert.Nil(t, actual)
+}
+
+func TestGeneration(t *testing.T) {
+	cache := New(logger, nil)
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	entry := &Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			Selectors: selectors,
+			ParentId:  "spiffe:parent",
+			SpiffeId:  "spiffe:test",
+			EntryId:   "1",
+		},
+	}
+	root := &x509.Certificate{Raw: []byte("root1")}
+
+	generation := cache.Generation()
+	advances := func(name string, mutate func()) {
+		mutate()
+		next := cache.Generation()
+		assert.True(t, next > generation, "%s did not advance the generation", name)
+		generation = next
+	}
+	advances("SetEntry", func() { cache.SetEntry(entry) })
+	advances("SetBundle", func() { cache.SetBundle([]*x509.Certificate{root}) })
+	advances("RemoveBundleRoot", func() { cache.RemoveBundleRoot(root) })
+	advances("SetFederatedBundle", func() { cache.SetFederatedBundle("spiffe://a.org", []*x509.Certificate{root}) })
+	advances("SetJWTBundle", func() { cache.SetJWTBundle("spiffe://a.org", map[string]crypto.PublicKey{"kid": privateKey.Public()}) })
+	advances("SetDegraded", func() { cache.SetDegraded(true, "reason") })
+	advances("DeleteEntry", func() { cache.DeleteEntry(entry.RegistrationEntry) })
+	advances("Reset", func() { cache.Reset([]*Entry{entry}, nil) })
+
+	// Reads, and mutations that change nothing, don't advance it.
+	cache.Entries()
+	cache.Entry(entry.RegistrationEntry)
+	cache.Bundle()
+	cache.HasMatch(selectors)
+	cache.RemoveBundleRoot(root)
+	cache.SetDegraded(true, "reason")
+	cache.DeleteEntry(&common.RegistrationEntry{EntryId: "2"})
+	assert.Equal(t, generation, cache.Generation())
+
+	// Updates are sent for the current generation.
+	sub := NewSubscriber(selectors)
+	cache.Subscribe(sub)
+	defer cache.Unsubscribe(sub)
+	<-sub.Updates()
+	assert.Equal(t, generation, sub.version)
+}
+
+func TestSubscribeFunc(t *testing.T) {
+	cache := New(logger, nil)
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	newEntry := func(id string, selectors Selectors) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: selectors,
+				ParentId:  "spiffe:parent",
+				SpiffeId:  "spiffe:test" + id,
+				EntryId:   id,
+			},
+		}
+	}
+
+	var updates []*WorkloadUpdate
+	cancel, err := cache.SubscribeFunc(selectors, func(wu *WorkloadUpdate) {
+		updates = append(updates, wu)
+	})
+	require.NoError(t, err)
+
+	// The callback is called with the initial update and on matching changes.
+	require.Len(t, updates, 1)
+	assert.Empty(t, updates[0].Entries)
+	e1 := newEntry("1", selectors)
+	cache.SetEntry(e1)
+	require.Len(t, updates, 2)
+	assert.Equal(t, []*Entry{e1}, updates[1].Entries)
+	cache.SetEntry(newEntry("2", Selectors{&common.Selector{Type: "unix", Value: "uid:2222"}}))
+	assert.Len(t, updates, 2)
+
+	// The callback is not called after canceling.
+	cancel()
+	cache.SetEntry(newEntry("3", selectors))
+	assert.Len(t, updates, 2)
+	assert.Empty(t, cache.WouldNotify(e1))
+}
+
+func TestPickSVID(t *testing.T) {
+	cache := New(logger, nil)
+	assert.Nil(t, cache.PickSVID("spiffe://example.org/foo"))
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, cache.SetEntry(&Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				EntryId:  fmt.Sprintf("foo%d", i),
+				SpiffeId: "spiffe://example.org/foo",
+			},
+			SVID: &x509.Certificate{},
+		}))
+	}
+	// Entries without an SVID or with another SPIFFE ID are never picked.
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			EntryId:  "foo-pending",
+			SpiffeId: "spiffe://example.org/foo",
+		},
+	}))
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			EntryId:  "bar",
+			SpiffeId: "spiffe://example.org/bar",
+		},
+		SVID: &x509.Certificate{},
+	}))
+
+	picks := make(map[string]int)
+	var m sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 30; j++ {
+				entry := cache.PickSVID("spiffe://example.org/foo")
+				m.Lock()
+				picks[entry.RegistrationEntry.EntryId]++
+				m.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, map[string]int{"foo0": 100, "foo1": 100, "foo2": 100}, picks)
+
+	assert.Equal(t, "bar", cache.PickSVID("spiffe://example.org/bar").RegistrationEntry.EntryId)
+}
+
+func TestVerifyFederationRefs(t *testing.T) {
+	cache := New(logger, nil)
+	cache.SetFederatedBundle("spiffe://a.org", []*x509.Certificate{{Raw: []byte("root")}})
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{EntryId: "foo"},
+		Bundles: map[string][]byte{
+			"spiffe://a.org": []byte("a"),
+			"spiffe://b.org": []byte("b"),
+		},
+	}))
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{EntryId: "bar"},
+		Bundles: map[string][]byte{
+			"spiffe://a.org": []byte("a"),
+		},
+	}))
+	assert.Equal(t, map[string][]string{"foo": {"spiffe://b.org"}}, cache.VerifyFederationRefs())
+
+	cache.SetFederatedBundle("spiffe://b.org", []*x509.Certificate{{Raw: []byte("root")}})
+	assert.Empty(t, cache.VerifyFederationRefs())
+}
+
+func TestFreeze(t *testing.T) {
+	root1 := &x509.Certificate{Raw: []byte("root1")}
+	root2 := &x509.Certificate{Raw: []byte("root2")}
+	cache := New(logger, []*x509.Certificate{root1})
+	entry := &Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			Selectors: Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}},
+			EntryId:   "foo",
+		},
+	}
+	require.NoError(t, cache.SetEntry(entry))
+	sub := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}})
+	require.NoError(t, cache.Subscribe(sub))
+	<-sub.Updates()
+
+	cache.Freeze()
+	other := &Entry{RegistrationEntry: &common.RegistrationEntry{EntryId: "bar"}}
+	assert.Equal(t, ErrFrozen, cache.SetEntry(other))
+	deleted, err := cache.DeleteEntry(entry.RegistrationEntry)
+	assert.Equal(t, ErrFrozen, err)
+	assert.False(t, deleted)
+	assert.Equal(t, ErrFrozen, cache.SetBundle([]*x509.Certificate{root2}))
+	assert.False(t, cache.RemoveBundleRoot(root1))
+	cache.Reset(nil, nil)
+	cache.SetFederatedBundle("spiffe://a.org", []*x509.Certificate{root2})
+	cache.SetJWTBundle("spiffe://a.org", map[string]crypto.PublicKey{"kid": privateKey.Public()})
+	cache.SetBundleMetadata(map[string]string{"seq": "1"})
+	cache.SetDegraded(true, "server unreachable")
+	cache.SetBootstrapComplete()
+
+	// Reads and subscriptions keep working.
+	assert.Equal(t, entry, cache.Entry(entry.RegistrationEntry))
+	assert.Nil(t, cache.Entry(other.RegistrationEntry))
+	assert.Equal(t, []*x509.Certificate{root1}, cache.Bundle())
+	assert.Nil(t, cache.FederatedBundle("spiffe://a.org"))
+	assert.Nil(t, cache.JWTBundle("spiffe://a.org"))
+	assert.Nil(t, cache.BundleMetadata())
+	update, snapshotSub, err := cache.SubscribeAndSnapshot(sub.sel)
+	require.NoError(t, err)
+	defer cache.Unsubscribe(snapshotSub)
+	assert.Len(t, update.Entries, 1)
+	assert.False(t, update.Stale)
+	assert.False(t, update.Bootstrapped)
+	select {
+	case <-sub.Updates():
+		t.Fatal("subscriber notified while frozen")
+	default:
+	}
+
+	cache.Unfreeze()
+	assert.NoError(t, cache.SetEntry(other))
+	assert.NoError(t, cache.SetBundle([]*x509.Certificate{root2}))
+	deleted, err = cache.DeleteEntry(entry.RegistrationEntry)
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	assert.Equal(t, []*x509.Certificate{root2}, cache.Bundle())
+}
+
+func TestClose(t *testing.T) {
+	cache := New(logger, nil)
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	entry := &Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			Selectors: selectors,
+			EntryId:   "foo",
+			SpiffeId:  "spiffe://example.org/foo",
+		},
+	}
+	require.NoError(t, cache.SetEntry(entry))
+	sub := NewSubscriber(selectors)
+	require.NoError(t, cache.Subscribe(sub))
+	<-sub.Updates()
+
+	cache.Close()
+	_, ok := <-sub.Updates()
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.subscribers.count())
+
+	// Subscribers can't be registered anymore.
+	assert.Equal(t, ErrClosed, cache.Subscribe(NewSubscriber(selectors)))
+	_, err := cache.SubscribeSelectors(selectors)
+	assert.Equal(t, ErrClosed, err)
+	_, _, err = cache.SubscribeAndSnapshot(selectors)
+	assert.Equal(t, ErrClosed, err)
+	_, ok = <-cache.SubscribeSPIFFEID(entry.RegistrationEntry.SpiffeId).Updates()
+	assert.False(t, ok)
+	_, ok = <-cache.SubscribeDynamic(context.Background(), make(chan Selectors)).Updates()
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.subscribers.count())
+
+	// Other calls keep working.
+	other := &Entry{RegistrationEntry: &common.RegistrationEntry{EntryId: "bar"}}
+	assert.NoError(t, cache.SetEntry(other))
+	assert.Equal(t, other, cache.Entry(other.RegistrationEntry))
+	assert.True(t, cache.HasMatch(selectors))
+}
+
+func TestFreezeKeepsSoftDeletedEntry(t *testing.T) {
+	clk := newFakeClock()
+	cache := New(logger, nil, WithClock(clk))
+	entry := &Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			Selectors: Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}},
+			EntryId:   "foo",
+		},
+	}
+	require.NoError(t, cache.SetEntry(entry))
+	require.NoError(t, cache.SoftDeleteEntry("foo", time.Minute))
+
+	// The grace period elapsing while frozen doesn't remove the entry.
+	cache.Freeze()
+	clk.Add(time.Minute)
+	cache.Unfreeze()
+	require.NotNil(t, cache.Entry(entry.RegistrationEntry))
+	assert.True(t, cache.Entry(entry.RegistrationEntry).Deprecated)
+}
+
+func TestEntryIssuer(t *testing.T) {
+	svid, _, err := util.LoadSVIDFixture()
+	require.NoError(t, err)
+	require.NotEmpty(t, svid.AuthorityKeyId)
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	cache := New(logger, nil)
+
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "with-aki"},
+		SVID:              svid,
+	}))
+	// SVIDs without an authority key identifier have an empty issuer key ID.
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "without-aki"},
+		SVID:              &x509.Certificate{},
+	}))
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "without-svid"},
+	}))
+
+	update, sub, err := cache.SubscribeAndSnapshot(selectors)
+	require.NoError(t, err)
+	defer cache.Unsubscribe(sub)
+	b, err := update.Marshal()
+	require.NoError(t, err)
+	decoded, err := UnmarshalWorkloadUpdate(b)
+	require.NoError(t, err)
+	sortEntries(decoded.Entries)
+
+	require.Len(t, decoded.Entries, 3)
+	assert.Equal(t, svid.AuthorityKeyId, decoded.Entries[0].IssuerKeyID)
+	assert.Equal(t, "O=SPIFFE,C=US", decoded.Entries[0].IssuerDN)
+	assert.Empty(t, decoded.Entries[1].IssuerKeyID)
+	assert.Empty(t, decoded.Entries[1].IssuerDN)
+	assert.Empty(t, decoded.Entries[2].IssuerKeyID)
+	assert.Empty(t, decoded.Entries[2].IssuerDN)
+}
+
+func TestExpiryOnlyUpdates(t *testing.T) {
+	cache := New(logger, nil)
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	now := time.Now()
+	newEntry := func(id, parentID string, notAfter time.Time) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: selectors,
+				ParentId:  parentID,
+				EntryId:   id,
+			},
+			SVID: &x509.Certificate{NotAfter: notAfter},
+		}
+	}
+	require.NoError(t, cache.SetEntry(newEntry("1", "spiffe:parent", now.Add(time.Hour))))
+
+	sub := NewSubscriber(selectors, WithExpiryOnly())
+	require.NoError(t, cache.Subscribe(sub))
+	defer cache.Unsubscribe(sub)
+	assertUpdate := func(entries int) {
+		select {
+		case wu := <-sub.Updates():
+			assert.Len(t, wu.Entries, entries)
+		default:
+			t.Fatal("expected an update")
+		}
+	}
+	assertNoUpdate := func() {
+		select {
+		case <-sub.Updates():
+			t.Fatal("unexpected update")
+		default:
+		}
+	}
+	assertUpdate(1)
+
+	// Changes not affecting the expiration don't notify the subscriber.
+	require.NoError(t, cache.SetEntry(newEntry("1", "spiffe:other-parent", now.Add(time.Hour))))
+	require.NoError(t, cache.SetBundle([]*x509.Certificate{{Raw: []byte("root")}}))
+	cache.SetDegraded(true, "server unreachable")
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "pending"},
+	}))
+	assertNoUpdate()
+
+	// Rotated, added and removed SVIDs notify the subscriber.
+	require.NoError(t, cache.SetEntry(newEntry("1", "spiffe:other-parent", now.Add(2*time.Hour))))
+	assertUpdate(2)
+	require.NoError(t, cache.SetEntry(newEntry("2", "spiffe:parent", now.Add(time.Hour))))
+	assertUpdate(3)
+	_, err := cache.DeleteEntry(&common.RegistrationEntry{EntryId: "2"})
+	require.NoError(t, err)
+	assertUpdate(2)
+	assertNoUpdate()
+}
+
+func TestKeyFunc(t *testing.T) {
+	// Entries are keyed by SPIFFE ID and selectors, regardless of their ID.
+	keyFunc := func(e *Entry) string {
+		return e.RegistrationEntry.SpiffeId + "#" + selectorsKey(e.RegistrationEntry.Selectors)
+	}
+	cache := New(logger, nil, WithKeyFunc(keyFunc), WithAccessCounting())
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	newEntry := func(entryID, spiffeID string) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: selectors,
+				SpiffeId:  spiffeID,
+				EntryId:   entryID,
+			},
+		}
+	}
+	foo := newEntry("1", "spiffe://example.org/foo")
+	bar := newEntry("1", "spiffe://example.org/bar")
+	require.NoError(t, cache.SetEntry(foo))
+	require.NoError(t, cache.SetEntry(bar))
+	assert.Len(t, cache.Entries(), 2)
+	assert.Equal(t, ErrInvalidEntry, cache.SetEntry(&Entry{}))
+
+	// Entries with the same key replace each other.
+	fooReplaced := newEntry("2", "spiffe://example.org/foo")
+	require.NoError(t, cache.SetEntry(fooReplaced))
+	assert.Len(t, cache.Entries(), 2)
+	assert.Equal(t, fooReplaced, cache.Entry(foo.RegistrationEntry))
+
+	fooKey := keyFunc(foo)
+	entry, err := cache.EntryOrError(fooKey)
+	require.NoError(t, err)
+	assert.Equal(t, fooReplaced, entry)
+	assert.Equal(t, map[string]*Entry{fooKey: fooReplaced}, cache.EntriesByIDs([]string{fooKey, "1", "2"}))
+	_, err = cache.EntryOrError("1")
+	assert.Equal(t, ErrEntryNotFound, err)
+	assert.Equal(t, uint64(3), cache.EntryAccessCount(fooKey))
+	// Explanations name the entries by key.
+	explanations := cache.ExplainMatch(selectors)
+	require.Len(t, explanations, 2)
+	for _, explanation := range explanations {
+		_, err := cache.EntryOrError(explanation.EntryID)
+		assert.NoError(t, err)
+	}
+
+	deleted, err := cache.DeleteEntry(foo.RegistrationEntry)
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	assert.Nil(t, cache.Entry(fooReplaced.RegistrationEntry))
+	assert.Equal(t, bar, cache.Entry(bar.RegistrationEntry))
+
+	cache.Reset([]*Entry{foo}, nil)
+	assert.Equal(t, foo, cache.Entry(fooReplaced.RegistrationEntry))
+	assert.Nil(t, cache.Entry(bar.RegistrationEntry))
+	assert.NoError(t, cache.checkInvariants())
+
+	// Reset keys the normalized entries.
+	cache.SetSelectorNormalizer(func(s *common.Selector) *common.Selector {
+		return &common.Selector{Type: s.Type, Value: strings.ToLower(s.Value)}
+	})
+	upper := newEntry("1", "spiffe://example.org/foo")
+	upper.RegistrationEntry.Selectors = Selectors{&common.Selector{Type: "unix", Value: "UID:1111"}}
+	cache.Reset([]*Entry{upper}, nil)
+	assert.NotNil(t, cache.Entry(foo.RegistrationEntry))
+	assert.NoError(t, cache.checkInvariants())
+}
+
+func TestKeyFuncUpdates(t *testing.T) {
+	keyFunc := func(e *Entry) string {
+		return e.RegistrationEntry.SpiffeId
+	}
+	cache := New(logger, nil, WithKeyFunc(keyFunc))
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	notAfter := time.Now().Add(time.Hour)
+	// The entries share their entry ID.
+	newEntry := func(spiffeID string, svid bool) *Entry {
+		entry := &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: selectors,
+				SpiffeId:  spiffeID,
+				EntryId:   "1",
+			},
+		}
+		if svid {
+			entry.SVID = &x509.Certificate{NotAfter: notAfter}
+		}
+		return entry
+	}
+	foo := newEntry("spiffe://example.org/foo", true)
+	bar := newEntry("spiffe://example.org/bar", true)
+	require.NoError(t, cache.SetEntry(foo))
+	require.NoError(t, cache.SetEntry(bar))
+
+	delta := NewSubscriber(selectors, WithDeltaUpdates())
+	require.NoError(t, cache.Subscribe(delta))
+	defer cache.Unsubscribe(delta)
+	expiry := NewSubscriber(selectors, WithExpiryOnly())
+	require.NoError(t, cache.Subscribe(expiry))
+	defer cache.Unsubscribe(expiry)
+	assert.Len(t, (<-delta.Updates()).Entries, 2)
+	assert.Len(t, (<-expiry.Updates()).Entries, 2)
+
+	// Dropping the SVID of one entry changes the expiries.
+	require.NoError(t, cache.SetEntry(newEntry("spiffe://example.org/foo", false)))
+	wu := <-delta.Updates()
+	assert.Empty(t, wu.AddedEntries)
+	assert.Len(t, wu.ChangedEntries, 1)
+	assert.Len(t, (<-expiry.Updates()).Entries, 2)
+
+	// Removed entries are reported by key.
+	_, err := cache.DeleteEntry(bar.RegistrationEntry)
+	require.NoError(t, err)
+	wu = <-delta.Updates()
+	assert.Empty(t, wu.AddedEntries)
+	assert.Empty(t, wu.ChangedEntries)
+	assert.Equal(t, []string{"spiffe://example.org/bar"}, wu.RemovedEntryIDs)
+	assert.Len(t, (<-expiry.Updates()).Entries, 1)
+}
+
+func TestManualFlush(t *testing.T) {
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	newEntry := func(i int) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: selectors,
+				SpiffeId:  fmt.Sprintf("spiffe:test_%d", i),
+				EntryId:   "1",
+			},
+		}
+	}
+
+	t.Run("flush", func(t *testing.T) {
+		cache := New(logger, nil, WithManualFlush(0))
+		sub := NewSubscriber(selectors)
+		require.NoError(t, cache.Subscribe(sub))
+		for i := 0; i < 5; i++ {
+			require.NoError(t, cache.SetEntry(newEntry(i)))
+		}
+		assert.Equal(t, 0, len(sub.Updates()))
+
+		// The latest state is delivered in a single update.
+		cache.FlushNotifications()
+		assert.Equal(t, 1, len(sub.Updates()))
+		wu := <-sub.Updates()
+		assert.Equal(t, "spiffe:test_4", wu.Entries[0].RegistrationEntry.SpiffeId)
+		assert.Equal(t, uint64(0), cache.droppedUpdates)
+
+		cache.FlushNotifications()
+		assert.Equal(t, 0, len(sub.Updates()))
+	})
+
+	t.Run("max delay", func(t *testing.T) {
+		clk := newFakeClock()
+		cache := New(logger, nil, WithClock(clk), WithManualFlush(time.Second))
+		sub1 := NewSubscriber(selectors)
+		require.NoError(t, cache.Subscribe(sub1))
+		clk.Add(500 * time.Millisecond)
+		sub2 := NewSubscriber(selectors)
+		require.NoError(t, cache.Subscribe(sub2))
+		require.NoError(t, cache.SetEntry(newEntry(0)))
+		assert.Equal(t, 0, len(sub1.Updates()))
+		assert.Equal(t, 0, len(sub2.Updates()))
+
+		// Every subscriber is notified when its own timer expires.
+		clk.Add(500 * time.Millisecond)
+		assert.Equal(t, 1, len(sub1.Updates()))
+		assert.Equal(t, 0, len(sub2.Updates()))
+		clk.Add(500 * time.Millisecond)
+		assert.Equal(t, 1, len(sub2.Updates()))
+		wu := <-sub2.Updates()
+		assert.Equal(t, "spiffe:test_0", wu.Entries[0].RegistrationEntry.SpiffeId)
+	})
+}
+
+func TestUpdateSubscription(t *testing.T) {
+	cache := New(logger, nil, WithMaxSelectors(2))
+	uid := &common.Selector{Type: "unix", Value: "uid:1111"}
+	gid := &common.Selector{Type: "unix", Value: "gid:2222"}
+	newEntry := func(id string, selectors ...*common.Selector) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: selectors,
+				EntryId:   id,
+			},
+		}
+	}
+	require.NoError(t, cache.SetEntry(newEntry("uid", uid)))
+	require.NoError(t, cache.SetEntry(newEntry("gid", gid)))
+
+	sub := NewSubscriber(Selectors{uid})
+	require.NoError(t, cache.Subscribe(sub))
+	defer cache.Unsubscribe(sub)
+	wu := <-sub.Updates()
+	assert.Equal(t, []string{"uid"}, entryIDs(wu.Entries))
+
+	// The subscriber is notified right away with the new matching entries,
+	// even if the cache didn't change.
+	require.NoError(t, cache.UpdateSubscription(sub, Selectors{gid}))
+	wu = <-sub.Updates()
+	assert.Equal(t, []string{"gid"}, entryIDs(wu.Entries))
+	assert.NoError(t, cache.checkInvariants())
+
+	// Later changes are matched against the new selectors.
+	require.NoError(t, cache.SetEntry(newEntry("uid", uid)))
+	assert.Equal(t, 0, len(sub.Updates()))
+	require.NoError(t, cache.SetEntry(newEntry("uid-gid", uid, gid)))
+	assert.Equal(t, 0, len(sub.Updates()))
+	require.NoError(t, cache.UpdateSubscription(sub, Selectors{uid, gid}))
+	wu = <-sub.Updates()
+	assert.Equal(t, []string{"gid", "uid", "uid-gid"}, entryIDs(wu.Entries))
+	require.NoError(t, cache.SetEntry(newEntry("gid2", gid)))
+	wu = <-sub.Updates()
+	assert.Equal(t, []string{"gid", "gid2", "uid", "uid-gid"}, entryIDs(wu.Entries))
+
+	assert.Equal(t, ErrTooManySelectors, cache.UpdateSubscription(sub, Selectors{uid, gid, {Type: "unix", Value: "user:foo"}}))
+
+	// Unsubscribed subscribers are not registered again.
+	cache.Unsubscribe(sub)
+	require.NoError(t, cache.UpdateSubscription(sub, Selectors{uid}))
+	assert.Nil(t, cache.SubscriberByID(sub.ID()))
+	assert.NoError(t, cache.checkInvariants())
+}
+
+func entryIDs(entries []*Entry) []string {
+	ids := []string{}
+	for _, e := range entries {
+		ids = append(ids, e.RegistrationEntry.EntryId)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestExpirySort(t *testing.T) {
+	cache := New(logger, nil)
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	now := time.Now()
+	newEntry := func(id string, svid *x509.Certificate) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: id},
+			SVID:              svid,
+		}
+	}
+	require.NoError(t, cache.SetEntry(newEntry("1", &x509.Certificate{NotAfter: now.Add(3 * time.Hour)})))
+	require.NoError(t, cache.SetEntry(newEntry("2", nil)))
+	require.NoError(t, cache.SetEntry(newEntry("3", &x509.Certificate{NotAfter: now.Add(time.Hour)})))
+	require.NoError(t, cache.SetEntry(newEntry("4", &x509.Certificate{NotAfter: now.Add(2 * time.Hour)})))
+	require.NoError(t, cache.SetEntry(newEntry("5", nil)))
+	require.NoError(t, cache.SetEntry(newEntry("6", &x509.Certificate{NotAfter: now.Add(time.Hour)})))
+
+	ids := func(wu *WorkloadUpdate) []string {
+		ids := []string{}
+		for _, e := range wu.Entries {
+			ids = append(ids, e.RegistrationEntry.EntryId)
+		}
+		return ids
+	}
+
+	sorted := NewSubscriber(selectors, WithExpirySort())
+	require.NoError(t, cache.Subscribe(sorted))
+	defer cache.Unsubscribe(sorted)
+	assert.Equal(t, []string{"3", "6", "4", "1", "2", "5"}, ids(<-sorted.Updates()))
+
+	// Entries are sorted by ID by default.
+	unsorted := NewSubscriber(selectors)
+	require.NoError(t, cache.Subscribe(unsorted))
+	defer cache.Unsubscribe(unsorted)
+	assert.Equal(t, []string{"1", "2", "3", "4", "5", "6"}, ids(<-unsorted.Updates()))
+
+	require.NoError(t, cache.SetEntry(newEntry("1", &x509.Certificate{NotAfter: now.Add(time.Minute)})))
+	assert.Equal(t, []string{"1", "3", "6", "4", "2", "5"}, ids(<-sorted.Updates()))
+	assert.Equal(t, []string{"1", "2", "3", "4", "5", "6"}, ids(<-unsorted.Updates()))
+}
+
+func TestEntriesByDNSName(t *testing.T) {
+	newEntry := func(id string, dnsNames ...string) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{EntryId: id},
+			SVID:              &x509.Certificate{DNSNames: dnsNames},
+		}
+	}
+	setEntries := func(cache Cache) {
+		require.NoError(t, cache.SetEntry(newEntry("foo", "foo.example.org", "www.example.org")))
+		require.NoError(t, cache.SetEntry(newEntry("www", "www.example.org")))
+		require.NoError(t, cache.SetEntry(newEntry("wildcard", "*.example.org")))
+		require.NoError(t, cache.SetEntry(&Entry{RegistrationEntry: &common.RegistrationEntry{EntryId: "pending"}}))
+	}
+
+	t.Run("exact", func(t *testing.T) {
+		cache := New(logger, nil)
+		setEntries(cache)
+		assert.Equal(t, []string{"foo", "www"}, entryIDs(cache.EntriesByDNSName("www.example.org")))
+		assert.Equal(t, []string{"foo"}, entryIDs(cache.EntriesByDNSName("foo.example.org")))
+		assert.Equal(t, []string{"wildcard"}, entryIDs(cache.EntriesByDNSName("*.example.org")))
+		assert.Empty(t, cache.EntriesByDNSName("bar.example.org"))
+
+		// The index follows the entry changes.
+		require.NoError(t, cache.SetEntry(newEntry("foo", "bar.example.org")))
+		assert.Equal(t, []string{"www"}, entryIDs(cache.EntriesByDNSName("www.example.org")))
+		assert.Equal(t, []string{"foo"}, entryIDs(cache.EntriesByDNSName("bar.example.org")))
+		assert.Empty(t, cache.EntriesByDNSName("foo.example.org"))
+		_, err := cache.DeleteEntry(&common.RegistrationEntry{EntryId: "www"})
+		require.NoError(t, err)
+		assert.Empty(t, cache.EntriesByDNSName("www.example.org"))
+		cache.Reset([]*Entry{newEntry("www", "www.example.org")}, nil)
+		assert.Equal(t, []string{"www"}, entryIDs(cache.EntriesByDNSName("www.example.org")))
+		assert.Empty(t, cache.EntriesByDNSName("bar.example.org"))
+	})
+
+	t.Run("wildcard", func(t *testing.T) {
+		cache := New(logger, nil, WithDNSWildcardMatch())
+		setEntries(cache)
+		assert.Equal(t, []string{"foo", "wildcard", "www"}, entryIDs(cache.EntriesByDNSName("www.example.org")))
+		assert.Equal(t, []string{"wildcard"}, entryIDs(cache.EntriesByDNSName("bar.example.org")))
+		assert.Equal(t, []string{"wildcard"}, entryIDs(cache.EntriesByDNSName("*.example.org")))
+		// Wildcards only cover a single label.
+		assert.Empty(t, cache.EntriesByDNSName("foo.bar.example.org"))
+		assert.Empty(t, cache.EntriesByDNSName("example.org"))
+	})
+}
+
+func TestBundlePEM(t *testing.T) {
+	ca, _, err := util.LoadCAFixture()
+	require.NoError(t, err)
+	svid, _, err := util.LoadSVIDFixture()
+	require.NoError(t, err)
+	cache := New(logger, nil)
+
+	pemBytes, err := cache.BundlePEM()
+	require.NoError(t, err)
+	assert.Nil(t, pemBytes)
+	pemBytes, err = cache.TrustDomainBundlePEM("spiffe://a.org")
+	require.NoError(t, err)
+	assert.Nil(t, pemBytes)
+
+	parse := func(pemBytes []byte) []*x509.Certificate {
+		var certs []*x509.Certificate
+		for {
+			var block *pem.Block
+			block, pemBytes = pem.Decode(pemBytes)
+			if block == nil {
+				break
+			}
+			assert.Equal(t, "CERTIFICATE", block.Type)
+			cert, err := x509.ParseCertificate(block.Bytes)
+			require.NoError(t, err)
+			certs = append(certs, cert)
+		}
+		assert.Empty(t, pemBytes)
+		return certs
+	}
+
+	// The output is the same regardless of the order the roots are set in.
+	require.NoError(t, cache.SetBundle([]*x509.Certificate{ca, svid}))
+	pemBytes, err = cache.BundlePEM()
+	require.NoError(t, err)
+	require.NoError(t, cache.SetBundle([]*x509.Certificate{svid, ca}))
+	reorderedPEMBytes, err := cache.BundlePEM()
+	require.NoError(t, err)
+	assert.Equal(t, pemBytes, reorderedPEMBytes)
+	assert.Equal(t, cache.Bundle(), parse(pemBytes))
+
+	cache.SetFederatedBundle("spiffe://a.org", []*x509.Certificate{svid, ca})
+	pemBytes, err = cache.TrustDomainBundlePEM("spiffe://a.org")
+	require.NoError(t, err)
+	assert.Equal(t, cache.FederatedBundle("spiffe://a.org"), parse(pemBytes))
+	assert.Equal(t, reorderedPEMBytes, pemBytes)
+}
+
+func TestLastDelivered(t *testing.T) {
+	cache := New(logger, nil, WithManualFlush(0))
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	newEntry := func(i int) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: selectors,
+				SpiffeId:  fmt.Sprintf("spiffe:test_%d", i),
+				EntryId:   "1",
+			},
+		}
+	}
+
+	sub := NewSubscriber(selectors)
+	require.NoError(t, cache.Subscribe(sub))
+	defer cache.Unsubscribe(sub)
+	assert.Nil(t, cache.LastDelivered(sub))
+
+	cache.FlushNotifications()
+	wu := <-sub.Updates()
+	assert.True(t, wu == cache.LastDelivered(sub))
+
+	// Pending changes don't affect the last update sent.
+	require.NoError(t, cache.SetEntry(newEntry(0)))
+	assert.True(t, wu == cache.LastDelivered(sub))
+	assert.Empty(t, cache.LastDelivered(sub).Entries)
+
+	cache.FlushNotifications()
+	wu = <-sub.Updates()
+	assert.True(t, wu == cache.LastDelivered(sub))
+	require.NoError(t, cache.SetEntry(newEntry(1)))
+	assert.Equal(t, "spiffe:test_0", cache.LastDelivered(sub).Entries[0].RegistrationEntry.SpiffeId)
+
+	snapshot, snapshotSub, err := cache.SubscribeAndSnapshot(selectors)
+	require.NoError(t, err)
+	defer cache.Unsubscribe(snapshotSub)
+	assert.True(t, snapshot == cache.LastDelivered(snapshotSub))
+}
+
+func TestSoftDeleteEntry(t *testing.T) {
+	clk := newFakeClock()
+	cache := New(logger, nil, WithClock(clk))
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	newEntry := func(id string) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: id},
+		}
+	}
+	require.NoError(t, cache.SetEntry(newEntry("1")))
+	require.NoError(t, cache.SetEntry(newEntry("2")))
+	sub := NewSubscriber(selectors)
+	require.NoError(t, cache.Subscribe(sub))
+	defer cache.Unsubscribe(sub)
+	<-sub.Updates()
+
+	assert.Equal(t, ErrEntryNotFound, cache.SoftDeleteEntry("3", time.Minute))
+	require.NoError(t, cache.SoftDeleteEntry("1", time.Minute))
+	require.NoError(t, cache.SoftDeleteEntry("2", time.Minute))
+
+	// Deprecated entries are delivered during the grace period.
+	wu := <-sub.Updates()
+	require.Len(t, wu.Entries, 2)
+	assert.True(t, wu.Entries[0].Deprecated)
+	assert.True(t, wu.Entries[1].Deprecated)
+	clk.Add(30 * time.Second)
+	assert.Equal(t, 0, len(sub.Updates()))
+	assert.True(t, cache.Entry(newEntry("1").RegistrationEntry).Deprecated)
+
+	// Entries set again during the grace period are kept.
+	require.NoError(t, cache.SetEntry(newEntry("2")))
+	<-sub.Updates()
+
+	clk.Add(30 * time.Second)
+	wu = <-sub.Updates()
+	assert.Equal(t, []string{"2"}, entryIDs(wu.Entries))
+	assert.False(t, wu.Entries[0].Deprecated)
+	assert.Nil(t, cache.Entry(newEntry("1").RegistrationEntry))
+	assert.NoError(t, cache.checkInvariants())
+
+	cache.Freeze()
+	assert.Equal(t, ErrFrozen, cache.SoftDeleteEntry("2", time.Minute))
+}
+
+func TestSubscribersForEntry(t *testing.T) {
+	cache := New(logger, nil)
+	uid := &common.Selector{Type: "unix", Value: "uid:1111"}
+	gid := &common.Selector{Type: "unix", Value: "gid:2222"}
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: Selectors{uid}, EntryId: "uid"},
+	}))
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: Selectors{uid, gid}, EntryId: "uid-gid"},
+	}))
+
+	uidSub := NewSubscriber(Selectors{uid})
+	gidSub := NewSubscriber(Selectors{gid})
+	uidGidSub := NewSubscriber(Selectors{gid, uid})
+	for _, sub := range []*subscriber{uidSub, gidSub, uidGidSub} {
+		require.NoError(t, cache.Subscribe(sub))
+		defer cache.Unsubscribe(sub)
+	}
+
+	assert.Equal(t, []uint64{uidSub.ID(), uidGidSub.ID()}, cache.SubscribersForEntry("uid"))
+	assert.Equal(t, []uint64{uidGidSub.ID()}, cache.SubscribersForEntry("uid-gid"))
+	assert.Equal(t, []uint64{}, cache.SubscribersForEntry("unknown"))
+
+	uidSub.Finish()
+	assert.Equal(t, []uint64{uidGidSub.ID()}, cache.SubscribersForEntry("uid"))
+}
+
+func TestSPIFFEIDDedup(t *testing.T) {
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	now := time.Now()
+	newEntry := func(id string, notBefore time.Time) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: selectors,
+				SpiffeId:  "spiffe://example.org/foo",
+				EntryId:   id,
+			},
+			SVID: &x509.Certificate{NotBefore: notBefore},
+		}
+	}
+
+	// All the entries are kept by default.
+	cache := New(logger, nil)
+	require.NoError(t, cache.SetEntry(newEntry("1", now)))
+	require.NoError(t, cache.SetEntry(newEntry("2", now.Add(time.Minute))))
+	assert.Len(t, cache.Entries(), 2)
+
+	cache = New(logger, nil, WithSPIFFEIDDedup())
+	require.NoError(t, cache.SetEntry(newEntry("1", now)))
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			Selectors: selectors,
+			SpiffeId:  "spiffe://example.org/bar",
+			EntryId:   "bar",
+		},
+	}))
+	sub := NewSubscriber(selectors)
+	require.NoError(t, cache.Subscribe(sub))
+	defer cache.Unsubscribe(sub)
+	<-sub.Updates()
+
+	// A fresher SVID evicts the older one.
+	require.NoError(t, cache.SetEntry(newEntry("2", now.Add(time.Minute))))
+	wu := <-sub.Updates()
+	assert.Equal(t, []string{"2", "bar"}, entryIDs(wu.Entries))
+
+	// An older SVID is dropped.
+	require.NoError(t, cache.SetEntry(newEntry("1", now.Add(30*time.Second))))
+	assert.Equal(t, 0, len(sub.Updates()))
+	assert.Nil(t, cache.Entry(newEntry("1", now).RegistrationEntry))
+
+	// The entry itself can be replaced.
+	require.NoError(t, cache.SetEntry(newEntry("2", now)))
+	wu = <-sub.Updates()
+	assert.Equal(t, []string{"2", "bar"}, entryIDs(wu.Entries))
+	assert.NoError(t, cache.checkInvariants())
+
+	// Reconcile and Reset keep the freshest SVID of the given entries.
+	result := cache.Reconcile([]*Entry{newEntry("1", now.Add(time.Hour)), newEntry("2", now), newEntry("3", now)})
+	assert.Equal(t, []string{"1"}, result.Added)
+	assert.Equal(t, []string{"2", "bar"}, result.Removed)
+	assert.Equal(t, []string{"1"}, entryIDs(cache.Entries()))
+	cache.Reset([]*Entry{newEntry("1", now), newEntry("3", now), newEntry("2", now.Add(-time.Hour))}, nil)
+	assert.Equal(t, []string{"1"}, entryIDs(cache.Entries()))
+	assert.NoError(t, cache.checkInvariants())
+}
+
+func TestUpdateEpoch(t *testing.T) {
+	cache := New(logger, nil)
+	uid := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	gid := Selectors{&common.Selector{Type: "unix", Value: "gid:2222"}}
+	newEntry := func(id string, selectors Selectors, serial int64) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: id},
+			SVID:              &x509.Certificate{SerialNumber: big.NewInt(serial)},
+		}
+	}
+	require.NoError(t, cache.SetEntry(newEntry("1", uid, 1)))
+	require.NoError(t, cache.SetEntry(newEntry("2", uid, 1)))
+
+	sub := NewSubscriber(uid)
+	require.NoError(t, cache.Subscribe(sub))
+	defer cache.Unsubscribe(sub)
+	epoch := (<-sub.Updates()).Epoch
+
+	// Redeliveries of the same content have the same epoch, even to other
+	// subscribers.
+	require.NoError(t, cache.SetEntry(newEntry("3", gid, 1)))
+	update, snapshotSub, err := cache.SubscribeAndSnapshot(uid)
+	require.NoError(t, err)
+	defer cache.Unsubscribe(snapshotSub)
+	assert.Equal(t, epoch, update.Epoch)
+	require.NoError(t, cache.UpdateSubscription(sub, uid))
+	assert.Equal(t, epoch, (<-sub.Updates()).Epoch)
+
+	// Changed content has a new epoch.
+	require.NoError(t, cache.SetEntry(newEntry("2", uid, 2)))
+	rotated := (<-sub.Updates()).Epoch
+	assert.NotEqual(t, epoch, rotated)
+	cache.SetDegraded(true, "server unreachable")
+	stale := (<-sub.Updates()).Epoch
+	assert.NotEqual(t, rotated, stale)
+
+	// Going back to the same content goes back to the same epoch.
+	cache.SetDegraded(false, "")
+	assert.Equal(t, rotated, (<-sub.Updates()).Epoch)
+}
+
+func TestTrustDomain(t *testing.T) {
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	cache := New(logger, nil, WithTrustDomain("spiffe://example.org"))
+	sub := NewSubscriber(selectors)
+	require.NoError(t, cache.Subscribe(sub))
+	defer cache.Unsubscribe(sub)
+	assert.Equal(t, "spiffe://example.org", (<-sub.Updates()).TrustDomain)
+
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "1"},
+	}))
+	assert.Equal(t, "spiffe://example.org", (<-sub.Updates()).TrustDomain)
+
+	update, snapshotSub, err := cache.SubscribeAndSnapshot(selectors)
+	require.NoError(t, err)
+	defer cache.Unsubscribe(snapshotSub)
+	assert.Equal(t, "spiffe://example.org", update.TrustDomain)
+}
+
+func TestTrustDomainMismatch(t *testing.T) {
+	cache := New(logger, nil, WithTrustDomain("spiffe://example.org"))
+	newEntry := func(uris ...string) *Entry {
+		svid := &x509.Certificate{}
+		for _, uri := range uris {
+			u, err := url.Parse(uri)
+			require.NoError(t, err)
+			svid.URIs = append(svid.URIs, u)
+		}
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}},
+				EntryId:   "1",
+			},
+			SVID: svid,
+		}
+	}
+
+	assert.NoError(t, cache.SetEntry(newEntry("spiffe://example.org/workload")))
+	assert.Equal(t, ErrTrustDomainMismatch, cache.SetEntry(newEntry("spiffe://other.org/workload")))
+	assert.Equal(t, ErrTrustDomainMismatch, cache.SetEntry(newEntry()))
+	assert.Equal(t, ErrTrustDomainMismatch, cache.SetEntry(newEntry("spiffe://example.org/a", "spiffe://example.org/b")))
+	assert.Equal(t, ErrTrustDomainMismatch, cache.SetEntry(newEntry("https://example.org/workload")))
+	assert.Equal(t, "spiffe://example.org/workload", cache.Entry(&common.RegistrationEntry{EntryId: "1"}).SVID.URIs[0].String())
+
+	// Mismatched SVIDs are not cached by Reconcile and Reset either.
+	cache.Reset(nil, nil)
+	result := cache.Reconcile([]*Entry{newEntry("spiffe://evil.org/workload")})
+	assert.Empty(t, result.Added)
+	assert.Nil(t, cache.Entry(&common.RegistrationEntry{EntryId: "1"}))
+	cache.Reset([]*Entry{newEntry("spiffe://evil.org/workload")}, nil)
+	assert.Nil(t, cache.Entry(&common.RegistrationEntry{EntryId: "1"}))
+	cache.Reset([]*Entry{newEntry("spiffe://example.org/workload")}, nil)
+	assert.NotNil(t, cache.Entry(&common.RegistrationEntry{EntryId: "1"}))
+
+	// Without trust domain any SVID is accepted.
+	cache = New(logger, nil)
+	assert.NoError(t, cache.SetEntry(newEntry("spiffe://other.org/workload")))
+	assert.NoError(t, cache.SetEntry(newEntry()))
+}
+
+func TestDeliveryHistory(t *testing.T) {
+	clk := newFakeClock()
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	newEntry := func(i int) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: selectors,
+				SpiffeId:  fmt.Sprintf("spiffe:test_%d", i),
+				EntryId:   "1",
+			},
+			PrivateKey: privateKey,
+		}
+	}
+
+	// Updates are not recorded by default.
+	cache := New(logger, nil)
+	sub := NewSubscriber(selectors)
+	require.NoError(t, cache.Subscribe(sub))
+	defer cache.Unsubscribe(sub)
+	<-sub.Updates()
+	assert.Empty(t, cache.DeliveryHistory(sub))
+
+	cache = New(logger, nil, WithClock(clk), WithDeliveryHistory(3))
+	sub = NewSubscriber(selectors)
+	require.NoError(t, cache.Subscribe(sub))
+	defer cache.Unsubscribe(sub)
+	<-sub.Updates()
+	for i := 0; i < 5; i++ {
+		clk.Add(time.Second)
+		require.NoError(t, cache.SetEntry(newEntry(i)))
+		<-sub.Updates()
+	}
+
+	// The most recent updates are kept, the oldest first.
+	history := cache.DeliveryHistory(sub)
+	require.Len(t, history, 3)
+	for i, view := range history {
+		assert.Equal(t, clk.Now().Add(time.Duration(i-2)*time.Second), view.SentAt)
+		require.Len(t, view.Entries, 1)
+		assert.Equal(t, fmt.Sprintf("spiffe:test_%d", i+2), view.Entries[0].RegistrationEntry.SpiffeId)
+		assert.Nil(t, view.Entries[0].PrivateKey)
+	}
+	assert.Equal(t, privateKey, cache.LastDelivered(sub).Entries[0].PrivateKey)
+}
+
+func TestPauseSubscriber(t *testing.T) {
+	cache := New(logger, nil)
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	newEntry := func(id string) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: id},
+		}
+	}
+	sub := NewSubscriber(selectors)
+	require.NoError(t, cache.Subscribe(sub))
+	defer cache.Unsubscribe(sub)
+	<-sub.Updates()
+
+	// Resuming a subscriber when nothing changed sends nothing.
+	cache.PauseSubscriber(sub)
+	cache.ResumeSubscriber(sub)
+	assert.Equal(t, 0, len(sub.Updates()))
+
+	cache.PauseSubscriber(sub)
+	require.NoError(t, cache.SetEntry(newEntry("1")))
+	require.NoError(t, cache.SetEntry(newEntry("2")))
+	_, err := cache.DeleteEntry(&common.RegistrationEntry{EntryId: "1"})
+	require.NoError(t, err)
+	require.NoError(t, cache.SetEntry(newEntry("3")))
+	assert.Equal(t, 0, len(sub.Updates()))
+	assert.NotNil(t, cache.SubscriberByID(sub.ID()))
+
+	// A single update with the current state is sent on resume.
+	cache.ResumeSubscriber(sub)
+	assert.Equal(t, []string{"2", "3"}, entryIDs((<-sub.Updates()).Entries))
+	assert.Equal(t, 0, len(sub.Updates()))
+	assert.Equal(t, uint64(0), cache.droppedUpdates)
+
+	// Resuming again has no effect.
+	cache.ResumeSubscriber(sub)
+	assert.Equal(t, 0, len(sub.Updates()))
+	require.NoError(t, cache.SetEntry(newEntry("4")))
+	assert.Equal(t, []string{"2", "3", "4"}, entryIDs((<-sub.Updates()).Entries))
+}
+
+func TestUndeliveredEntries(t *testing.T) {
+	cache := New(logger, nil)
+	uid := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	gid := Selectors{&common.Selector{Type: "unix", Value: "gid:2222"}}
+	newEntry := func(id string, selectors Selectors) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: id},
+		}
+	}
+	require.NoError(t, cache.SetEntry(newEntry("uid", uid)))
+	require.NoError(t, cache.SetEntry(newEntry("gid", gid)))
+	assert.Equal(t, []string{"gid", "uid"}, entryIDs(cache.UndeliveredEntries()))
+
+	// Lookups are not deliveries.
+	cache.Entry(newEntry("uid", uid).RegistrationEntry)
+	assert.Equal(t, []string{"gid", "uid"}, entryIDs(cache.UndeliveredEntries()))
+
+	sub := NewSubscriber(uid)
+	require.NoError(t, cache.Subscribe(sub))
+	defer cache.Unsubscribe(sub)
+	<-sub.Updates()
+	assert.Equal(t, []string{"gid"}, entryIDs(cache.UndeliveredEntries()))
+
+	// Entries stay delivered when updated.
+	require.NoError(t, cache.SetEntry(newEntry("uid", uid)))
+	assert.Equal(t, []string{"gid"}, entryIDs(cache.UndeliveredEntries()))
+
+	_, snapshotSub, err := cache.SubscribeAndSnapshot(gid)
+	require.NoError(t, err)
+	defer cache.Unsubscribe(snapshotSub)
+	assert.Empty(t, cache.UndeliveredEntries())
+
+	// Entries set again after being removed were never delivered.
+	cache.Unsubscribe(snapshotSub)
+	_, err = cache.DeleteEntry(newEntry("gid", gid).RegistrationEntry)
+	require.NoError(t, err)
+	cache.Reset([]*Entry{newEntry("uid", uid), newEntry("gid", gid)}, nil)
+	assert.Equal(t, []string{"gid"}, entryIDs(cache.UndeliveredEntries()))
+}
+
+func TestValidate(t *testing.T) {
+	ca, _, err := util.LoadCAFixture()
+	require.NoError(t, err)
+	svid, key, err := util.LoadSVIDFixture()
+	require.NoError(t, err)
+	clk := newFakeClock()
+	clk.Add(svid.NotBefore.Add(time.Minute).Sub(clk.Now()))
+
+	newCache := func() *cacheImpl {
+		cache := New(logger, []*x509.Certificate{ca}, WithClock(clk))
+		require.NoError(t, cache.SetEntry(&Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}},
+				EntryId:   "1",
+			},
+			SVID:       svid,
+			PrivateKey: key,
+		}))
+		require.NoError(t, cache.Subscribe(NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}})))
+		return cache
+	}
+
+	cache := newCache()
+	generation := cache.Generation()
+	assert.NoError(t, cache.Validate())
+	assert.Equal(t, generation, cache.Generation())
+
+	// SVIDs not chaining to the bundle.
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             ca.NotBefore,
+		NotAfter:              ca.NotAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, privateKey.Public(), privateKey)
+	require.NoError(t, err)
+	otherCA, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	require.NoError(t, cache.SetBundle([]*x509.Certificate{otherCA}))
+	err = cache.Validate()
+	if assert.Error(t, err) {
+		assert.Len(t, err, 1)
+		assert.Contains(t, err.Error(), `entry "1" SVID does not chain to the bundle`)
+	}
+
+	// All the problems are reported.
+	cache = newCache()
+	cache.subscribers.selMap["unix:uid:2222"] = []uint64{}
+	clk.Add(time.Hour)
+	err = cache.Validate()
+	if assert.Error(t, err) {
+		assert.Len(t, err, 2)
+		assert.Contains(t, err.Error(), "selector index bucket unix:uid:2222 is empty")
+		assert.Contains(t, err.Error(), `entry "1" SVID expired at`)
+	}
+}
+
+func TestUpdateFields(t *testing.T) {
+	root := &x509.Certificate{Raw: []byte("root")}
+	cache := New(logger, []*x509.Certificate{root})
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "1"},
+	}))
+	cache.SetFederatedBundle("spiffe://a.org", []*x509.Certificate{root})
+
+	all := NewSubscriber(selectors)
+	require.NoError(t, cache.Subscribe(all))
+	defer cache.Unsubscribe(all)
+	wu := <-all.Updates()
+	assert.Len(t, wu.Entries, 1)
+	assert.Equal(t, []*x509.Certificate{root}, wu.Bundle)
+	assert.Len(t, wu.FederatedBundles, 1)
+
+	bundleOnly := NewSubscriber(selectors, WithUpdateFields(WantBundle))
+	require.NoError(t, cache.Subscribe(bundleOnly))
+	defer cache.Unsubscribe(bundleOnly)
+	wu = <-bundleOnly.Updates()
+	assert.Empty(t, wu.Entries)
+	assert.Equal(t, []*x509.Certificate{root}, wu.Bundle)
+	assert.Empty(t, wu.FederatedBundles)
+	bundleOnlyEpoch := wu.Epoch
+
+	bundles := NewSubscriber(selectors, WithUpdateFields(WantBundle|WantFederatedBundles), WithDeltaUpdates())
+	require.NoError(t, cache.Subscribe(bundles))
+	defer cache.Unsubscribe(bundles)
+	<-bundles.Updates()
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "2"},
+	}))
+	wu = <-bundles.Updates()
+	assert.Empty(t, wu.Entries)
+	assert.Empty(t, wu.AddedEntries)
+	assert.Equal(t, []*x509.Certificate{root}, wu.Bundle)
+	assert.Len(t, wu.FederatedBundles, 1)
+
+	// Changes to the fields left out don't change the epoch.
+	wu = <-bundleOnly.Updates()
+	assert.Empty(t, wu.Entries)
+	assert.Equal(t, bundleOnlyEpoch, wu.Epoch)
+
+	// Entries are only delivered to the subscribers wanting them.
+	_, err := cache.DeleteEntry(&common.RegistrationEntry{EntryId: "2"})
+	require.NoError(t, err)
+	cache.Unsubscribe(all)
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "2"},
+	}))
+	assert.Equal(t, []string{"2"}, entryIDs(cache.UndeliveredEntries()))
+}
+
+// deliveredEntry returns a copy of e as delivered with the given bundle
+// version.
+func deliveredEntry(e *Entry, bundleSeq uint64) *Entry {
+	e = copyEntry(e)
+	e.ValidatedBundleSeq = bundleSeq
+	return e
+}
+
+func TestValidatedBundleSeq(t *testing.T) {
+	cache := New(logger, []*x509.Certificate{{Raw: []byte("a")}})
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "1"},
+	}))
+
+	sub := NewSubscriber(selectors)
+	require.NoError(t, cache.Subscribe(sub))
+	defer cache.Unsubscribe(sub)
+	wu := <-sub.Updates()
+	require.Len(t, wu.Entries, 1)
+	first := wu.Entries[0].ValidatedBundleSeq
+
+	require.NoError(t, cache.SetBundle([]*x509.Certificate{{Raw: []byte("b")}}))
+	wu = <-sub.Updates()
+	require.Len(t, wu.Entries, 1)
+	assert.Equal(t, first+1, wu.Entries[0].ValidatedBundleSeq)
+
+	// Changing an entry doesn't change the bundle sequence.
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "2"},
+	}))
+	wu = <-sub.Updates()
+	require.Len(t, wu.Entries, 2)
+	for _, e := range wu.Entries {
+		assert.Equal(t, first+1, e.ValidatedBundleSeq)
+	}
+	assert.Zero(t, cache.Entry(&common.RegistrationEntry{EntryId: "1"}).ValidatedBundleSeq)
+}
+
+func TestSubscriberChannelDepth(t *testing.T) {
+	cache := New(logger, nil)
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	sub := NewSubscriber(selectors)
+	assert.Equal(t, 0, cache.SubscriberChannelDepth(sub))
+
+	require.NoError(t, cache.Subscribe(sub))
+	defer cache.Unsubscribe(sub)
+	assert.Equal(t, 1, cache.SubscriberChannelDepth(sub))
+
+	// Unread updates are replaced, so the depth doesn't grow.
+	require.NoError(t, cache.SetBundle([]*x509.Certificate{{Raw: []byte("a")}}))
+	assert.Equal(t, 1, cache.SubscriberChannelDepth(sub))
+
+	<-sub.Updates()
+	assert.Equal(t, 0, cache.SubscriberChannelDepth(sub))
+}
+
+func TestSubscribeSelectors(t *testing.T) {
+	cache := New(logger, nil, WithMaxSelectors(1))
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "1"},
+	}))
+
+	sub, err := cache.SubscribeSelectors(selectors, WithDeltaUpdates())
+	require.NoError(t, err)
+	defer cache.Unsubscribe(sub)
+	assert.Equal(t, sub, cache.SubscriberByID(sub.ID()))
+	wu := <-sub.Updates()
+	assert.Equal(t, []string{"1"}, entryIDs(wu.Entries))
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "2"},
+	}))
+	wu = <-sub.Updates()
+	assert.True(t, wu.Delta)
+	assert.Equal(t, []string{"2"}, entryIDs(wu.AddedEntries))
+
+	for _, invalid := range []Selectors{
+		{nil},
+		{&common.Selector{Value: "uid:1111"}},
+		{&common.Selector{Type: "unix"}},
+	} {
+		sub, err := cache.SubscribeSelectors(invalid)
+		assert.Equal(t, &InvalidSelectorError{Selector: invalid[0]}, err)
+		assert.Nil(t, sub)
+	}
+
+	sub, err = cache.SubscribeSelectors(append(selectors, &common.Selector{Type: "unix", Value: "gid:1111"}))
+	assert.Equal(t, ErrTooManySelectors, err)
+	assert.Nil(t, sub)
+	assert.Equal(t, 1, cache.subscribers.count())
+}
+
+func TestSubscribeSPIFFEID(t *testing.T) {
+	cache := New(logger, nil)
+	newEntry := func(id, spiffeID string, serial int64) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: Selectors{&common.Selector{Type: "unix", Value: "uid:" + id}},
+				SpiffeId:  spiffeID,
+				EntryId:   id,
+			},
+			SVID: &x509.Certificate{SerialNumber: big.NewInt(serial)},
+		}
+	}
+	require.NoError(t, cache.SetEntry(newEntry("1", "spiffe://example.org/a", 1)))
+	require.NoError(t, cache.SetEntry(newEntry("2", "spiffe://example.org/b", 1)))
+
+	sub := cache.SubscribeSPIFFEID("spiffe://example.org/a")
+	defer cache.Unsubscribe(sub)
+	assert.Equal(t, []string{"1"}, entryIDs((<-sub.Updates()).Entries))
+
+	// Entries are matched by SPIFFE ID regardless of their selectors.
+	require.NoError(t, cache.SetEntry(newEntry("3", "spiffe://example.org/a", 1)))
+	assert.Equal(t, []string{"1", "3"}, entryIDs((<-sub.Updates()).Entries))
+
+	// Rotating an SVID notifies the subscriber.
+	require.NoError(t, cache.SetEntry(newEntry("1", "spiffe://example.org/a", 2)))
+	wu := <-sub.Updates()
+	require.Len(t, wu.Entries, 2)
+	assert.Equal(t, big.NewInt(2), wu.Entries[0].SVID.SerialNumber)
+
+	// Entries with other SPIFFE IDs don't wake the subscriber.
+	require.NoError(t, cache.SetEntry(newEntry("2", "spiffe://example.org/b", 2)))
+	require.NoError(t, cache.SetEntry(newEntry("4", "spiffe://example.org/c", 1)))
+	_, err := cache.DeleteEntry(&common.RegistrationEntry{EntryId: "4"})
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(sub.Updates()))
+
+	deleted, err := cache.DeleteEntry(&common.RegistrationEntry{EntryId: "3"})
+	require.NoError(t, err)
+	require.True(t, deleted)
+	assert.Equal(t, []string{"1"}, entryIDs((<-sub.Updates()).Entries))
+
+	// An entry moving to another SPIFFE ID is removed from the updates.
+	require.NoError(t, cache.SetEntry(newEntry("1", "spiffe://example.org/b", 2)))
+	assert.Empty(t, (<-sub.Updates()).Entries)
+	assert.Equal(t, 0, len(sub.Updates()))
+
+	// Selector subscribers are unaffected by SPIFFE ID subscribers.
+	selSub := NewSubscriber(Selectors{&common.Selector{Type: "unix", Value: "uid:2"}})
+	require.NoError(t, cache.Subscribe(selSub))
+	defer cache.Unsubscribe(selSub)
+	assert.Equal(t, []string{"2"}, entryIDs((<-selSub.Updates()).Entries))
+	assert.NoError(t, cache.subscribers.checkInvariants())
+}
+
+func TestEntryRotationCount(t *testing.T) {
+	cache := New(logger, nil)
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	newEntry := func(serial int64) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "1"},
+			SVID:              &x509.Certificate{SerialNumber: big.NewInt(serial)},
+		}
+	}
+
+	require.NoError(t, cache.SetEntry(newEntry(1)))
+	assert.Equal(t, uint64(0), cache.EntryRotationCount("1"))
+
+	// Setting the same SVID again isn't a rotation.
+	require.NoError(t, cache.SetEntry(newEntry(1)))
+	assert.Equal(t, uint64(0), cache.EntryRotationCount("1"))
+
+	require.NoError(t, cache.SetEntry(newEntry(2)))
+	require.NoError(t, cache.SetEntry(newEntry(3)))
+	assert.Equal(t, uint64(2), cache.EntryRotationCount("1"))
+
+	cache.Reset([]*Entry{newEntry(3)}, nil)
+	assert.Equal(t, uint64(2), cache.EntryRotationCount("1"))
+	cache.Reset([]*Entry{newEntry(4)}, nil)
+	assert.Equal(t, uint64(3), cache.EntryRotationCount("1"))
+
+	// Deleted entries start over.
+	_, err := cache.DeleteEntry(&common.RegistrationEntry{EntryId: "1"})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), cache.EntryRotationCount("1"))
+	require.NoError(t, cache.SetEntry(newEntry(5)))
+	assert.Equal(t, uint64(0), cache.EntryRotationCount("1"))
+	assert.Equal(t, uint64(0), cache.EntryRotationCount("unknown"))
+}
+
+func TestLastGoodBundle(t *testing.T) {
+	root := &x509.Certificate{Raw: []byte("root")}
+	cache := New(logger, []*x509.Certificate{root})
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+
+	explicit := NewSubscriber(selectors)
+	require.NoError(t, cache.Subscribe(explicit))
+	defer cache.Unsubscribe(explicit)
+	kept := NewSubscriber(selectors, WithLastGoodBundle())
+	require.NoError(t, cache.Subscribe(kept))
+	defer cache.Unsubscribe(kept)
+	assert.Equal(t, []*x509.Certificate{root}, (<-explicit.Updates()).Bundle)
+	wu := <-kept.Updates()
+	assert.Equal(t, []*x509.Certificate{root}, wu.Bundle)
+	epoch := wu.Epoch
+
+	// The epoch covers the kept bundle.
+	require.NoError(t, cache.SetBundle(nil))
+	assert.Empty(t, (<-explicit.Updates()).Bundle)
+	wu = <-kept.Updates()
+	assert.Equal(t, []*x509.Certificate{root}, wu.Bundle)
+	assert.Equal(t, epoch, wu.Epoch)
+
+	newRoot := &x509.Certificate{Raw: []byte("new root")}
+	require.NoError(t, cache.SetBundle([]*x509.Certificate{newRoot}))
+	assert.Equal(t, []*x509.Certificate{newRoot}, (<-explicit.Updates()).Bundle)
+	assert.Equal(t, []*x509.Certificate{newRoot}, (<-kept.Updates()).Bundle)
+
+	// Subscribers that were never sent a bundle get the empty one.
+	require.NoError(t, cache.SetBundle(nil))
+	empty := NewSubscriber(selectors, WithLastGoodBundle())
+	require.NoError(t, cache.Subscribe(empty))
+	defer cache.Unsubscribe(empty)
+	assert.Empty(t, (<-empty.Updates()).Bundle)
+	assert.Equal(t, []*x509.Certificate{newRoot}, (<-kept.Updates()).Bundle)
+}
+
+func TestEstimatedSizeBytes(t *testing.T) {
+	cache := New(logger, nil)
+	assert.Equal(t, int64(0), cache.EstimatedSizeBytes())
+
+	root := &x509.Certificate{Raw: []byte("root")}
+	require.NoError(t, cache.SetBundle([]*x509.Certificate{root}))
+	bundleSize := cache.EstimatedSizeBytes()
+	assert.Equal(t, int64(len(root.Raw)), bundleSize)
+
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	newEntry := func(id string) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: selectors,
+				EntryId:   id,
+				SpiffeId:  "spiffe://example.org/" + id,
+			},
+			SVID:       &x509.Certificate{Raw: make([]byte, 100)},
+			PrivateKey: privateKey,
+		}
+	}
+	require.NoError(t, cache.SetEntry(newEntry("1")))
+	oneEntrySize := cache.EstimatedSizeBytes()
+	assert.True(t, oneEntrySize > bundleSize+100)
+
+	require.NoError(t, cache.SetEntry(newEntry("2")))
+	twoEntriesSize := cache.EstimatedSizeBytes()
+	assert.Equal(t, 2*oneEntrySize-bundleSize, twoEntriesSize)
+
+	_, err := cache.DeleteEntry(&common.RegistrationEntry{EntryId: "2"})
+	require.NoError(t, err)
+	assert.Equal(t, oneEntrySize, cache.EstimatedSizeBytes())
+}
+
+func TestValidFrom(t *testing.T) {
+	clk := newFakeClock()
+	cache := New(logger, nil, WithClock(clk))
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	now := clk.Now()
+	future := now.Add(time.Hour)
+	for id, notBefore := range map[string]time.Time{"current": now, "future": future} {
+		require.NoError(t, cache.SetEntry(&Entry{
+			RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: id},
+			SVID:              &x509.Certificate{NotBefore: notBefore, NotAfter: notBefore.Add(time.Hour)},
+		}))
+	}
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "none"},
+	}))
+
+	sub := NewSubscriber(selectors)
+	require.NoError(t, cache.Subscribe(sub))
+	defer cache.Unsubscribe(sub)
+	wu := <-sub.Updates()
+	require.Len(t, wu.Entries, 3)
+	validFrom := make(map[string]time.Time)
+	for _, e := range wu.Entries {
+		validFrom[e.RegistrationEntry.EntryId] = e.ValidFrom
+	}
+	assert.Equal(t, now, validFrom["current"])
+	assert.Equal(t, future, validFrom["future"])
+	assert.True(t, validFrom["none"].IsZero())
+}
+
+func TestHasher(t *testing.T) {
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	entry := &Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "1"},
+		SVID:              &x509.Certificate{SerialNumber: big.NewInt(1)},
+	}
+	epochs := func(cache *cacheImpl) (uint64, uint64) {
+		require.NoError(t, cache.SetEntry(entry))
+		update, sub, err := cache.SubscribeAndSnapshot(selectors)
+		require.NoError(t, err)
+		defer cache.Unsubscribe(sub)
+		snapshot, sub, err := cache.SubscribeAndSnapshot(selectors)
+		require.NoError(t, err)
+		defer cache.Unsubscribe(sub)
+		return update.Epoch, snapshot.Epoch
+	}
+
+	// The default hasher hashes the same content consistently.
+	first, second := epochs(New(logger, nil))
+	assert.Equal(t, first, second)
+	other, _ := epochs(New(logger, nil))
+	assert.Equal(t, first, other)
+
+	var hashes int
+	custom := HasherFunc(func() hash.Hash64 {
+		hashes++
+		return crc64.New(crc64.MakeTable(crc64.ISO))
+	})
+	first, second = epochs(New(logger, nil, WithHasher(custom)))
+	assert.Equal(t, first, second)
+	assert.NotEqual(t, other, first)
+	assert.Equal(t, 2, hashes)
+}
+
+func TestFederatedTrustDomains(t *testing.T) {
+	cache := New(logger, nil, WithTrustDomain("spiffe://example.org"))
+	assert.Empty(t, cache.FederatedTrustDomains())
+
+	root := &x509.Certificate{Raw: []byte("root")}
+	cache.SetFederatedBundle("spiffe://b.org", []*x509.Certificate{root})
+	cache.SetFederatedBundle("spiffe://a.org", []*x509.Certificate{root})
+	cache.SetFederatedBundle("spiffe://example.org", []*x509.Certificate{root})
+	assert.Equal(t, []string{"spiffe://a.org", "spiffe://b.org"}, cache.FederatedTrustDomains())
+
+	cache.SetFederatedBundle("spiffe://b.org", nil)
+	assert.Equal(t, []string{"spiffe://a.org"}, cache.FederatedTrustDomains())
+}
+
+func TestStreamTo(t *testing.T) {
+	cache := New(logger, nil)
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	sub := NewSubscriber(selectors)
+	require.NoError(t, cache.Subscribe(sub))
+
+	sent := make(chan *WorkloadUpdate)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- cache.StreamTo(ctx, sub, func(update *WorkloadUpdate) error {
+			sent <- update
+			return nil
+		})
+	}()
+
+	util.RunWithTimeout(t, 5*time.Second, func() {
+		assert.Empty(t, (<-sent).Entries)
+		require.NoError(t, cache.SetEntry(&Entry{
+			RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "1"},
+		}))
+		assert.Equal(t, []string{"1"}, entryIDs((<-sent).Entries))
+
+		cancel()
+		assert.Equal(t, context.Canceled, <-done)
+	})
+	assert.Nil(t, cache.SubscriberByID(sub.ID()))
+	_, ok := <-sub.Updates()
+	assert.False(t, ok)
+
+	// Send errors are returned after unsubscribing.
+	sub = NewSubscriber(selectors)
+	require.NoError(t, cache.Subscribe(sub))
+	sendErr := errors.New("stream closed")
+	err := cache.StreamTo(context.Background(), sub, func(*WorkloadUpdate) error {
+		return sendErr
+	})
+	assert.Equal(t, sendErr, err)
+	assert.Nil(t, cache.SubscriberByID(sub.ID()))
+
+	// Finishing the subscriber ends the stream.
+	sub = NewSubscriber(selectors)
+	require.NoError(t, cache.Subscribe(sub))
+	<-sub.Updates()
+	sub.Finish()
+	assert.NoError(t, cache.StreamTo(context.Background(), sub, func(*WorkloadUpdate) error {
+		return nil
+	}))
+}
+
+func TestSetEntryInvalidSelector(t *testing.T) {
+	cache := New(logger, nil)
+	valid := &common.Selector{Type: "unix", Value: "uid:1111"}
+	for _, tt := range []struct {
+		selector *common.Selector
+		err      string
+	}{
+		{selector: nil, err: "invalid nil selector"},
+		{selector: &common.Selector{Type: "unix"}, err: `invalid selector "unix:"`},
+		{selector: &common.Selector{Value: "uid:1111"}, err: `invalid selector ":uid:1111"`},
+	} {
+		err := cache.SetEntry(&Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: Selectors{valid, tt.selector},
+				EntryId:   "1",
+			},
+		})
+		require.IsType(t, &InvalidSelectorError{}, err)
+		assert.Equal(t, tt.selector, err.(*InvalidSelectorError).Selector)
+		assert.EqualError(t, err, tt.err)
+		assert.Nil(t, cache.Entry(&common.RegistrationEntry{EntryId: "1"}))
+	}
+}
+
+func TestSweepExpired(t *testing.T) {
+	clk := newFakeClock()
+	cache := New(logger, nil, WithClock(clk))
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	newEntry := func(id string, ttl time.Duration) *Entry {
+		entry := &Entry{
+			RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: id},
+		}
+		if ttl > 0 {
+			entry.SVID = &x509.Certificate{NotBefore: clk.Now(), NotAfter: clk.Now().Add(ttl)}
+		}
+		return entry
+	}
+	require.NoError(t, cache.SetEntry(newEntry("1", time.Minute)))
+	require.NoError(t, cache.SetEntry(newEntry("2", 2*time.Minute)))
+	require.NoError(t, cache.SetEntry(newEntry("3", time.Hour)))
+	require.NoError(t, cache.SetEntry(newEntry("4", 0)))
+
+	sub := NewSubscriber(selectors)
+	require.NoError(t, cache.Subscribe(sub))
+	defer cache.Unsubscribe(sub)
+	<-sub.Updates()
+
+	assert.Equal(t, 0, cache.SweepExpired())
+	assert.Len(t, sub.Updates(), 0)
+
+	clk.Add(5 * time.Minute)
+	assert.Equal(t, 2, cache.SweepExpired())
+	assert.Equal(t, []string{"3", "4"}, entryIDs(cache.Entries()))
+	assert.Equal(t, []string{"3", "4"}, entryIDs((<-sub.Updates()).Entries))
+	assert.Len(t, sub.Updates(), 0)
+	assert.NoError(t, cache.checkInvariants())
+
+	cache.Freeze()
+	clk.Add(2 * time.Hour)
+	assert.Equal(t, 0, cache.SweepExpired())
+	cache.Unfreeze()
+	assert.Equal(t, 1, cache.SweepExpired())
+	assert.Equal(t, []string{"4"}, entryIDs(cache.Entries()))
+}
+
+func TestRefreshHints(t *testing.T) {
+	cache := New(logger, nil)
+	now := time.Now().Truncate(time.Second)
+	cache.SetFederatedBundle("spiffe://a.org", []*x509.Certificate{
+		{Raw: []byte("a1"), NotAfter: now.Add(2 * time.Hour)},
+		{Raw: []byte("a2"), NotAfter: now.Add(time.Hour)},
+	})
+	cache.SetFederatedBundle("spiffe://b.org", []*x509.Certificate{
+		{Raw: []byte("b"), NotAfter: now.Add(3 * time.Hour)},
+	})
+	cache.SetFederatedBundle("spiffe://c.org", []*x509.Certificate{
+		{Raw: []byte("c"), NotAfter: now.Add(4 * time.Hour)},
+	})
+
+	uid := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	gid := Selectors{&common.Selector{Type: "unix", Value: "gid:2222"}}
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: uid, EntryId: "1"},
+		FederatesWith:     []string{"spiffe://a.org", "spiffe://unknown.org"},
+	}))
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: uid, EntryId: "2"},
+		FederatesWith:     []string{"spiffe://a.org", "spiffe://b.org"},
+	}))
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: gid, EntryId: "3"},
+		FederatesWith:     []string{"spiffe://c.org"},
+	}))
+
+	sub := NewSubscriber(uid)
+	require.NoError(t, cache.Subscribe(sub))
+	defer cache.Unsubscribe(sub)
+	assert.Equal(t, map[string]time.Time{
+		"spiffe://a.org": now.Add(time.Hour),
+		"spiffe://b.org": now.Add(3 * time.Hour),
+	}, (<-sub.Updates()).RefreshHints)
+
+	cache.SetFederatedBundle("spiffe://a.org", nil)
+	assert.Equal(t, map[string]time.Time{
+		"spiffe://b.org": now.Add(3 * time.Hour),
+	}, (<-sub.Updates()).RefreshHints)
+
+	bundleOnly := NewSubscriber(uid, WithUpdateFields(WantBundle))
+	require.NoError(t, cache.Subscribe(bundleOnly))
+	defer cache.Unsubscribe(bundleOnly)
+	assert.Nil(t, (<-bundleOnly.Updates()).RefreshHints)
+}
+
+func TestBundleMetadata(t *testing.T) {
+	cache := New(logger, nil)
+	assert.Nil(t, cache.BundleMetadata())
+
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	sub := NewSubscriber(selectors)
+	require.NoError(t, cache.Subscribe(sub))
+	defer cache.Unsubscribe(sub)
+	assert.Nil(t, (<-sub.Updates()).BundleMetadata)
+
+	metadata := map[string]string{"sequence": "1"}
+	cache.SetBundleMetadata(metadata)
+	metadata["sequence"] = "modified"
+	assert.Equal(t, map[string]string{"sequence": "1"}, cache.BundleMetadata())
+	wu := <-sub.Updates()
+	assert.Equal(t, map[string]string{"sequence": "1"}, wu.BundleMetadata)
+	epoch := wu.Epoch
+
+	// Setting the same metadata doesn't notify the subscribers.
+	cache.SetBundleMetadata(map[string]string{"sequence": "1"})
+	assert.Len(t, sub.Updates(), 0)
+
+	cache.SetBundleMetadata(map[string]string{"sequence": "2", "refresh_interval": "5m"})
+	assert.Equal(t, map[string]string{"sequence": "2", "refresh_interval": "5m"}, cache.BundleMetadata())
+	wu = <-sub.Updates()
+	assert.Equal(t, map[string]string{"sequence": "2", "refresh_interval": "5m"}, wu.BundleMetadata)
+	assert.NotEqual(t, epoch, wu.Epoch)
+
+	cache.SetBundleMetadata(nil)
+	assert.Nil(t, cache.BundleMetadata())
+	assert.Nil(t, (<-sub.Updates()).BundleMetadata)
+}
+
+func TestReconcile(t *testing.T) {
+	cache := New(logger, nil)
+	uid := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	gid := Selectors{&common.Selector{Type: "unix", Value: "gid:2222"}}
+	other := Selectors{&common.Selector{Type: "unix", Value: "uid:3333"}}
+	newEntry := func(id string, selectors Selectors, serial int64) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: id},
+			SVID:              &x509.Certificate{SerialNumber: big.NewInt(serial)},
+		}
+	}
+	require.NoError(t, cache.SetEntry(newEntry("1", uid, 1)))
+	require.NoError(t, cache.SetEntry(newEntry("2", uid, 1)))
+	require.NoError(t, cache.SetEntry(newEntry("3", gid, 1)))
+	require.NoError(t, cache.SetEntry(newEntry("4", other, 1)))
+
+	subscribe := func(selectors Selectors) *subscriber {
+		sub := NewSubscriber(selectors)
+		require.NoError(t, cache.Subscribe(sub))
+		<-sub.Updates()
+		return sub
+	}
+	uidSub, gidSub, otherSub := subscribe(uid), subscribe(gid), subscribe(other)
+	defer cache.Unsubscribe(uidSub)
+	defer cache.Unsubscribe(gidSub)
+	defer cache.Unsubscribe(otherSub)
+
+	authoritative := []*Entry{
+		newEntry("1", uid, 1),
+		newEntry("2", uid, 2),
+		newEntry("4", other, 1),
+		newEntry("5", uid, 1),
+		{},
+	}
+	result := cache.Reconcile(authoritative)
+	assert.Equal(t, ReconcileResult{
+		Added:     []string{"5"},
+		Updated:   []string{"2"},
+		Removed:   []string{"3"},
+		Unchanged: []string{"1", "4"},
+	}, result)
+	assert.Equal(t, []string{"1", "2", "4", "5"}, entryIDs(cache.Entries()))
+	assert.Equal(t, uint64(1), cache.EntryRotationCount("2"))
+	assert.NoError(t, cache.checkInvariants())
+
+	assert.Equal(t, []string{"1", "2", "5"}, entryIDs((<-uidSub.Updates()).Entries))
+	assert.Empty(t, (<-gidSub.Updates()).Entries)
+	assert.Len(t, uidSub.Updates(), 0)
+	assert.Len(t, otherSub.Updates(), 0)
+
+	// Reconciling the same entries again changes nothing.
+	result = cache.Reconcile(authoritative)
+	assert.Equal(t, ReconcileResult{Unchanged: []string{"1", "2", "4", "5"}}, result)
+	assert.Len(t, uidSub.Updates(), 0)
+	assert.Len(t, gidSub.Updates(), 0)
+	assert.Len(t, otherSub.Updates(), 0)
+
+	cache.Freeze()
+	assert.Equal(t, ReconcileResult{}, cache.Reconcile(nil))
+	cache.Unfreeze()
+	assert.Equal(t, ReconcileResult{Removed: []string{"1", "2", "4", "5"}}, cache.Reconcile(nil))
+	assert.True(t, cache.IsEmpty())
+}
+
+func TestSubscribeDynamic(t *testing.T) {
+	cache := New(logger, nil, WithMaxSelectors(1))
+	uid := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	gid := Selectors{&common.Selector{Type: "unix", Value: "gid:2222"}}
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: uid, EntryId: "1"},
+	}))
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: gid, EntryId: "2"},
+	}))
+
+	selCh := make(chan Selectors)
+	sub := cache.SubscribeDynamic(context.Background(), selCh)
+	assert.Len(t, sub.Updates(), 0)
+
+	util.RunWithTimeout(t, 5*time.Second, func() {
+		selCh <- uid
+		assert.Equal(t, []string{"1"}, entryIDs((<-sub.Updates()).Entries))
+		selCh <- gid
+		assert.Equal(t, []string{"2"}, entryIDs((<-sub.Updates()).Entries))
+
+		// Invalid selectors are ignored.
+		selCh <- append(uid, gid...)
+		selCh <- uid
+		assert.Equal(t, []string{"1"}, entryIDs((<-sub.Updates()).Entries))
+
+		close(selCh)
+		for cache.SubscriberByID(sub.ID()) != nil {
+			runtime.Gosched()
+		}
+	})
+	_, ok := <-sub.Updates()
+	assert.False(t, ok)
+
+	// Canceling the context unsubscribes too.
+	ctx, cancel := context.WithCancel(context.Background())
+	sub = cache.SubscribeDynamic(ctx, make(chan Selectors))
+	cancel()
+	util.RunWithTimeout(t, 5*time.Second, func() {
+		for cache.SubscriberByID(sub.ID()) != nil {
+			runtime.Gosched()
+		}
+	})
+}
+
+func TestDeliveryKeyCheck(t *testing.T) {
+	svid, key, err := util.LoadSVIDFixture()
+	require.NoError(t, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	entries := []*Entry{
+		{
+			RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "valid"},
+			SVID:              svid,
+			PrivateKey:        key,
+		},
+		{
+			RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "corrupt"},
+			SVID:              svid,
+			PrivateKey:        otherKey,
+		},
+		{
+			RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "no-key"},
+			SVID:              svid,
+		},
+	}
+
+	for _, tt := range []struct {
+		opts     []Option
+		expected []string
+		warnings int
+	}{
+		{expected: []string{"corrupt", "no-key", "valid"}},
+		{opts: []Option{WithDeliveryKeyCheck()}, expected: []string{"no-key", "valid"}, warnings: 1},
+	} {
+		log, hook := testlog.NewNullLogger()
+		cache := New(log, nil, tt.opts...)
+		for _, entry := range entries {
+			require.NoError(t, cache.SetEntry(entry))
+		}
+		sub := NewSubscriber(selectors)
+		require.NoError(t, cache.Subscribe(sub))
+		assert.Equal(t, tt.expected, entryIDs((<-sub.Updates()).Entries))
+		update, snapshotSub, err := cache.SubscribeAndSnapshot(selectors)
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, entryIDs(update.Entries))
+		cache.Unsubscribe(sub)
+		cache.Unsubscribe(snapshotSub)
+
+		// The corrupt entry is logged when stored, not on every delivery.
+		warnings := 0
+		for _, entry := range hook.AllEntries() {
+			if entry.Level == logrus.WarnLevel {
+				warnings++
+			}
+		}
+		assert.Equal(t, tt.warnings, warnings)
+	}
+}
+
+func TestEntryTimes(t *testing.T) {
+	clk := newFakeClock()
+	cache := New(logger, nil, WithClock(clk))
+	_, ok := cache.OldestEntryTime()
+	assert.False(t, ok)
+	_, ok = cache.NewestEntryTime()
+	assert.False(t, ok)
+
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	newEntry := func(id string) *Entry {
+		return &Entry{RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: id}}
+	}
+	start := clk.Now()
+	require.NoError(t, cache.SetEntry(newEntry("1")))
+	clk.Add(time.Minute)
+	require.NoError(t, cache.SetEntry(newEntry("2")))
+	clk.Add(time.Minute)
+	require.NoError(t, cache.SetEntry(newEntry("3")))
+	assertTimes := func(oldest, newest time.Time) {
+		actual, ok := cache.OldestEntryTime()
+		assert.True(t, ok)
+		assert.Equal(t, oldest, actual)
+		actual, ok = cache.NewestEntryTime()
+		assert.True(t, ok)
+		assert.Equal(t, newest, actual)
+	}
+	assertTimes(start, start.Add(2*time.Minute))
+
+	// Replacing an entry keeps its insertion time.
+	clk.Add(time.Minute)
+	require.NoError(t, cache.SetEntry(newEntry("1")))
+	assertTimes(start, start.Add(2*time.Minute))
+
+	_, err := cache.DeleteEntry(newEntry("1").RegistrationEntry)
+	require.NoError(t, err)
+	assertTimes(start.Add(time.Minute), start.Add(2*time.Minute))
+
+	cache.Reset([]*Entry{newEntry("3"), newEntry("4")}, nil)
+	assertTimes(start.Add(2*time.Minute), start.Add(3*time.Minute))
+
+	cache.Reset(nil, nil)
+	_, ok = cache.OldestEntryTime()
+	assert.False(t, ok)
+}
+
+func TestFingerprint(t *testing.T) {
+	selectors := Selectors{
+		&common.Selector{Type: "unix", Value: "uid:1111"},
+		&common.Selector{Type: "unix", Value: "gid:2222"},
+	}
+	newEntry := func(id string, serial int64) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: id},
+			SVID:              &x509.Certificate{SerialNumber: big.NewInt(serial)},
+		}
+	}
+	root1 := &x509.Certificate{Raw: []byte("root1")}
+	root2 := &x509.Certificate{Raw: []byte("root2")}
+
+	cache1 := New(logger, []*x509.Certificate{root1, root2})
+	require.NoError(t, cache1.SetEntry(newEntry("1", 1)))
+	require.NoError(t, cache1.SetEntry(newEntry("2", 1)))
+
+	cache2 := New(logger, []*x509.Certificate{root2, root1})
+	reversed := newEntry("1", 1)
+	reversed.RegistrationEntry.Selectors = Selectors{selectors[1], selectors[0]}
+	require.NoError(t, cache2.SetEntry(newEntry("2", 1)))
+	require.NoError(t, cache2.SetEntry(reversed))
+	fingerprint := cache1.Fingerprint()
+	assert.Equal(t, fingerprint, cache2.Fingerprint())
+	assert.Equal(t, fingerprint, cache1.Fingerprint())
+
+	require.NoError(t, cache2.SetEntry(newEntry("2", 2)))
+	rotated := cache2.Fingerprint()
+	assert.NotEqual(t, fingerprint, rotated)
+	require.NoError(t, cache2.SetBundle([]*x509.Certificate{root1}))
+	assert.NotEqual(t, rotated, cache2.Fingerprint())
+	_, err := cache1.DeleteEntry(newEntry("2", 1).RegistrationEntry)
+	require.NoError(t, err)
+	assert.NotEqual(t, fingerprint, cache1.Fingerprint())
+}
+
+func TestMaxSVIDAge(t *testing.T) {
+	clk := newFakeClock()
+	cache := New(logger, nil, WithClock(clk))
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	newEntry := func(id string, issued time.Time) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: id},
+			SVID:              &x509.Certificate{NotBefore: issued, NotAfter: issued.Add(24 * time.Hour)},
+		}
+	}
+	require.NoError(t, cache.SetEntry(newEntry("old", clk.Now().Add(-2*time.Hour))))
+	require.NoError(t, cache.SetEntry(newEntry("recent", clk.Now().Add(-time.Minute))))
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "no-svid"},
+	}))
+
+	normal := NewSubscriber(selectors)
+	require.NoError(t, cache.Subscribe(normal))
+	defer cache.Unsubscribe(normal)
+	constrained := NewSubscriber(selectors, WithMaxSVIDAge(time.Hour))
+	require.NoError(t, cache.Subscribe(constrained))
+	defer cache.Unsubscribe(constrained)
+	assert.Equal(t, []string{"no-svid", "old", "recent"}, entryIDs((<-normal.Updates()).Entries))
+	assert.Equal(t, []string{"no-svid", "recent"}, entryIDs((<-constrained.Updates()).Entries))
+
+	// SVIDs age out with the clock, and rotated SVIDs are delivered again.
+	clk.Add(time.Hour)
+	require.NoError(t, cache.SetEntry(newEntry("old", clk.Now())))
+	assert.Equal(t, []string{"no-svid", "old", "recent"}, entryIDs((<-normal.Updates()).Entries))
+	assert.Equal(t, []string{"no-svid", "old"}, entryIDs((<-constrained.Updates()).Entries))
+}
+
+func TestEntriesBySPIFFEIDMap(t *testing.T) {
+	cache := New(logger, nil)
+	assert.Empty(t, cache.EntriesBySPIFFEIDMap())
+
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	for id, spiffeID := range map[string]string{
+		"1": "spiffe://example.org/a",
+		"2": "spiffe://example.org/b",
+		"3": "spiffe://example.org/a",
+	} {
+		require.NoError(t, cache.SetEntry(&Entry{
+			RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: id, SpiffeId: spiffeID},
+		}))
+	}
+
+	groups := cache.EntriesBySPIFFEIDMap()
+	require.Len(t, groups, 2)
+	assert.Equal(t, []string{"1", "3"}, entryIDs(groups["spiffe://example.org/a"]))
+	assert.Equal(t, []string{"2"}, entryIDs(groups["spiffe://example.org/b"]))
+
+	// The returned entries are copies.
+	groups["spiffe://example.org/b"][0].RegistrationEntry.SpiffeId = "spiffe://example.org/c"
+	assert.Equal(t, "spiffe://example.org/b", cache.Entry(&common.RegistrationEntry{EntryId: "2"}).RegistrationEntry.SpiffeId)
 }
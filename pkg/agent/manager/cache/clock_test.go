@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// fakeClock is a Clock whose time only moves forward when Add is called.
+type fakeClock struct {
+	m      sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clk     *fakeClock
+	at      time.Time
+	f       func()
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.m.Lock()
+	defer c.m.Unlock()
+	t := &fakeTimer{clk: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Add advances the clock by d, running the functions of the timers that
+// expire in the meantime.
+func (c *fakeClock) Add(d time.Duration) {
+	c.m.Lock()
+	c.now = c.now.Add(d)
+	c.m.Unlock()
+
+	for {
+		c.m.Lock()
+		var due, rest []*fakeTimer
+		for _, t := range c.timers {
+			switch {
+			case t.stopped:
+			case t.at.After(c.now):
+				rest = append(rest, t)
+			default:
+				due = append(due, t)
+			}
+		}
+		c.timers = rest
+		c.m.Unlock()
+
+		if len(due) == 0 {
+			return
+		}
+		sort.SliceStable(due, func(i, j int) bool { return due[i].at.Before(due[j].at) })
+		for _, t := range due {
+			t.f()
+		}
+	}
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clk.m.Lock()
+	defer t.clk.m.Unlock()
+	wasActive := !t.stopped
+	t.stopped = true
+	return wasActive
+}
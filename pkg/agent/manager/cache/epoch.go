@@ -0,0 +1,188 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"hash"
+	"hash/fnv"
+	"math"
+	"sort"
+)
+
+// Hasher creates the hashes the cache content is hashed with to detect
+// changes, like the update epochs.
+type Hasher interface {
+	New64() hash.Hash64
+}
+
+// HasherFunc is a function used as a Hasher.
+type HasherFunc func() hash.Hash64
+
+// New64 calls f.
+func (f HasherFunc) New64() hash.Hash64 {
+	return f()
+}
+
+// fnvHasher is the default hasher, creating 64-bit FNV-1a hashes.
+var fnvHasher = HasherFunc(fnv.New64a)
+
+// updateEpoch returns a hash of the content of the update, so updates with the
+// same content have the same epoch regardless of the order of the entries.
+// Deltas must be computed after the epoch, so it covers the whole content.
+func updateEpoch(hasher Hasher, u *WorkloadUpdate) uint64 {
+	sum := hasher.New64()
+	h := contentHash{sum}
+	h.writeString(u.TrustDomain)
+
+	entries := append([]*Entry(nil), u.Entries...)
+	sortEntries(entries)
+	h.writeInt(int64(len(entries)))
+	for _, e := range entries {
+		h.writeEntry(e)
+	}
+
+	h.writeCerts(u.Bundle)
+	keys := make([]string, 0, len(u.BundleMetadata))
+	for k := range u.BundleMetadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h.writeInt(int64(len(keys)))
+	for _, k := range keys {
+		h.writeString(k)
+		h.writeString(u.BundleMetadata[k])
+	}
+	h.writeInt(int64(len(u.FederatedBundles)))
+	tds := make([]string, 0, len(u.FederatedBundles))
+	for td := range u.FederatedBundles {
+		tds = append(tds, td)
+	}
+	sort.Strings(tds)
+	for _, td := range tds {
+		h.writeString(td)
+		h.writeCerts(u.FederatedBundles[td])
+	}
+	h.writeInt(int64(len(u.JWTBundles)))
+	tds = make([]string, 0, len(u.JWTBundles))
+	for td := range u.JWTBundles {
+		tds = append(tds, td)
+	}
+	sort.Strings(tds)
+	for _, td := range tds {
+		h.writeString(td)
+		keys := u.JWTBundles[td]
+		kids := make([]string, 0, len(keys))
+		for kid := range keys {
+			kids = append(kids, kid)
+		}
+		sort.Strings(kids)
+		h.writeInt(int64(len(kids)))
+		for _, kid := range kids {
+			h.writeString(kid)
+			der, _ := x509.MarshalPKIXPublicKey(keys[kid])
+			h.writeBytes(der)
+		}
+	}
+
+	h.writeBool(u.Stale)
+	h.writeString(u.StaleReason)
+	h.writeBool(u.Bootstrapped)
+	return sum.Sum64()
+}
+
+func (c *cacheImpl) Fingerprint() [32]byte {
+	c.m.RLock()
+	entries := make([]*Entry, 0, len(c.cache))
+	for _, e := range c.cache {
+		entries = append(entries, e)
+	}
+	bundle := c.bundle
+	c.m.RUnlock()
+
+	sortEntries(entries)
+	h := contentHash{sha256.New()}
+	h.writeInt(int64(len(entries)))
+	for _, e := range entries {
+		h.writeEntry(e)
+	}
+	h.writeCerts(bundle)
+
+	var fingerprint [32]byte
+	copy(fingerprint[:], h.Sum(nil))
+	return fingerprint
+}
+
+// contentHash writes values to a hash unambiguously, prefixing variable length
+// values with their length.
+type contentHash struct {
+	hash.Hash
+}
+
+func (h contentHash) writeEntry(e *Entry) {
+	regEntry := e.RegistrationEntry
+	h.writeString(regEntry.EntryId)
+	h.writeString(regEntry.ParentId)
+	h.writeString(regEntry.SpiffeId)
+	h.writeString(selectorsKey(regEntry.Selectors))
+	h.writeStrings(regEntry.FbSpiffeIds)
+
+	h.writeBool(e.SVID != nil)
+	if e.SVID != nil {
+		h.writeBytes(e.SVID.Raw)
+		h.writeString(e.SVID.SerialNumber.String())
+		h.writeInt(e.SVID.NotAfter.UnixNano())
+	}
+	h.writeInt(int64(len(e.Bundles)))
+	ids := make([]string, 0, len(e.Bundles))
+	for id := range e.Bundles {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		h.writeString(id)
+		h.writeBytes(e.Bundles[id])
+	}
+	h.writeStrings(e.FederatesWith)
+	h.writeInt(int64(math.Float64bits(e.RotationThreshold)))
+	h.writeBool(e.Deprecated)
+}
+
+func (h contentHash) writeCerts(certs []*x509.Certificate) {
+	h.writeInt(int64(len(certs)))
+	for _, cert := range certs {
+		h.writeBytes(cert.Raw)
+	}
+}
+
+func (h contentHash) writeStrings(strs []string) {
+	sorted := append([]string(nil), strs...)
+	sort.Strings(sorted)
+	h.writeInt(int64(len(sorted)))
+	for _, s := range sorted {
+		h.writeString(s)
+	}
+}
+
+func (h contentHash) writeString(s string) {
+	h.writeBytes([]byte(s))
+}
+
+func (h contentHash) writeBytes(b []byte) {
+	h.writeInt(int64(len(b)))
+	h.Write(b)
+}
+
+func (h contentHash) writeBool(b bool) {
+	if b {
+		h.writeInt(1)
+	} else {
+		h.writeInt(0)
+	}
+}
+
+func (h contentHash) writeInt(i int64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(i))
+	h.Write(buf[:])
+}
@@ -0,0 +1,59 @@
+package cache
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// expvarMutex serializes the publishing of expvar maps, so maps are only
+// created once.
+var expvarMutex sync.Mutex
+
+func (c *cacheImpl) PublishExpvar(prefix string) {
+	expvarMutex.Lock()
+	defer expvarMutex.Unlock()
+
+	vars, ok := expvar.Get(prefix).(*expvar.Map)
+	if !ok {
+		vars = expvar.NewMap(prefix)
+	}
+
+	vars.Set("entries", expvar.Func(func() interface{} {
+		c.m.RLock()
+		defer c.m.RUnlock()
+		return len(c.cache)
+	}))
+	vars.Set("subscribers", expvar.Func(func() interface{} {
+		return c.subscribers.count()
+	}))
+	vars.Set("bundle_version", expvar.Func(func() interface{} {
+		c.m.RLock()
+		defer c.m.RUnlock()
+		return c.bundleVersion
+	}))
+	vars.Set("last_notification", expvar.Func(func() interface{} {
+		last := atomic.LoadInt64(&c.lastNotification)
+		if last == 0 {
+			return ""
+		}
+		return time.Unix(0, last).UTC().Format(time.RFC3339Nano)
+	}))
+	vars.Set("coalesced_passes", expvar.Func(func() interface{} {
+		if c.notifyLimiter == nil {
+			return uint64(0)
+		}
+		return c.notifyLimiter.coalescedPasses()
+	}))
+	vars.Set("dropped_updates", expvar.Func(func() interface{} {
+		return atomic.LoadUint64(&c.droppedUpdates)
+	}))
+	vars.Set("subscriber_channel_depth", expvar.Func(func() interface{} {
+		depths := make(map[uint64]int)
+		for _, sub := range c.subscribers.getAll() {
+			depths[sub.id] = c.SubscriberChannelDepth(sub)
+		}
+		return depths
+	}))
+}
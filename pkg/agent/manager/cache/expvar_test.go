@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"crypto/x509"
+	"expvar"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/spiffe/spire/proto/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishExpvar(t *testing.T) {
+	clk := newFakeClock()
+	cache := New(logger, nil, WithClock(clk), WithNotifyRateLimit(1, 1))
+	cache.PublishExpvar("test_publish_expvar")
+	vars, ok := expvar.Get("test_publish_expvar").(*expvar.Map)
+	require.True(t, ok)
+	get := func(name string) string {
+		return vars.Get(name).String()
+	}
+
+	assert.Equal(t, "0", get("entries"))
+	assert.Equal(t, "0", get("subscribers"))
+	assert.Equal(t, "0", get("bundle_version"))
+	assert.Equal(t, `""`, get("last_notification"))
+	assert.Equal(t, "0", get("coalesced_passes"))
+	assert.Equal(t, "0", get("dropped_updates"))
+	assert.Equal(t, "{}", get("subscriber_channel_depth"))
+
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	sub := NewSubscriber(selectors)
+	cache.Subscribe(sub)
+	defer cache.Unsubscribe(sub)
+	assert.Equal(t, "1", get("subscribers"))
+	assert.Equal(t, `"2018-01-01T00:00:00Z"`, get("last_notification"))
+	assert.Equal(t, fmt.Sprintf(`{"%d":1}`, sub.ID()), get("subscriber_channel_depth"))
+
+	// The unread update is replaced by the coalesced pass.
+	cache.SetBundle([]*x509.Certificate{{Raw: []byte("root1")}})
+	cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			Selectors: selectors,
+			ParentId:  "spiffe:parent",
+			SpiffeId:  "spiffe:test",
+			EntryId:   "1",
+		},
+	})
+	clk.Add(time.Second)
+	assert.Equal(t, "1", get("entries"))
+	assert.Equal(t, "1", get("bundle_version"))
+	assert.Equal(t, "2", get("coalesced_passes"))
+	assert.Equal(t, "1", get("dropped_updates"))
+	assert.Equal(t, `"2018-01-01T00:00:01Z"`, get("last_notification"))
+
+	// Publishing again with the same name is allowed and publishes the new
+	// cache internals.
+	cache = New(logger, nil)
+	cache.PublishExpvar("test_publish_expvar")
+	assert.Equal(t, "0", get("entries"))
+	assert.Equal(t, "0", get("bundle_version"))
+}
@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// notifyLimiter is a token bucket limiting the rate of notification passes.
+// Passes over the limit are queued and coalesced into a single pass that is
+// flushed as soon as a token is available.
+type notifyLimiter struct {
+	clk   Clock
+	rate  float64
+	burst float64
+	flush func(subs []*subscriber)
+
+	m         sync.Mutex
+	tokens    float64
+	last      time.Time
+	pending   map[uint64]*subscriber
+	scheduled bool
+	// Number of passes queued instead of running right away.
+	coalesced uint64
+}
+
+func newNotifyLimiter(clk Clock, rate float64, burst int, flush func(subs []*subscriber)) *notifyLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &notifyLimiter{
+		clk:     clk,
+		rate:    rate,
+		burst:   float64(burst),
+		flush:   flush,
+		tokens:  float64(burst),
+		last:    clk.Now(),
+		pending: make(map[uint64]*subscriber),
+	}
+}
+
+// allow returns true if a pass notifying subs can run right away. Otherwise
+// subs are queued to be flushed later and false is returned.
+func (l *notifyLimiter) allow(subs []*subscriber) bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.refill()
+	if l.tokens >= 1 && len(l.pending) == 0 {
+		l.tokens--
+		return true
+	}
+
+	for _, sub := range subs {
+		l.pending[sub.id] = sub
+	}
+	l.coalesced++
+	l.schedule()
+	return false
+}
+
+// coalescedPasses returns the number of passes that were queued instead of
+// running right away.
+func (l *notifyLimiter) coalescedPasses() uint64 {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.coalesced
+}
+
+func (l *notifyLimiter) flushPending() {
+	l.m.Lock()
+	l.scheduled = false
+	l.refill()
+	if l.tokens < 1 {
+		l.schedule()
+		l.m.Unlock()
+		return
+	}
+	l.tokens--
+
+	subs := make([]*subscriber, 0, len(l.pending))
+	for _, sub := range l.pending {
+		subs = append(subs, sub)
+	}
+	l.pending = make(map[uint64]*subscriber)
+	l.m.Unlock()
+
+	l.flush(subs)
+}
+
+// schedule arranges for the pending subscribers to be flushed once a token
+// is available. Must be called with the lock held.
+func (l *notifyLimiter) schedule() {
+	if l.scheduled {
+		return
+	}
+	l.scheduled = true
+	// Round up so the token is available by the time the timer fires.
+	wait := time.Duration(math.Ceil((1 - l.tokens) / l.rate * float64(time.Second)))
+	l.clk.AfterFunc(wait, l.flushPending)
+}
+
+// refill adds the tokens accumulated since the last refill. Must be called
+// with the lock held.
+func (l *notifyLimiter) refill() {
+	now := l.clk.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
@@ -0,0 +1,270 @@
+package cache
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/spiffe/spire/proto/common"
+)
+
+// workloadUpdateVersion is the version of the WorkloadUpdate encoding. It must
+// be increased on changes that older versions can't decode. Adding fields
+// doesn't require a new version, since unknown fields are ignored on decoding.
+const workloadUpdateVersion = 1
+
+// workloadUpdateData is the encoding of a WorkloadUpdate. Collections are
+// always encoded, as null when nil, so empty collections are decoded empty
+// rather than nil.
+type workloadUpdateData struct {
+	Version          int                          `json:"version"`
+	TrustDomain      string                       `json:"trust_domain,omitempty"`
+	Entries          []*entryData                 `json:"entries"`
+	Bundle           [][]byte                     `json:"bundle"`
+	SVIDPEM          []byte                       `json:"svid_pem"`
+	BundlePEM        []byte                       `json:"bundle_pem"`
+	FederatedBundles map[string][][]byte          `json:"federated_bundles"`
+	RefreshHints     map[string]time.Time         `json:"refresh_hints"`
+	BundleMetadata   map[string]string            `json:"bundle_metadata"`
+	JWTBundles       map[string]map[string][]byte `json:"jwt_bundles"`
+	Stale            bool                         `json:"stale,omitempty"`
+	StaleReason      string                       `json:"stale_reason,omitempty"`
+	Bootstrapped     bool                         `json:"bootstrapped,omitempty"`
+	Epoch            uint64                       `json:"epoch,omitempty"`
+	Delta            bool                         `json:"delta,omitempty"`
+	AddedEntries     []*entryData                 `json:"added_entries"`
+	ChangedEntries   []*entryData                 `json:"changed_entries"`
+	RemovedEntryIDs  []string                     `json:"removed_entry_ids"`
+}
+
+type entryData struct {
+	RegistrationEntry  *common.RegistrationEntry `json:"registration_entry,omitempty"`
+	SVID               []byte                    `json:"svid,omitempty"`
+	PrivateKey         []byte                    `json:"private_key,omitempty"`
+	Bundles            map[string][]byte         `json:"bundles"`
+	FederatesWith      []string                  `json:"federates_with"`
+	RotationThreshold  float64                   `json:"rotation_threshold,omitempty"`
+	IssuerKeyID        []byte                    `json:"issuer_key_id,omitempty"`
+	IssuerDN           string                    `json:"issuer_dn,omitempty"`
+	ValidFrom          time.Time                 `json:"valid_from"`
+	Deprecated         bool                      `json:"deprecated,omitempty"`
+	ValidatedBundleSeq uint64                    `json:"validated_bundle_seq,omitempty"`
+}
+
+// Marshal encodes the update, including the entries' private keys, into a
+// versioned format that can be decoded with UnmarshalWorkloadUpdate.
+func (u *WorkloadUpdate) Marshal() ([]byte, error) {
+	data := &workloadUpdateData{
+		Version:         workloadUpdateVersion,
+		TrustDomain:     u.TrustDomain,
+		Bundle:          marshalCerts(u.Bundle),
+		SVIDPEM:         u.SVIDPEM,
+		BundlePEM:       u.BundlePEM,
+		Stale:           u.Stale,
+		StaleReason:     u.StaleReason,
+		Bootstrapped:    u.Bootstrapped,
+		Epoch:           u.Epoch,
+		Delta:           u.Delta,
+		RemovedEntryIDs: u.RemovedEntryIDs,
+		RefreshHints:    u.RefreshHints,
+		BundleMetadata:  u.BundleMetadata,
+	}
+
+	var err error
+	if data.Entries, err = marshalEntries(u.Entries); err != nil {
+		return nil, err
+	}
+	if data.AddedEntries, err = marshalEntries(u.AddedEntries); err != nil {
+		return nil, err
+	}
+	if data.ChangedEntries, err = marshalEntries(u.ChangedEntries); err != nil {
+		return nil, err
+	}
+
+	if u.FederatedBundles != nil {
+		data.FederatedBundles = make(map[string][][]byte, len(u.FederatedBundles))
+		for td, bundle := range u.FederatedBundles {
+			data.FederatedBundles[td] = marshalCerts(bundle)
+		}
+	}
+
+	if u.JWTBundles != nil {
+		data.JWTBundles = make(map[string]map[string][]byte, len(u.JWTBundles))
+		for td, keys := range u.JWTBundles {
+			data.JWTBundles[td] = make(map[string][]byte, len(keys))
+			for kid, key := range keys {
+				der, err := x509.MarshalPKIXPublicKey(key)
+				if err != nil {
+					return nil, fmt.Errorf("unable to marshal JWT key %q of %q: %v", kid, td, err)
+				}
+				data.JWTBundles[td][kid] = der
+			}
+		}
+	}
+
+	return json.Marshal(data)
+}
+
+// UnmarshalWorkloadUpdate decodes an update encoded with WorkloadUpdate.Marshal.
+func UnmarshalWorkloadUpdate(b []byte) (*WorkloadUpdate, error) {
+	data := new(workloadUpdateData)
+	if err := json.Unmarshal(b, data); err != nil {
+		return nil, err
+	}
+	if data.Version != workloadUpdateVersion {
+		return nil, fmt.Errorf("unsupported workload update version %d", data.Version)
+	}
+
+	u := &WorkloadUpdate{
+		TrustDomain:     data.TrustDomain,
+		SVIDPEM:         data.SVIDPEM,
+		BundlePEM:       data.BundlePEM,
+		Stale:           data.Stale,
+		StaleReason:     data.StaleReason,
+		Bootstrapped:    data.Bootstrapped,
+		Epoch:           data.Epoch,
+		Delta:           data.Delta,
+		RemovedEntryIDs: data.RemovedEntryIDs,
+		RefreshHints:    data.RefreshHints,
+		BundleMetadata:  data.BundleMetadata,
+	}
+
+	var err error
+	if u.Entries, err = unmarshalEntries(data.Entries); err != nil {
+		return nil, err
+	}
+	if u.AddedEntries, err = unmarshalEntries(data.AddedEntries); err != nil {
+		return nil, err
+	}
+	if u.ChangedEntries, err = unmarshalEntries(data.ChangedEntries); err != nil {
+		return nil, err
+	}
+	if u.Bundle, err = unmarshalCerts(data.Bundle); err != nil {
+		return nil, err
+	}
+
+	if data.FederatedBundles != nil {
+		u.FederatedBundles = make(map[string][]*x509.Certificate, len(data.FederatedBundles))
+		for td, bundle := range data.FederatedBundles {
+			if u.FederatedBundles[td], err = unmarshalCerts(bundle); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if data.JWTBundles != nil {
+		u.JWTBundles = make(map[string]map[string]crypto.PublicKey, len(data.JWTBundles))
+		for td, keys := range data.JWTBundles {
+			u.JWTBundles[td] = make(map[string]crypto.PublicKey, len(keys))
+			for kid, der := range keys {
+				key, err := x509.ParsePKIXPublicKey(der)
+				if err != nil {
+					return nil, fmt.Errorf("unable to parse JWT key %q of %q: %v", kid, td, err)
+				}
+				u.JWTBundles[td][kid] = key
+			}
+		}
+	}
+
+	return u, nil
+}
+
+func marshalEntries(entries []*Entry) ([]*entryData, error) {
+	if entries == nil {
+		return nil, nil
+	}
+
+	data := make([]*entryData, 0, len(entries))
+	for _, entry := range entries {
+		e := &entryData{
+			RegistrationEntry:  entry.RegistrationEntry,
+			Bundles:            entry.Bundles,
+			FederatesWith:      entry.FederatesWith,
+			RotationThreshold:  entry.RotationThreshold,
+			IssuerKeyID:        entry.IssuerKeyID,
+			IssuerDN:           entry.IssuerDN,
+			ValidFrom:          entry.ValidFrom,
+			Deprecated:         entry.Deprecated,
+			ValidatedBundleSeq: entry.ValidatedBundleSeq,
+		}
+		if entry.SVID != nil {
+			e.SVID = entry.SVID.Raw
+		}
+		if entry.PrivateKey != nil {
+			der, err := x509.MarshalECPrivateKey(entry.PrivateKey)
+			if err != nil {
+				return nil, fmt.Errorf("unable to marshal private key: %v", err)
+			}
+			e.PrivateKey = der
+		}
+		data = append(data, e)
+	}
+	return data, nil
+}
+
+func unmarshalEntries(data []*entryData) ([]*Entry, error) {
+	if data == nil {
+		return nil, nil
+	}
+
+	entries := make([]*Entry, 0, len(data))
+	for _, e := range data {
+		entry := &Entry{
+			RegistrationEntry:  e.RegistrationEntry,
+			Bundles:            e.Bundles,
+			FederatesWith:      e.FederatesWith,
+			RotationThreshold:  e.RotationThreshold,
+			IssuerKeyID:        e.IssuerKeyID,
+			IssuerDN:           e.IssuerDN,
+			ValidFrom:          e.ValidFrom,
+			Deprecated:         e.Deprecated,
+			ValidatedBundleSeq: e.ValidatedBundleSeq,
+		}
+		if e.SVID != nil {
+			svid, err := x509.ParseCertificate(e.SVID)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse SVID: %v", err)
+			}
+			entry.SVID = svid
+		}
+		if e.PrivateKey != nil {
+			key, err := x509.ParseECPrivateKey(e.PrivateKey)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse private key: %v", err)
+			}
+			entry.PrivateKey = key
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func marshalCerts(certs []*x509.Certificate) [][]byte {
+	if certs == nil {
+		return nil
+	}
+
+	ders := make([][]byte, 0, len(certs))
+	for _, cert := range certs {
+		ders = append(ders, cert.Raw)
+	}
+	return ders
+}
+
+func unmarshalCerts(ders [][]byte) ([]*x509.Certificate, error) {
+	if ders == nil {
+		return nil, nil
+	}
+
+	certs := make([]*x509.Certificate, 0, len(ders))
+	for _, der := range ders {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"crypto"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/spiffe/spire/proto/common"
+	"github.com/spiffe/spire/test/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkloadUpdateMarshal(t *testing.T) {
+	svid, key, err := util.LoadSVIDFixture()
+	require.NoError(t, err)
+	ca, caKey, err := util.LoadCAFixture()
+	require.NoError(t, err)
+	svidPEM, err := encodeBundle([]*x509.Certificate{svid})
+	require.NoError(t, err)
+	bundlePEM, err := encodeBundle([]*x509.Certificate{ca})
+	require.NoError(t, err)
+
+	entry := &Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			Selectors:   Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}},
+			ParentId:    "spiffe://example.org/parent",
+			SpiffeId:    "spiffe://example.org/test",
+			Ttl:         3600,
+			FbSpiffeIds: []string{"spiffe://a.org"},
+			EntryId:     "00000000-0000-0000-0000-000000000001",
+		},
+		SVID:              svid,
+		PrivateKey:        key,
+		Bundles:           map[string][]byte{"spiffe://a.org": ca.Raw},
+		FederatesWith:     []string{"spiffe://a.org"},
+		RotationThreshold: 0.8,
+		IssuerKeyID:       svid.AuthorityKeyId,
+		IssuerDN:          svid.Issuer.String(),
+		Deprecated:        true,
+	}
+
+	update := &WorkloadUpdate{
+		Entries:          []*Entry{entry},
+		Bundle:           []*x509.Certificate{ca},
+		SVIDPEM:          svidPEM,
+		BundlePEM:        bundlePEM,
+		FederatedBundles: map[string][]*x509.Certificate{"spiffe://a.org": {ca}},
+		JWTBundles: map[string]map[string]crypto.PublicKey{
+			"spiffe://example.org": {"kid": caKey.Public()},
+		},
+		Stale:       true,
+		StaleReason: "server unreachable",
+		Epoch:       1234,
+		TrustDomain: "spiffe://example.org",
+
+		Bootstrapped: true,
+	}
+
+	b, err := update.Marshal()
+	require.NoError(t, err)
+	decoded, err := UnmarshalWorkloadUpdate(b)
+	require.NoError(t, err)
+	assert.Equal(t, update, decoded)
+
+	delta := &WorkloadUpdate{
+		Bundle:          []*x509.Certificate{ca},
+		Delta:           true,
+		AddedEntries:    []*Entry{entry},
+		ChangedEntries:  []*Entry{{RegistrationEntry: &common.RegistrationEntry{EntryId: "2"}}},
+		RemovedEntryIDs: []string{"3"},
+	}
+	b, err = delta.Marshal()
+	require.NoError(t, err)
+	decoded, err = UnmarshalWorkloadUpdate(b)
+	require.NoError(t, err)
+	assert.Equal(t, delta, decoded)
+
+	// Empty collections are decoded empty, not nil.
+	empty := &WorkloadUpdate{
+		Entries: []*Entry{{
+			RegistrationEntry: &common.RegistrationEntry{EntryId: "1"},
+			Bundles:           map[string][]byte{},
+			FederatesWith:     []string{},
+		}},
+		Bundle:           []*x509.Certificate{},
+		SVIDPEM:          []byte{},
+		BundlePEM:        []byte{},
+		FederatedBundles: map[string][]*x509.Certificate{},
+		RefreshHints:     map[string]time.Time{},
+		BundleMetadata:   map[string]string{},
+		JWTBundles:       map[string]map[string]crypto.PublicKey{},
+		AddedEntries:     []*Entry{},
+		ChangedEntries:   []*Entry{},
+		RemovedEntryIDs:  []string{},
+	}
+	b, err = empty.Marshal()
+	require.NoError(t, err)
+	decoded, err = UnmarshalWorkloadUpdate(b)
+	require.NoError(t, err)
+	assert.Equal(t, empty, decoded)
+}
+
+func TestUnmarshalWorkloadUpdate(t *testing.T) {
+	// Fields unknown to this version are ignored.
+	decoded, err := UnmarshalWorkloadUpdate([]byte(`{"version":1,"stale":true,"some_future_field":{"a":1}}`))
+	require.NoError(t, err)
+	assert.Equal(t, &WorkloadUpdate{Stale: true}, decoded)
+
+	_, err = UnmarshalWorkloadUpdate([]byte(`{"version":2}`))
+	assert.EqualError(t, err, "unsupported workload update version 2")
+
+	_, err = UnmarshalWorkloadUpdate([]byte(`{"version":1,"bundle":["bm90IGEgY2VydA=="]}`))
+	assert.Error(t, err)
+}
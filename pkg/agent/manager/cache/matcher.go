@@ -0,0 +1,18 @@
+package cache
+
+import "github.com/spiffe/spire/pkg/common/selector"
+
+// SelectorMatcher decides whether an entry matches a subscriber.
+type SelectorMatcher interface {
+	// Matches returns true if the entry with the entrySel selectors must be
+	// delivered to the subscriber with the subSel selectors.
+	Matches(entrySel, subSel selector.Set) bool
+}
+
+// subsetMatcher is the default SelectorMatcher, matching entries whose
+// selectors are all included in the subscriber's selectors.
+type subsetMatcher struct{}
+
+func (subsetMatcher) Matches(entrySel, subSel selector.Set) bool {
+	return subSel.IncludesSet(entrySel)
+}
@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"net"
+	"testing"
+
+	"github.com/spiffe/spire/pkg/common/selector"
+	"github.com/spiffe/spire/proto/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cidrMatcher matches ip selectors holding a CIDR range with the ip
+// selectors holding an address in the range, and other selectors by value.
+type cidrMatcher struct{}
+
+func (cidrMatcher) Matches(entrySel, subSel selector.Set) bool {
+	for _, e := range entrySel.Raw() {
+		matched := false
+		for _, s := range subSel.Raw() {
+			if e.Type != s.Type {
+				continue
+			}
+			if e.Value == s.Value {
+				matched = true
+				break
+			}
+			if _, ipNet, err := net.ParseCIDR(e.Value); err == nil && e.Type == "ip" {
+				if ip := net.ParseIP(s.Value); ip != nil && ipNet.Contains(ip) {
+					matched = true
+					break
+				}
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSelectorMatcher(t *testing.T) {
+	cache := New(logger, nil, WithSelectorMatcher(cidrMatcher{}))
+	newEntry := func(id string, selectors ...*common.Selector) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: id},
+		}
+	}
+	require.NoError(t, cache.SetEntry(newEntry("private", &common.Selector{Type: "ip", Value: "10.0.0.0/8"})))
+
+	inRange := NewSubscriber(Selectors{&common.Selector{Type: "ip", Value: "10.1.2.3"}})
+	require.NoError(t, cache.Subscribe(inRange))
+	defer cache.Unsubscribe(inRange)
+	outOfRange := NewSubscriber(Selectors{&common.Selector{Type: "ip", Value: "192.168.1.1"}})
+	require.NoError(t, cache.Subscribe(outOfRange))
+	defer cache.Unsubscribe(outOfRange)
+
+	assert.Equal(t, []string{"private"}, entryIDs((<-inRange.Updates()).Entries))
+	assert.Empty(t, (<-outOfRange.Updates()).Entries)
+	assert.True(t, cache.HasMatch(Selectors{&common.Selector{Type: "ip", Value: "10.1.2.3"}}))
+	assert.False(t, cache.HasMatch(Selectors{&common.Selector{Type: "ip", Value: "192.168.1.1"}}))
+	assert.Equal(t, []MatchExplanation{{EntryID: "private", Matched: true}},
+		cache.ExplainMatch(Selectors{&common.Selector{Type: "ip", Value: "10.1.2.3"}}))
+	assert.Equal(t, []MatchExplanation{{
+		EntryID:          "private",
+		MissingSelectors: Selectors{&common.Selector{Type: "ip", Value: "10.0.0.0/8"}},
+	}}, cache.ExplainMatch(Selectors{&common.Selector{Type: "ip", Value: "192.168.1.1"}}))
+
+	// Entries set later are delivered to the matching subscribers only.
+	require.NoError(t, cache.SetEntry(newEntry("lan", &common.Selector{Type: "ip", Value: "192.168.0.0/16"})))
+	assert.Equal(t, []string{"lan"}, entryIDs((<-outOfRange.Updates()).Entries))
+	assert.Equal(t, 0, len(inRange.Updates()))
+	assert.Equal(t, []uint64{outOfRange.ID()}, cache.SubscribersForEntry("lan"))
+
+	_, err := cache.DeleteEntry(&common.RegistrationEntry{EntryId: "private"})
+	require.NoError(t, err)
+	assert.Empty(t, (<-inRange.Updates()).Entries)
+	assert.Equal(t, 0, len(outOfRange.Updates()))
+}
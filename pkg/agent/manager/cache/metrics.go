@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// expiryBuckets are the bounds of the SVID expiration buckets reported by
+// WriteMetrics, by time left until expiration.
+var expiryBuckets = []struct {
+	label string
+	bound time.Duration
+}{
+	{"expired", 0},
+	{"1h", time.Hour},
+	{"24h", 24 * time.Hour},
+}
+
+// labelEscaper escapes label values as required by the exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (c *cacheImpl) WriteMetrics(w io.Writer) error {
+	now := c.clk.Now()
+
+	c.m.RLock()
+	entries := len(c.cache)
+	bundleRoots := len(c.bundle)
+	federatedRoots := make(map[string]int, len(c.federatedBundles))
+	for td, bundle := range c.federatedBundles {
+		federatedRoots[td] = len(bundle)
+	}
+	expiries := make(map[string]int)
+	for _, entry := range c.cache {
+		if entry.SVID != nil {
+			expiries[expiryBucket(entry.SVID.NotAfter.Sub(now))]++
+		}
+	}
+	c.m.RUnlock()
+
+	buf := new(bytes.Buffer)
+	writeFamily(buf, "spire_agent_cache_entries", "Number of cached entries.")
+	fmt.Fprintf(buf, "spire_agent_cache_entries %d\n", entries)
+
+	writeFamily(buf, "spire_agent_cache_subscribers", "Number of registered subscribers.")
+	fmt.Fprintf(buf, "spire_agent_cache_subscribers %d\n", c.subscribers.count())
+
+	writeFamily(buf, "spire_agent_cache_bundle_roots", "Number of roots in the bundle.")
+	fmt.Fprintf(buf, "spire_agent_cache_bundle_roots %d\n", bundleRoots)
+
+	writeFamily(buf, "spire_agent_cache_federated_bundle_roots", "Number of roots in the bundle of each federated trust domain.")
+	tds := make([]string, 0, len(federatedRoots))
+	for td := range federatedRoots {
+		tds = append(tds, td)
+	}
+	sort.Strings(tds)
+	for _, td := range tds {
+		fmt.Fprintf(buf, "spire_agent_cache_federated_bundle_roots{trust_domain=\"%s\"} %d\n", labelEscaper.Replace(td), federatedRoots[td])
+	}
+
+	writeFamily(buf, "spire_agent_cache_svids", "Number of cached SVIDs by time left until expiration.")
+	for _, bucket := range expiryBuckets {
+		fmt.Fprintf(buf, "spire_agent_cache_svids{expires_within=\"%s\"} %d\n", bucket.label, expiries[bucket.label])
+	}
+	fmt.Fprintf(buf, "spire_agent_cache_svids{expires_within=\"later\"} %d\n", expiries["later"])
+
+	buf.WriteString("# EOF\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// expiryBucket returns the label of the expiration bucket for an SVID
+// expiring in left.
+func expiryBucket(left time.Duration) string {
+	for _, bucket := range expiryBuckets {
+		if left <= bucket.bound {
+			return bucket.label
+		}
+	}
+	return "later"
+}
+
+func writeFamily(buf *bytes.Buffer, name, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s gauge\n", name)
+}
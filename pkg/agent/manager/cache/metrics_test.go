@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/spiffe/spire/proto/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	clk := newFakeClock()
+	root := &x509.Certificate{Raw: []byte("root")}
+	cache := New(logger, []*x509.Certificate{root}, WithClock(clk))
+	cache.SetFederatedBundle("spiffe://b.org", []*x509.Certificate{root})
+	cache.SetFederatedBundle(`spiffe://"a".org`, []*x509.Certificate{root, {Raw: []byte("other")}})
+
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	for id, ttl := range map[string]time.Duration{
+		"expired": -time.Minute,
+		"1h":      30 * time.Minute,
+		"24h":     2 * time.Hour,
+		"later":   48 * time.Hour,
+		"later2":  72 * time.Hour,
+	} {
+		require.NoError(t, cache.SetEntry(&Entry{
+			RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: id},
+			SVID:              &x509.Certificate{NotAfter: clk.Now().Add(ttl)},
+		}))
+	}
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "no-svid"},
+	}))
+	sub := NewSubscriber(selectors)
+	require.NoError(t, cache.Subscribe(sub))
+	defer cache.Unsubscribe(sub)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, cache.WriteMetrics(buf))
+	assert.Equal(t, `# HELP spire_agent_cache_entries Number of cached entries.
+# TYPE spire_agent_cache_entries gauge
+spire_agent_cache_entries 6
+# HELP spire_agent_cache_subscribers Number of registered subscribers.
+# TYPE spire_agent_cache_subscribers gauge
+spire_agent_cache_subscribers 1
+# HELP spire_agent_cache_bundle_roots Number of roots in the bundle.
+# TYPE spire_agent_cache_bundle_roots gauge
+spire_agent_cache_bundle_roots 1
+# HELP spire_agent_cache_federated_bundle_roots Number of roots in the bundle of each federated trust domain.
+# TYPE spire_agent_cache_federated_bundle_roots gauge
+spire_agent_cache_federated_bundle_roots{trust_domain="spiffe://\"a\".org"} 2
+spire_agent_cache_federated_bundle_roots{trust_domain="spiffe://b.org"} 1
+# HELP spire_agent_cache_svids Number of cached SVIDs by time left until expiration.
+# TYPE spire_agent_cache_svids gauge
+spire_agent_cache_svids{expires_within="expired"} 1
+spire_agent_cache_svids{expires_within="1h"} 1
+spire_agent_cache_svids{expires_within="24h"} 1
+spire_agent_cache_svids{expires_within="later"} 2
+# EOF
+`, buf.String())
+
+	// The metrics reflect the live state.
+	clk.Add(time.Hour)
+	buf.Reset()
+	require.NoError(t, cache.WriteMetrics(buf))
+	assert.Contains(t, buf.String(), "spire_agent_cache_svids{expires_within=\"expired\"} 2\n")
+}
@@ -0,0 +1,174 @@
+package cache
+
+import (
+	"crypto"
+	"crypto/x509"
+	"reflect"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spiffe/spire/proto/common"
+)
+
+// MirroredCache is a Cache applying the calls modifying the primary cache to
+// a secondary cache too, so the secondary can take over at any time. Reads and
+// subscriptions only go to the primary cache.
+type MirroredCache struct {
+	Cache
+
+	secondary Cache
+	log       logrus.FieldLogger
+}
+
+// NewMirroredCache returns a MirroredCache mirroring the calls modifying
+// primary to secondary.
+func NewMirroredCache(log logrus.FieldLogger, primary, secondary Cache) *MirroredCache {
+	return &MirroredCache{
+		Cache:     primary,
+		secondary: secondary,
+		log:       log.WithField("subsystem_name", "mirrored_cache"),
+	}
+}
+
+func (m *MirroredCache) SetEntry(entry *Entry) error {
+	err := m.Cache.SetEntry(entry)
+	if secondaryErr := m.secondary.SetEntry(entry); !sameError(err, secondaryErr) {
+		m.divergence("SetEntry", err, secondaryErr)
+	}
+	return err
+}
+
+func (m *MirroredCache) DeleteEntry(regEntry *common.RegistrationEntry) (bool, error) {
+	deleted, err := m.Cache.DeleteEntry(regEntry)
+	secondaryDeleted, secondaryErr := m.secondary.DeleteEntry(regEntry)
+	switch {
+	case !sameError(err, secondaryErr):
+		m.divergence("DeleteEntry", err, secondaryErr)
+	case secondaryDeleted != deleted:
+		m.divergence("DeleteEntry", deleted, secondaryDeleted)
+	}
+	return deleted, err
+}
+
+func (m *MirroredCache) SoftDeleteEntry(entryID string, grace time.Duration) error {
+	err := m.Cache.SoftDeleteEntry(entryID, grace)
+	if secondaryErr := m.secondary.SoftDeleteEntry(entryID, grace); !sameError(err, secondaryErr) {
+		m.divergence("SoftDeleteEntry", err, secondaryErr)
+	}
+	return err
+}
+
+func (m *MirroredCache) SweepExpired() int {
+	removed := m.Cache.SweepExpired()
+	if secondaryRemoved := m.secondary.SweepExpired(); secondaryRemoved != removed {
+		m.divergence("SweepExpired", removed, secondaryRemoved)
+	}
+	return removed
+}
+
+func (m *MirroredCache) PopRotated(now time.Time) []*Entry {
+	entries := m.Cache.PopRotated(now)
+	if secondaryEntries := m.secondary.PopRotated(now); !reflect.DeepEqual(secondaryEntries, entries) {
+		m.divergence("PopRotated", entries, secondaryEntries)
+	}
+	return entries
+}
+
+func (m *MirroredCache) Freeze() {
+	m.Cache.Freeze()
+	m.secondary.Freeze()
+}
+
+func (m *MirroredCache) Unfreeze() {
+	m.Cache.Unfreeze()
+	m.secondary.Unfreeze()
+}
+
+func (m *MirroredCache) Close() {
+	m.Cache.Close()
+	m.secondary.Close()
+}
+
+func (m *MirroredCache) SetBundle(bundle []*x509.Certificate) error {
+	err := m.Cache.SetBundle(bundle)
+	if secondaryErr := m.secondary.SetBundle(bundle); !sameError(err, secondaryErr) {
+		m.divergence("SetBundle", err, secondaryErr)
+	}
+	return err
+}
+
+func (m *MirroredCache) RemoveBundleRoot(cert *x509.Certificate) bool {
+	removed := m.Cache.RemoveBundleRoot(cert)
+	if secondaryRemoved := m.secondary.RemoveBundleRoot(cert); secondaryRemoved != removed {
+		m.divergence("RemoveBundleRoot", removed, secondaryRemoved)
+	}
+	return removed
+}
+
+func (m *MirroredCache) SetFederatedBundle(trustDomain string, bundle []*x509.Certificate) {
+	m.Cache.SetFederatedBundle(trustDomain, bundle)
+	m.secondary.SetFederatedBundle(trustDomain, bundle)
+}
+
+func (m *MirroredCache) Reset(entries []*Entry, bundle []*x509.Certificate) {
+	m.Cache.Reset(entries, bundle)
+	m.secondary.Reset(entries, bundle)
+}
+
+func (m *MirroredCache) Reconcile(authoritative []*Entry) ReconcileResult {
+	result := m.Cache.Reconcile(authoritative)
+	if secondaryResult := m.secondary.Reconcile(authoritative); !reflect.DeepEqual(secondaryResult, result) {
+		m.divergence("Reconcile", result, secondaryResult)
+	}
+	return result
+}
+
+func (m *MirroredCache) SetJWTBundle(trustDomain string, keys map[string]crypto.PublicKey) {
+	m.Cache.SetJWTBundle(trustDomain, keys)
+	m.secondary.SetJWTBundle(trustDomain, keys)
+}
+
+func (m *MirroredCache) SetBundleMetadata(metadata map[string]string) {
+	m.Cache.SetBundleMetadata(metadata)
+	m.secondary.SetBundleMetadata(metadata)
+}
+
+func (m *MirroredCache) SetDegraded(degraded bool, reason string) {
+	m.Cache.SetDegraded(degraded, reason)
+	m.secondary.SetDegraded(degraded, reason)
+}
+
+func (m *MirroredCache) SetBootstrapComplete() {
+	m.Cache.SetBootstrapComplete()
+	m.secondary.SetBootstrapComplete()
+}
+
+func (m *MirroredCache) SetSelectorNormalizer(normalizer func(*common.Selector) *common.Selector) {
+	m.Cache.SetSelectorNormalizer(normalizer)
+	m.secondary.SetSelectorNormalizer(normalizer)
+}
+
+func (m *MirroredCache) SetInsertPolicy(policy func(*Entry) error) {
+	m.Cache.SetInsertPolicy(policy)
+	m.secondary.SetInsertPolicy(policy)
+}
+
+// sameError returns true if both errors are nil, or both are set with the same
+// message. Errors built for each call, like InvalidSelectorError, are distinct
+// values even when both caches reject the call for the same reason.
+func sameError(a, b error) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Error() == b.Error()
+}
+
+// divergence logs that a call had different results on the primary and the
+// secondary cache.
+func (m *MirroredCache) divergence(method string, primary, secondary interface{}) {
+	m.log.WithFields(logrus.Fields{
+		"method":    method,
+		"primary":   primary,
+		"secondary": secondary,
+	}).Warn("Secondary cache diverged from the primary cache")
+}
@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"crypto/x509"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	testlog "github.com/sirupsen/logrus/hooks/test"
+	"github.com/spiffe/spire/proto/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirroredCache(t *testing.T) {
+	log, hook := testlog.NewNullLogger()
+	primary := New(logger, nil)
+	secondary := New(logger, nil)
+	mirrored := NewMirroredCache(log, primary, secondary)
+
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	newEntry := func(id string) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: selectors,
+				ParentId:  "spiffe:parent",
+				SpiffeId:  "spiffe:test" + id,
+				EntryId:   id,
+			},
+		}
+	}
+	root1 := &x509.Certificate{Raw: []byte("root1")}
+	root2 := &x509.Certificate{Raw: []byte("root2")}
+
+	assert.NoError(t, mirrored.SetEntry(newEntry("1")))
+	assert.NoError(t, mirrored.SetEntry(newEntry("2")))
+	assert.NoError(t, mirrored.SetEntry(newEntry("3")))
+	deleted, err := mirrored.DeleteEntry(newEntry("2").RegistrationEntry)
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	assert.NoError(t, mirrored.SetBundle([]*x509.Certificate{root1, root2}))
+	assert.True(t, mirrored.RemoveBundleRoot(root1))
+	mirrored.SetFederatedBundle("spiffe://a.org", []*x509.Certificate{root1})
+	mirrored.SetDegraded(true, "server unreachable")
+
+	// Both caches converge to the same state.
+	expected, expectedSub, err := primary.SubscribeAndSnapshot(selectors)
+	require.NoError(t, err)
+	defer primary.Unsubscribe(expectedSub)
+	actual, actualSub, err := secondary.SubscribeAndSnapshot(selectors)
+	require.NoError(t, err)
+	defer secondary.Unsubscribe(actualSub)
+	sortEntries(expected.Entries)
+	sortEntries(actual.Entries)
+	assert.Equal(t, expected, actual)
+	assert.Len(t, actual.Entries, 2)
+	assert.Empty(t, hook.AllEntries())
+
+	// Divergences are logged, and the primary result is returned.
+	secondary.DeleteEntry(newEntry("1").RegistrationEntry)
+	deleted, err = mirrored.DeleteEntry(newEntry("1").RegistrationEntry)
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	if assert.Len(t, hook.AllEntries(), 1) {
+		entry := hook.LastEntry()
+		assert.Equal(t, logrus.WarnLevel, entry.Level)
+		assert.Equal(t, "Secondary cache diverged from the primary cache", entry.Message)
+		assert.Equal(t, "DeleteEntry", entry.Data["method"])
+		assert.Equal(t, true, entry.Data["primary"])
+		assert.Equal(t, false, entry.Data["secondary"])
+	}
+}
+
+func TestMirroredCacheSameErrors(t *testing.T) {
+	log, hook := testlog.NewNullLogger()
+	mirrored := NewMirroredCache(log, New(logger, nil), New(logger, nil))
+
+	// Both caches reject the entry with distinct but equivalent errors.
+	err := mirrored.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			Selectors: Selectors{&common.Selector{Type: "unix"}},
+			EntryId:   "1",
+		},
+	})
+	assert.IsType(t, &InvalidSelectorError{}, err)
+	assert.Empty(t, hook.AllEntries())
+}
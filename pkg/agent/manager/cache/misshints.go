@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// missHintsBuffer is the number of hints held until they are read. Hints
+// emitted while the buffer is full are dropped.
+const missHintsBuffer = 16
+
+// missHinter emits hints for the sets of selectors that didn't match any
+// entry, at most once per interval for the same set.
+type missHinter struct {
+	clk      Clock
+	interval time.Duration
+	c        chan Selectors
+
+	m sync.Mutex
+	// Time of the last hint emitted, keyed by selector set key.
+	last map[string]time.Time
+}
+
+func newMissHinter(clk Clock, interval time.Duration) *missHinter {
+	return &missHinter{
+		clk:      clk,
+		interval: interval,
+		c:        make(chan Selectors, missHintsBuffer),
+		last:     make(map[string]time.Time),
+	}
+}
+
+// miss emits a hint for the selectors unless one was emitted less than the
+// interval ago.
+func (h *missHinter) miss(selectors Selectors) {
+	key := selectorsKey(selectors)
+	now := h.clk.Now()
+
+	h.m.Lock()
+	defer h.m.Unlock()
+	if last, ok := h.last[key]; ok && now.Sub(last) < h.interval {
+		return
+	}
+	select {
+	case h.c <- append(Selectors(nil), selectors...):
+		h.last[key] = now
+	default:
+		return
+	}
+	// Forget the sets that can be hinted again.
+	for k, last := range h.last {
+		if now.Sub(last) >= h.interval {
+			delete(h.last, k)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spiffe/spire/proto/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMissHints(t *testing.T) {
+	clk := newFakeClock()
+	cache := New(logger, nil, WithMissHints(time.Minute), WithClock(clk))
+	uid := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	gid := Selectors{&common.Selector{Type: "unix", Value: "gid:2222"}}
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: uid, EntryId: "1"},
+	}))
+
+	// Matches don't emit hints.
+	assert.True(t, cache.HasMatch(uid))
+	sub := NewSubscriber(uid)
+	require.NoError(t, cache.Subscribe(sub))
+	defer cache.Unsubscribe(sub)
+	assert.Len(t, cache.MissHints(), 0)
+
+	// Repeated misses for the same selectors emit a single hint.
+	assert.False(t, cache.HasMatch(gid))
+	assert.False(t, cache.HasMatch(gid))
+	_, missSub, err := cache.SubscribeAndSnapshot(gid)
+	require.NoError(t, err)
+	defer cache.Unsubscribe(missSub)
+	require.NoError(t, cache.UpdateSubscription(sub, gid))
+	require.Len(t, cache.MissHints(), 1)
+	assert.Equal(t, gid, <-cache.MissHints())
+
+	// The selectors are hinted again once the interval elapses.
+	clk.Add(30 * time.Second)
+	assert.False(t, cache.HasMatch(gid))
+	assert.Len(t, cache.MissHints(), 0)
+	clk.Add(30 * time.Second)
+	assert.False(t, cache.HasMatch(gid))
+	require.Len(t, cache.MissHints(), 1)
+	assert.Equal(t, gid, <-cache.MissHints())
+
+	// Hints are dropped while the channel is full.
+	for i := 0; i < missHintsBuffer+1; i++ {
+		cache.HasMatch(Selectors{&common.Selector{Type: "unix", Value: string(rune('a' + i))}})
+	}
+	assert.Len(t, cache.MissHints(), missHintsBuffer)
+
+	assert.Nil(t, New(logger, nil).MissHints())
+}
+
+func TestMissHintsDynamicSubscriber(t *testing.T) {
+	cache := New(logger, nil, WithMissHints(time.Minute))
+	uid := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: uid, EntryId: "1"},
+	}))
+
+	// Subscribing before any selectors are received doesn't emit a hint.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	selCh := make(chan Selectors)
+	sub := cache.SubscribeDynamic(ctx, selCh)
+	assert.Len(t, cache.MissHints(), 0)
+
+	selCh <- uid
+	assert.Len(t, (<-sub.Updates()).Entries, 1)
+	assert.Len(t, cache.MissHints(), 0)
+}
@@ -0,0 +1,186 @@
+package cache
+
+import (
+	"crypto"
+	"crypto/x509"
+	"time"
+)
+
+// Option configures optional cache behavior.
+type Option func(*cacheImpl)
+
+// WithClock sets the clock used by the cache. Defaults to the system clock.
+func WithClock(clk Clock) Option {
+	return func(c *cacheImpl) {
+		c.clk = clk
+	}
+}
+
+// WithTrustDomain sets the trust domain the cache holds the identities of,
+// reported in the updates sent to subscribers. SetEntry then rejects the
+// entries whose SVID has a SPIFFE ID in another trust domain.
+func WithTrustDomain(trustDomain string) Option {
+	return func(c *cacheImpl) {
+		c.trustDomain = trustDomain
+	}
+}
+
+// WithNotifyRateLimit limits notification passes to rate per second, allowing
+// bursts of up to burst passes. Passes over the limit are coalesced into a
+// single pass delivering the latest state once the rate allows it. By
+// default notifications are not limited.
+func WithNotifyRateLimit(rate float64, burst int) Option {
+	return func(c *cacheImpl) {
+		c.notifyRate = rate
+		c.notifyBurst = burst
+	}
+}
+
+// WithAccessCounting enables counting the accesses to every entry, reported
+// by EntryAccessCount. By default accesses are not counted.
+func WithAccessCounting() Option {
+	return func(c *cacheImpl) {
+		c.accessCounts = make(map[string]*uint64)
+	}
+}
+
+// WithStrictMode makes SetEntry fail with ErrConflict instead of replacing an
+// entry with different content that wasn't read since it was set. Callers
+// resolve the conflict by reading the current entry before setting it again.
+// By default the last entry set wins.
+func WithStrictMode() Option {
+	return func(c *cacheImpl) {
+		c.acknowledged = make(map[string]*uint32)
+	}
+}
+
+// WithAllowedRoots restricts the bundle to roots whose public key is one of
+// keys. Other roots are dropped when setting the bundle. By default any root
+// is allowed.
+func WithAllowedRoots(keys []crypto.PublicKey) Option {
+	return func(c *cacheImpl) {
+		c.allowedRoots = make(map[string]bool, len(keys))
+		for _, key := range keys {
+			if der, err := x509.MarshalPKIXPublicKey(key); err == nil {
+				c.allowedRoots[string(der)] = true
+			}
+		}
+	}
+}
+
+// WithMaxSelectors limits the number of selectors of entries and
+// subscriptions to max. Entries and subscriptions over the limit are rejected
+// with ErrTooManySelectors. By default the number of selectors is not
+// limited.
+func WithMaxSelectors(max int) Option {
+	return func(c *cacheImpl) {
+		c.maxSelectors = max
+	}
+}
+
+// WithManualFlush holds the subscriber notifications until FlushNotifications
+// is called or, if maxDelay is positive, maxDelay after the first held
+// notification of the subscriber. Notifications held for a subscriber are
+// coalesced into a single one delivering the latest state. By default
+// subscribers are notified right away.
+func WithManualFlush(maxDelay time.Duration) Option {
+	return func(c *cacheImpl) {
+		c.manualFlush = true
+		c.flushDelay = maxDelay
+	}
+}
+
+// WithDeliveryHistory records the last size updates sent to every subscriber,
+// reported by DeliveryHistory. By default updates are not recorded.
+func WithDeliveryHistory(size int) Option {
+	return func(c *cacheImpl) {
+		c.historySize = size
+	}
+}
+
+// WithKeyFunc sets the function returning the key entries are stored and
+// looked up with. Entries with the same key replace each other. Lookups by
+// registration entry use the key of an entry holding only the registration
+// entry. Defaults to the entry ID.
+func WithKeyFunc(keyFunc func(*Entry) string) Option {
+	return func(c *cacheImpl) {
+		c.keyFunc = keyFunc
+	}
+}
+
+// WithSelectorMatcher sets the matcher deciding which entries are delivered
+// to which subscribers, and which entries HasMatch matches. By default entries
+// match subscribers holding all the entry selectors.
+func WithSelectorMatcher(matcher SelectorMatcher) Option {
+	return func(c *cacheImpl) {
+		c.matcher = matcher
+	}
+}
+
+// WithHasher sets the hasher the cache content is hashed with to detect
+// changes, like the update epochs. Defaults to 64-bit FNV-1a.
+func WithHasher(hasher Hasher) Option {
+	return func(c *cacheImpl) {
+		c.hasher = hasher
+	}
+}
+
+// WithSPIFFEIDDedup makes the cache keep a single entry per SPIFFE ID, the one
+// with the SVID issued last. Setting an entry evicts the entries with the same
+// SPIFFE ID and an SVID issued before, and has no effect if one of them has an
+// SVID issued after. By default all the entries are kept.
+func WithSPIFFEIDDedup() Option {
+	return func(c *cacheImpl) {
+		c.dedupSPIFFEIDs = true
+	}
+}
+
+// WithDeliveryKeyCheck makes the cache check, when delivering entries, that
+// their private key matches their SVID, and leave out the entries that don't.
+// They are logged once, when they are stored. By default entries are
+// delivered without checking.
+func WithDeliveryKeyCheck() Option {
+	return func(c *cacheImpl) {
+		c.keyCheck = true
+	}
+}
+
+// WithDNSWildcardMatch makes EntriesByDNSName match wildcard DNS names, like
+// *.example.org, against the names they cover, like foo.example.org. By
+// default wildcard names only match literally.
+func WithDNSWildcardMatch() Option {
+	return func(c *cacheImpl) {
+		c.dnsWildcardMatch = true
+	}
+}
+
+// WithMissHints makes the cache send the sets of selectors that didn't match
+// any entry on the MissHints channel, so they can be fetched. The same set is
+// sent at most once per interval, and sets are dropped while the channel is
+// full. By default no hints are sent.
+func WithMissHints(interval time.Duration) Option {
+	return func(c *cacheImpl) {
+		c.missHintsEnabled = true
+		c.missHintInterval = interval
+	}
+}
+
+// WithAsyncNotify makes the cache notify subscribers in a background
+// goroutine, so calls modifying the cache return without waiting for the
+// subscribers to be notified. Notifications requested while others are
+// pending are coalesced into a single pass delivering the latest state. By
+// default subscribers are notified before the call returns.
+func WithAsyncNotify() Option {
+	return func(c *cacheImpl) {
+		c.asyncNotifier = newAsyncNotifier(c.limitedNotify)
+	}
+}
+
+// WithRotationThreshold sets how long before expiration the SVIDs of entries
+// without a rotation threshold are rotated, as scheduled by PeekNextRotation
+// and PopRotated. Defaults to zero, rotating them when they expire.
+func WithRotationThreshold(threshold time.Duration) Option {
+	return func(c *cacheImpl) {
+		c.rotationThreshold = threshold
+	}
+}
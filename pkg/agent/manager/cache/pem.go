@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"crypto/x509"
+	"sync"
+)
+
+// pemCache holds the PEM encoding of the entry SVIDs and of the bundle sent to
+// the subscribers created with WithPEM, so they are encoded once until they
+// change.
+type pemCache struct {
+	m sync.Mutex
+	// PEM encoding of the entry SVIDs, keyed by entry key.
+	svids map[string]encodedCerts
+	// PEM encoding of the last bundle encoded.
+	bundle encodedCerts
+}
+
+// encodedCerts is the PEM encoding of certs.
+type encodedCerts struct {
+	certs []*x509.Certificate
+	pem   []byte
+}
+
+func newPEMCache() *pemCache {
+	return &pemCache{svids: make(map[string]encodedCerts)}
+}
+
+// encoded returns the PEM encoding of certs, reusing the one of encoded if it
+// holds the same certificates.
+func (e encodedCerts) encoded(certs []*x509.Certificate) ([]byte, bool) {
+	if len(e.certs) != len(certs) {
+		return nil, false
+	}
+	for i, cert := range certs {
+		if e.certs[i] != cert {
+			return nil, false
+		}
+	}
+	return e.pem, true
+}
+
+// setPEM sets the PEM fields of the update from its entries and its bundle.
+func (p *pemCache) setPEM(update *WorkloadUpdate, keyFunc func(*Entry) string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	var svids []byte
+	for _, e := range update.Entries {
+		if e.SVID == nil {
+			continue
+		}
+		key := keyFunc(e)
+		certs := []*x509.Certificate{e.SVID}
+		pem, ok := p.svids[key].encoded(certs)
+		if !ok {
+			pem = encodeCerts(certs)
+			p.svids[key] = encodedCerts{certs: certs, pem: pem}
+		}
+		svids = append(svids, pem...)
+	}
+	update.SVIDPEM = svids
+
+	bundle, ok := p.bundle.encoded(update.Bundle)
+	if !ok {
+		bundle = encodeCerts(update.Bundle)
+		p.bundle = encodedCerts{certs: update.Bundle, pem: bundle}
+	}
+	update.BundlePEM = bundle
+}
+
+// forget drops the PEM encoding of the SVID of the entry stored under key.
+func (p *pemCache) forget(key string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	delete(p.svids, key)
+}
+
+// retain drops the PEM encoding of the SVIDs of the entries not in cache.
+func (p *pemCache) retain(cache map[string]*Entry) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	for key := range p.svids {
+		if _, ok := cache[key]; !ok {
+			delete(p.svids, key)
+		}
+	}
+}
+
+// encodeCerts returns the certificates as concatenated PEM blocks, or nil if
+// there are none.
+func encodeCerts(certs []*x509.Certificate) []byte {
+	// Encoding to a buffer doesn't fail.
+	pem, _ := encodeBundle(certs)
+	return pem
+}
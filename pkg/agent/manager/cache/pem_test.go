@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/spiffe/spire/proto/common"
+	"github.com/spiffe/spire/test/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// decodeCerts decodes the certificates of the concatenated PEM blocks.
+func decodeCerts(t *testing.T, b []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		require.NoError(t, err)
+		certs = append(certs, cert)
+	}
+	assert.Empty(t, b)
+	return certs
+}
+
+func TestPEMUpdates(t *testing.T) {
+	ca, _, err := util.LoadCAFixture()
+	require.NoError(t, err)
+	svid, _, err := util.LoadSVIDFixture()
+	require.NoError(t, err)
+
+	cache := New(logger, []*x509.Certificate{ca})
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	entry := &Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "1"},
+		SVID:              svid,
+	}
+	require.NoError(t, cache.SetEntry(entry))
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "2"},
+	}))
+
+	sub := NewSubscriber(selectors, WithPEM())
+	require.NoError(t, cache.Subscribe(sub))
+	defer cache.Unsubscribe(sub)
+	plain := NewSubscriber(selectors)
+	require.NoError(t, cache.Subscribe(plain))
+	defer cache.Unsubscribe(plain)
+
+	// Entries without SVID are skipped.
+	wu := <-sub.Updates()
+	assert.Equal(t, []*x509.Certificate{svid}, decodeCerts(t, wu.SVIDPEM))
+	assert.Equal(t, []*x509.Certificate{ca}, decodeCerts(t, wu.BundlePEM))
+
+	wu = <-plain.Updates()
+	assert.Nil(t, wu.SVIDPEM)
+	assert.Nil(t, wu.BundlePEM)
+
+	require.NoError(t, cache.SetEntry(&Entry{
+		RegistrationEntry: &common.RegistrationEntry{Selectors: selectors, EntryId: "3"},
+		SVID:              ca,
+	}))
+	wu = <-sub.Updates()
+	<-plain.Updates()
+	assert.Equal(t, []*x509.Certificate{svid, ca}, decodeCerts(t, wu.SVIDPEM))
+	assert.Equal(t, []*x509.Certificate{ca}, decodeCerts(t, wu.BundlePEM))
+
+	require.NoError(t, cache.SetBundle(nil))
+	wu = <-sub.Updates()
+	<-plain.Updates()
+	assert.Nil(t, wu.BundlePEM)
+	assert.Len(t, decodeCerts(t, wu.SVIDPEM), 2)
+}
+
+func TestPEMCacheReuse(t *testing.T) {
+	ca, _, err := util.LoadCAFixture()
+	require.NoError(t, err)
+	svid, _, err := util.LoadSVIDFixture()
+	require.NoError(t, err)
+
+	p := newPEMCache()
+	update := func(svid *x509.Certificate) *WorkloadUpdate {
+		wu := &WorkloadUpdate{
+			Entries: []*Entry{{RegistrationEntry: &common.RegistrationEntry{EntryId: "1"}, SVID: svid}},
+			Bundle:  []*x509.Certificate{ca},
+		}
+		p.setPEM(wu, entryID)
+		return wu
+	}
+
+	// The encodings are reused while the certificates don't change.
+	first := update(svid)
+	cached := p.svids["1"].pem
+	second := update(svid)
+	assert.Equal(t, first.SVIDPEM, second.SVIDPEM)
+	assert.True(t, &cached[0] == &p.svids["1"].pem[0])
+	assert.True(t, &first.BundlePEM[0] == &second.BundlePEM[0])
+
+	// A rotated SVID is encoded again.
+	rotated := update(ca)
+	assert.Equal(t, []*x509.Certificate{ca}, decodeCerts(t, rotated.SVIDPEM))
+	assert.False(t, &cached[0] == &p.svids["1"].pem[0])
+
+	p.forget("1")
+	assert.Empty(t, p.svids)
+	update(svid)
+	p.retain(map[string]*Entry{})
+	assert.Empty(t, p.svids)
+}
@@ -0,0 +1,571 @@
+package cache
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	"github.com/spiffe/spire/proto/common"
+)
+
+// Operation is a call modifying the cache, recorded by RecordingCache.
+type Operation struct {
+	// Method is the name of the called Cache method.
+	Method string
+	// Args holds copies of the call arguments. Subscribers are recorded by
+	// their ID and selectors.
+	Args []interface{}
+
+	replay func(target Cache, subs map[uint64]*subscriber)
+}
+
+// RecordingCache is a Cache recording the calls modifying the underlying
+// cache, so they can be replayed on another cache. Calls that don't modify
+// the cache are delegated without being recorded. Subscribers are replayed
+// with the same selectors, options and pause state. Subscribers calling a
+// callback are replayed as channel subscribers, so callbacks are not called
+// again.
+type RecordingCache struct {
+	Cache
+
+	m       sync.Mutex
+	journal []Operation
+}
+
+// NewRecordingCache returns a RecordingCache delegating to cache.
+func NewRecordingCache(cache Cache) *RecordingCache {
+	return &RecordingCache{Cache: cache}
+}
+
+// Journal returns the operations recorded so far, in the order they were
+// called.
+func (r *RecordingCache) Journal() []Operation {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return append([]Operation(nil), r.journal...)
+}
+
+// Replay calls the journal operations on target, in order. Subscribers are
+// created for the recorded subscriptions. Unsubscribing a subscriber that
+// wasn't subscribed in the journal has no effect.
+func Replay(journal []Operation, target Cache) {
+	subs := make(map[uint64]*subscriber)
+	for _, op := range journal {
+		op.replay(target, subs)
+	}
+}
+
+// record adds op to the journal. The lock must be held until the operation
+// is applied, so the journal order is the order operations are applied in.
+func (r *RecordingCache) record(op Operation) {
+	r.journal = append(r.journal, op)
+}
+
+func (r *RecordingCache) SetEntry(entry *Entry) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	recorded := entry
+	if entry != nil {
+		recorded = copyEntry(entry)
+	}
+	r.record(Operation{
+		Method: "SetEntry",
+		Args:   []interface{}{recorded},
+		replay: func(target Cache, _ map[uint64]*subscriber) {
+			target.SetEntry(recorded)
+		},
+	})
+	return r.Cache.SetEntry(entry)
+}
+
+func (r *RecordingCache) DeleteEntry(regEntry *common.RegistrationEntry) (bool, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	// The whole registration entry is recorded, as caches with a custom key
+	// function may not key entries by ID.
+	recorded := regEntry
+	if regEntry != nil {
+		recorded = copyEntry(&Entry{RegistrationEntry: regEntry}).RegistrationEntry
+	}
+	r.record(Operation{
+		Method: "DeleteEntry",
+		Args:   []interface{}{recorded},
+		replay: func(target Cache, _ map[uint64]*subscriber) {
+			target.DeleteEntry(recorded)
+		},
+	})
+	return r.Cache.DeleteEntry(regEntry)
+}
+
+func (r *RecordingCache) SoftDeleteEntry(entryID string, grace time.Duration) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.record(Operation{
+		Method: "SoftDeleteEntry",
+		Args:   []interface{}{entryID, grace},
+		replay: func(target Cache, _ map[uint64]*subscriber) {
+			target.SoftDeleteEntry(entryID, grace)
+		},
+	})
+	return r.Cache.SoftDeleteEntry(entryID, grace)
+}
+
+func (r *RecordingCache) SweepExpired() int {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.record(Operation{
+		Method: "SweepExpired",
+		replay: func(target Cache, _ map[uint64]*subscriber) {
+			target.SweepExpired()
+		},
+	})
+	return r.Cache.SweepExpired()
+}
+
+func (r *RecordingCache) PopRotated(now time.Time) []*Entry {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.record(Operation{
+		Method: "PopRotated",
+		Args:   []interface{}{now},
+		replay: func(target Cache, _ map[uint64]*subscriber) {
+			target.PopRotated(now)
+		},
+	})
+	return r.Cache.PopRotated(now)
+}
+
+func (r *RecordingCache) Freeze() {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.record(Operation{
+		Method: "Freeze",
+		replay: func(target Cache, _ map[uint64]*subscriber) {
+			target.Freeze()
+		},
+	})
+	r.Cache.Freeze()
+}
+
+func (r *RecordingCache) Unfreeze() {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.record(Operation{
+		Method: "Unfreeze",
+		replay: func(target Cache, _ map[uint64]*subscriber) {
+			target.Unfreeze()
+		},
+	})
+	r.Cache.Unfreeze()
+}
+
+func (r *RecordingCache) Close() {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.record(Operation{
+		Method: "Close",
+		replay: func(target Cache, subs map[uint64]*subscriber) {
+			target.Close()
+			for id := range subs {
+				delete(subs, id)
+			}
+		},
+	})
+	r.Cache.Close()
+}
+
+func (r *RecordingCache) Subscribe(sub *subscriber) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.recordSubscribe("Subscribe", sub)
+	return r.Cache.Subscribe(sub)
+}
+
+// recordSubscribe records the registration of sub by the given method.
+func (r *RecordingCache) recordSubscribe(method string, sub *subscriber) {
+	id, selectors, opts, paused := sub.id, sub.sel, sub.options(), sub.paused
+	r.record(Operation{
+		Method: method,
+		Args:   []interface{}{id, selectors},
+		replay: func(target Cache, subs map[uint64]*subscriber) {
+			subs[id] = NewSubscriber(selectors, opts...)
+			subs[id].paused = paused
+			target.Subscribe(subs[id])
+		},
+	})
+}
+
+func (r *RecordingCache) SubscribeFunc(selectors Selectors, cb func(*WorkloadUpdate)) (func(), error) {
+	sub := NewSubscriber(selectors)
+	sub.callback = cb
+
+	r.m.Lock()
+	r.recordSubscribe("SubscribeFunc", sub)
+	err := r.Cache.Subscribe(sub)
+	r.m.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return func() { r.Unsubscribe(sub) }, nil
+}
+
+func (r *RecordingCache) SubscribeDynamic(ctx context.Context, selCh <-chan Selectors) *subscriber {
+	sub := NewSubscriber(nil)
+	// Hold the updates until the subscriber has selectors.
+	sub.paused = true
+
+	r.m.Lock()
+	r.recordSubscribe("SubscribeDynamic", sub)
+	err := r.Cache.Subscribe(sub)
+	r.m.Unlock()
+	if err != nil {
+		sub.Finish()
+		return sub
+	}
+
+	// The selectors are applied through the recorder so they are recorded.
+	go func() {
+		defer r.Unsubscribe(sub)
+		first := true
+		for {
+			select {
+			case selectors, ok := <-selCh:
+				if !ok {
+					return
+				}
+				if err := r.UpdateSubscription(sub, selectors); err != nil {
+					continue
+				}
+				if first {
+					r.ResumeSubscriber(sub)
+					first = false
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return sub
+}
+
+func (r *RecordingCache) StreamTo(ctx context.Context, sub *subscriber, send func(*WorkloadUpdate) error) error {
+	err := r.Cache.StreamTo(ctx, sub, send)
+
+	// StreamTo unsubscribes the subscriber before returning.
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.recordUnsubscribe(sub.id)
+	return err
+}
+
+func (r *RecordingCache) PauseSubscriber(sub *subscriber) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	id := sub.id
+	r.record(Operation{
+		Method: "PauseSubscriber",
+		Args:   []interface{}{id},
+		replay: func(target Cache, subs map[uint64]*subscriber) {
+			if sub, ok := subs[id]; ok {
+				target.PauseSubscriber(sub)
+			}
+		},
+	})
+	r.Cache.PauseSubscriber(sub)
+}
+
+func (r *RecordingCache) ResumeSubscriber(sub *subscriber) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	id := sub.id
+	r.record(Operation{
+		Method: "ResumeSubscriber",
+		Args:   []interface{}{id},
+		replay: func(target Cache, subs map[uint64]*subscriber) {
+			if sub, ok := subs[id]; ok {
+				target.ResumeSubscriber(sub)
+			}
+		},
+	})
+	r.Cache.ResumeSubscriber(sub)
+}
+
+func (r *RecordingCache) SubscribeAndSnapshot(selectors Selectors) (*WorkloadUpdate, *subscriber, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	update, sub, err := r.Cache.SubscribeAndSnapshot(selectors)
+	// Failed calls don't create a subscriber, which is recorded as ID zero.
+	var id uint64
+	if sub != nil {
+		id = sub.id
+	}
+	r.record(Operation{
+		Method: "SubscribeAndSnapshot",
+		Args:   []interface{}{id, selectors},
+		replay: func(target Cache, subs map[uint64]*subscriber) {
+			if _, sub, err := target.SubscribeAndSnapshot(selectors); err == nil {
+				subs[id] = sub
+			}
+		},
+	})
+	return update, sub, err
+}
+
+func (r *RecordingCache) SubscribeSelectors(selectors Selectors, opts ...SubscribeOption) (*subscriber, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	sub, err := r.Cache.SubscribeSelectors(selectors, opts...)
+	// Failed calls don't create a subscriber, which is recorded as ID zero.
+	var id uint64
+	if sub != nil {
+		id = sub.id
+	}
+	r.record(Operation{
+		Method: "SubscribeSelectors",
+		Args:   []interface{}{id, selectors},
+		replay: func(target Cache, subs map[uint64]*subscriber) {
+			if sub, err := target.SubscribeSelectors(selectors, opts...); err == nil {
+				subs[id] = sub
+			}
+		},
+	})
+	return sub, err
+}
+
+func (r *RecordingCache) SubscribeSPIFFEID(spiffeID string) *subscriber {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	sub := r.Cache.SubscribeSPIFFEID(spiffeID)
+	id := sub.id
+	r.record(Operation{
+		Method: "SubscribeSPIFFEID",
+		Args:   []interface{}{id, spiffeID},
+		replay: func(target Cache, subs map[uint64]*subscriber) {
+			subs[id] = target.SubscribeSPIFFEID(spiffeID)
+		},
+	})
+	return sub
+}
+
+func (r *RecordingCache) UpdateSubscription(sub *subscriber, selectors Selectors) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	id := sub.id
+	r.record(Operation{
+		Method: "UpdateSubscription",
+		Args:   []interface{}{id, selectors},
+		replay: func(target Cache, subs map[uint64]*subscriber) {
+			if sub, ok := subs[id]; ok {
+				target.UpdateSubscription(sub, selectors)
+			}
+		},
+	})
+	return r.Cache.UpdateSubscription(sub, selectors)
+}
+
+func (r *RecordingCache) Unsubscribe(sub *subscriber) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.recordUnsubscribe(sub.id)
+	r.Cache.Unsubscribe(sub)
+}
+
+// recordUnsubscribe records the removal of the subscriber with the given ID.
+func (r *RecordingCache) recordUnsubscribe(id uint64) {
+	r.record(Operation{
+		Method: "Unsubscribe",
+		Args:   []interface{}{id},
+		replay: func(target Cache, subs map[uint64]*subscriber) {
+			if sub, ok := subs[id]; ok {
+				target.Unsubscribe(sub)
+				delete(subs, id)
+			}
+		},
+	})
+}
+
+func (r *RecordingCache) SetBundle(bundle []*x509.Certificate) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	recorded := append([]*x509.Certificate(nil), bundle...)
+	r.record(Operation{
+		Method: "SetBundle",
+		Args:   []interface{}{recorded},
+		replay: func(target Cache, _ map[uint64]*subscriber) {
+			target.SetBundle(recorded)
+		},
+	})
+	return r.Cache.SetBundle(bundle)
+}
+
+func (r *RecordingCache) RemoveBundleRoot(cert *x509.Certificate) bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.record(Operation{
+		Method: "RemoveBundleRoot",
+		Args:   []interface{}{cert},
+		replay: func(target Cache, _ map[uint64]*subscriber) {
+			target.RemoveBundleRoot(cert)
+		},
+	})
+	return r.Cache.RemoveBundleRoot(cert)
+}
+
+func (r *RecordingCache) SetFederatedBundle(trustDomain string, bundle []*x509.Certificate) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	recorded := append([]*x509.Certificate(nil), bundle...)
+	r.record(Operation{
+		Method: "SetFederatedBundle",
+		Args:   []interface{}{trustDomain, recorded},
+		replay: func(target Cache, _ map[uint64]*subscriber) {
+			target.SetFederatedBundle(trustDomain, recorded)
+		},
+	})
+	r.Cache.SetFederatedBundle(trustDomain, bundle)
+}
+
+func (r *RecordingCache) Reset(entries []*Entry, bundle []*x509.Certificate) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	recordedEntries := make([]*Entry, 0, len(entries))
+	for _, entry := range entries {
+		recordedEntries = append(recordedEntries, copyEntry(entry))
+	}
+	recordedBundle := append([]*x509.Certificate(nil), bundle...)
+	r.record(Operation{
+		Method: "Reset",
+		Args:   []interface{}{recordedEntries, recordedBundle},
+		replay: func(target Cache, _ map[uint64]*subscriber) {
+			target.Reset(recordedEntries, recordedBundle)
+		},
+	})
+	r.Cache.Reset(entries, bundle)
+}
+
+func (r *RecordingCache) Reconcile(authoritative []*Entry) ReconcileResult {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	recorded := make([]*Entry, 0, len(authoritative))
+	for _, entry := range authoritative {
+		if entry != nil {
+			recorded = append(recorded, copyEntry(entry))
+		}
+	}
+	r.record(Operation{
+		Method: "Reconcile",
+		Args:   []interface{}{recorded},
+		replay: func(target Cache, _ map[uint64]*subscriber) {
+			target.Reconcile(recorded)
+		},
+	})
+	return r.Cache.Reconcile(authoritative)
+}
+
+func (r *RecordingCache) SetJWTBundle(trustDomain string, keys map[string]crypto.PublicKey) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	recorded := copyJWTKeys(keys)
+	r.record(Operation{
+		Method: "SetJWTBundle",
+		Args:   []interface{}{trustDomain, recorded},
+		replay: func(target Cache, _ map[uint64]*subscriber) {
+			target.SetJWTBundle(trustDomain, recorded)
+		},
+	})
+	r.Cache.SetJWTBundle(trustDomain, keys)
+}
+
+func (r *RecordingCache) SetBundleMetadata(metadata map[string]string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	recorded := copyMetadata(metadata)
+	r.record(Operation{
+		Method: "SetBundleMetadata",
+		Args:   []interface{}{recorded},
+		replay: func(target Cache, _ map[uint64]*subscriber) {
+			target.SetBundleMetadata(recorded)
+		},
+	})
+	r.Cache.SetBundleMetadata(metadata)
+}
+
+func (r *RecordingCache) SetDegraded(degraded bool, reason string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.record(Operation{
+		Method: "SetDegraded",
+		Args:   []interface{}{degraded, reason},
+		replay: func(target Cache, _ map[uint64]*subscriber) {
+			target.SetDegraded(degraded, reason)
+		},
+	})
+	r.Cache.SetDegraded(degraded, reason)
+}
+
+func (r *RecordingCache) SetBootstrapComplete() {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.record(Operation{
+		Method: "SetBootstrapComplete",
+		replay: func(target Cache, _ map[uint64]*subscriber) {
+			target.SetBootstrapComplete()
+		},
+	})
+	r.Cache.SetBootstrapComplete()
+}
+
+func (r *RecordingCache) SetSelectorNormalizer(normalizer func(*common.Selector) *common.Selector) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.record(Operation{
+		Method: "SetSelectorNormalizer",
+		Args:   []interface{}{normalizer},
+		replay: func(target Cache, _ map[uint64]*subscriber) {
+			target.SetSelectorNormalizer(normalizer)
+		},
+	})
+	r.Cache.SetSelectorNormalizer(normalizer)
+}
+
+func (r *RecordingCache) SetInsertPolicy(policy func(*Entry) error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.record(Operation{
+		Method: "SetInsertPolicy",
+		Args:   []interface{}{policy},
+		replay: func(target Cache, _ map[uint64]*subscriber) {
+			target.SetInsertPolicy(policy)
+		},
+	})
+	r.Cache.SetInsertPolicy(policy)
+}
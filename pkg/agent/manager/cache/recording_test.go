@@ -0,0 +1,166 @@
+package cache
+
+import (
+	"context"
+	"crypto/x509"
+	"testing"
+
+	"github.com/spiffe/spire/proto/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordingCache(t *testing.T) {
+	recorder := NewRecordingCache(New(logger, nil))
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+	newEntry := func(id string) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: selectors,
+				ParentId:  "spiffe:parent",
+				SpiffeId:  "spiffe:test" + id,
+				EntryId:   id,
+			},
+		}
+	}
+	root := &x509.Certificate{Raw: []byte("root1")}
+
+	e1 := newEntry("1")
+	recorder.SetEntry(e1)
+	recorder.SetEntry(newEntry("2"))
+	sub := NewSubscriber(selectors)
+	recorder.Subscribe(sub)
+	recorder.SetBundle([]*x509.Certificate{root})
+	recorder.DeleteEntry(e1.RegistrationEntry)
+	recorder.SetDegraded(true, "server unreachable")
+	recorder.Unsubscribe(sub)
+	// Calls that don't modify the cache are not recorded.
+	recorder.Entries()
+	recorder.Bundle()
+
+	// Modifying the arguments after the call doesn't affect the journal.
+	e1.RegistrationEntry.SpiffeId = "spiffe:modified"
+
+	journal := recorder.Journal()
+	methods := []string{}
+	for _, op := range journal {
+		methods = append(methods, op.Method)
+	}
+	assert.Equal(t, []string{
+		"SetEntry",
+		"SetEntry",
+		"Subscribe",
+		"SetBundle",
+		"DeleteEntry",
+		"SetDegraded",
+		"Unsubscribe",
+	}, methods)
+	assert.Equal(t, []interface{}{newEntry("1")}, journal[0].Args)
+	assert.Equal(t, []interface{}{sub.ID(), selectors}, journal[2].Args)
+	assert.Equal(t, []interface{}{[]*x509.Certificate{root}}, journal[3].Args)
+	assert.Equal(t, []interface{}{newEntry("1").RegistrationEntry}, journal[4].Args)
+	assert.Equal(t, []interface{}{true, "server unreachable"}, journal[5].Args)
+
+	// Replaying the journal reproduces the same state.
+	target := New(logger, nil)
+	Replay(journal, target)
+	expected, expectedSub, err := recorder.SubscribeAndSnapshot(selectors)
+	require.NoError(t, err)
+	defer recorder.Unsubscribe(expectedSub)
+	actual, actualSub, err := target.SubscribeAndSnapshot(selectors)
+	require.NoError(t, err)
+	defer target.Unsubscribe(actualSub)
+	assert.Equal(t, expected, actual)
+	assert.Equal(t, []*Entry{deliveredEntry(newEntry("2"), 1)}, actual.Entries)
+	assert.NoError(t, target.checkInvariants())
+}
+
+func TestRecordingCacheKeyFunc(t *testing.T) {
+	keyFunc := func(e *Entry) string {
+		return e.RegistrationEntry.SpiffeId
+	}
+	recorder := NewRecordingCache(New(logger, nil, WithKeyFunc(keyFunc)))
+	newEntry := func(spiffeID string) *Entry {
+		return &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}},
+				SpiffeId:  spiffeID,
+				EntryId:   "1",
+			},
+		}
+	}
+	require.NoError(t, recorder.SetEntry(newEntry("spiffe:foo")))
+	require.NoError(t, recorder.SetEntry(newEntry("spiffe:bar")))
+	deleted, err := recorder.DeleteEntry(newEntry("spiffe:bar").RegistrationEntry)
+	require.NoError(t, err)
+	assert.True(t, deleted)
+
+	// Deletions are replayed with the recorded registration entry, so the
+	// target looks up the entry by the same key.
+	target := New(logger, nil, WithKeyFunc(keyFunc))
+	Replay(recorder.Journal(), target)
+	assert.Len(t, target.Entries(), 1)
+	assert.NotNil(t, target.Entry(newEntry("spiffe:foo").RegistrationEntry))
+	assert.Nil(t, target.Entry(newEntry("spiffe:bar").RegistrationEntry))
+}
+
+func TestRecordingCacheSubscribers(t *testing.T) {
+	recorder := NewRecordingCache(New(logger, nil))
+	selectors := Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}}
+
+	sub := NewSubscriber(selectors, WithDeltaUpdates(), WithUpdateFields(WantEntries))
+	require.NoError(t, recorder.Subscribe(sub))
+	recorder.PauseSubscriber(sub)
+	cancel, err := recorder.SubscribeFunc(selectors, func(*WorkloadUpdate) {})
+	require.NoError(t, err)
+	cancel()
+
+	// Dynamic subscribers are recorded with the selectors they receive, and
+	// unsubscribed once the channel is closed.
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+	selCh := make(chan Selectors)
+	dynamic := recorder.SubscribeDynamic(ctx, selCh)
+	selCh <- selectors
+	<-dynamic.Updates()
+	close(selCh)
+	for range dynamic.Updates() {
+	}
+
+	// Streamed subscribers are unsubscribed once streaming ends.
+	streamed := NewSubscriber(selectors)
+	require.NoError(t, recorder.Subscribe(streamed))
+	streamCtx, cancelStream := context.WithCancel(context.Background())
+	cancelStream()
+	assert.Equal(t, context.Canceled, recorder.StreamTo(streamCtx, streamed, func(*WorkloadUpdate) error {
+		return nil
+	}))
+
+	journal := recorder.Journal()
+	methods := []string{}
+	for _, op := range journal {
+		methods = append(methods, op.Method)
+	}
+	assert.Equal(t, []string{
+		"Subscribe",
+		"PauseSubscriber",
+		"SubscribeFunc",
+		"Unsubscribe",
+		"SubscribeDynamic",
+		"UpdateSubscription",
+		"ResumeSubscriber",
+		"Unsubscribe",
+		"Subscribe",
+		"Unsubscribe",
+	}, methods)
+
+	// The remaining subscriber is replayed with its options and pause state.
+	target := New(logger, nil)
+	Replay(journal, target)
+	subs := target.subscribers.getAll()
+	require.Len(t, subs, 1)
+	assert.True(t, subs[0].delta)
+	assert.Equal(t, WantEntries, subs[0].fields)
+	assert.True(t, subs[0].paused)
+	assert.Equal(t, len(sub.Updates()), len(subs[0].Updates()))
+}
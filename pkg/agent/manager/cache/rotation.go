@@ -0,0 +1,146 @@
+package cache
+
+import (
+	"container/heap"
+	"fmt"
+	"time"
+)
+
+// rotationItem is the rotation time of the SVID of the entry stored under
+// key.
+type rotationItem struct {
+	key   string
+	at    time.Time
+	index int
+}
+
+// rotationQueue is a min-heap of the entries with an SVID, ordered by
+// rotation time and then by key.
+type rotationQueue struct {
+	items []*rotationItem
+	byKey map[string]*rotationItem
+}
+
+func newRotationQueue() *rotationQueue {
+	return &rotationQueue{byKey: make(map[string]*rotationItem)}
+}
+
+func (q *rotationQueue) Len() int { return len(q.items) }
+
+func (q *rotationQueue) Less(i, j int) bool {
+	a, b := q.items[i], q.items[j]
+	if !a.at.Equal(b.at) {
+		return a.at.Before(b.at)
+	}
+	return a.key < b.key
+}
+
+func (q *rotationQueue) Swap(i, j int) {
+	q.items[i], q.items[j] = q.items[j], q.items[i]
+	q.items[i].index = i
+	q.items[j].index = j
+}
+
+func (q *rotationQueue) Push(x interface{}) {
+	item := x.(*rotationItem)
+	item.index = len(q.items)
+	q.items = append(q.items, item)
+	q.byKey[item.key] = item
+}
+
+func (q *rotationQueue) Pop() interface{} {
+	n := len(q.items)
+	item := q.items[n-1]
+	q.items[n-1] = nil
+	q.items = q.items[:n-1]
+	delete(q.byKey, item.key)
+	return item
+}
+
+// set schedules the rotation of the entry stored under key at the given time,
+// replacing its current schedule if any.
+func (q *rotationQueue) set(key string, at time.Time) {
+	if item, ok := q.byKey[key]; ok {
+		item.at = at
+		heap.Fix(q, item.index)
+		return
+	}
+	heap.Push(q, &rotationItem{key: key, at: at})
+}
+
+// remove unschedules the rotation of the entry stored under key.
+func (q *rotationQueue) remove(key string) {
+	if item, ok := q.byKey[key]; ok {
+		heap.Remove(q, item.index)
+	}
+}
+
+// peek returns the earliest scheduled rotation, and false if there is none.
+func (q *rotationQueue) peek() (*rotationItem, bool) {
+	if len(q.items) == 0 {
+		return nil, false
+	}
+	return q.items[0], true
+}
+
+// checkInvariants checks that the queue is a heap agreeing with its key
+// index, and that it only schedules entries of cache with an SVID, at their
+// rotation time. Popped entries are not scheduled until they are set again.
+func (q *rotationQueue) checkInvariants(cache map[string]*Entry, threshold time.Duration) error {
+	if len(q.byKey) != len(q.items) {
+		return fmt.Errorf("rotation queue holds %d items but indexes %d", len(q.items), len(q.byKey))
+	}
+	for i, item := range q.items {
+		if item.index != i {
+			return fmt.Errorf("rotation of entry %q is at index %d, expected %d", item.key, item.index, i)
+		}
+		if q.byKey[item.key] != item {
+			return fmt.Errorf("rotation of entry %q is not indexed", item.key)
+		}
+		if i > 0 && q.Less(i, (i-1)/2) {
+			return fmt.Errorf("rotation of entry %q is scheduled before its parent", item.key)
+		}
+		entry, ok := cache[item.key]
+		if !ok || entry.SVID == nil {
+			return fmt.Errorf("rotation of entry %q is scheduled without SVID", item.key)
+		}
+		if at := entry.RotationTime(threshold); !item.at.Equal(at) {
+			return fmt.Errorf("rotation of entry %q is scheduled at %v, expected %v", item.key, item.at, at)
+		}
+	}
+	return nil
+}
+
+// scheduleRotation schedules the rotation of the SVID of the entry stored
+// under key, if it has one. Must be called with the cache lock held.
+func (c *cacheImpl) scheduleRotation(key string, entry *Entry) {
+	if entry.SVID == nil {
+		c.rotations.remove(key)
+		return
+	}
+	c.rotations.set(key, entry.RotationTime(c.rotationThreshold))
+}
+
+func (c *cacheImpl) PeekNextRotation() (*Entry, time.Time, bool) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	item, ok := c.rotations.peek()
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	return c.cache[item.key], item.at, true
+}
+
+func (c *cacheImpl) PopRotated(now time.Time) []*Entry {
+	c.m.Lock()
+	defer c.m.Unlock()
+	var entries []*Entry
+	for {
+		item, ok := c.rotations.peek()
+		if !ok || item.at.After(now) {
+			return entries
+		}
+		heap.Pop(c.rotations)
+		entries = append(entries, c.cache[item.key])
+	}
+}
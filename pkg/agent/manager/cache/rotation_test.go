@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/spiffe/spire/proto/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotationSchedule(t *testing.T) {
+	cache := New(logger, nil, WithRotationThreshold(time.Minute))
+	_, _, ok := cache.PeekNextRotation()
+	assert.False(t, ok)
+
+	now := time.Now()
+	newEntry := func(id string, lifetime time.Duration, threshold float64) *Entry {
+		entry := &Entry{
+			RegistrationEntry: &common.RegistrationEntry{
+				Selectors: Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}},
+				SpiffeId:  "spiffe://example.org/" + id,
+				EntryId:   id,
+			},
+			RotationThreshold: threshold,
+		}
+		if lifetime > 0 {
+			entry.SVID = &x509.Certificate{NotBefore: now, NotAfter: now.Add(lifetime)}
+		}
+		return entry
+	}
+	// The IDs of the popped entries, in rotation order.
+	poppedIDs := func(entries []*Entry) []string {
+		ids := []string{}
+		for _, e := range entries {
+			ids = append(ids, e.RegistrationEntry.EntryId)
+		}
+		return ids
+	}
+	requireNext := func(id string, at time.Time) {
+		entry, next, ok := cache.PeekNextRotation()
+		require.True(t, ok)
+		assert.Equal(t, id, entry.RegistrationEntry.EntryId)
+		assert.Equal(t, at, next)
+	}
+
+	// Entries without SVID are not scheduled.
+	require.NoError(t, cache.SetEntry(newEntry("none", 0, 0)))
+	_, _, ok = cache.PeekNextRotation()
+	assert.False(t, ok)
+
+	// Rotated a minute before expiring, in 59 minutes.
+	require.NoError(t, cache.SetEntry(newEntry("1", time.Hour, 0)))
+	requireNext("1", now.Add(59*time.Minute))
+	// Rotated at 50% of its lifetime, in 30 minutes.
+	require.NoError(t, cache.SetEntry(newEntry("2", time.Hour, 0.5)))
+	requireNext("2", now.Add(30*time.Minute))
+	require.NoError(t, cache.SetEntry(newEntry("3", 2*time.Hour, 0)))
+	requireNext("2", now.Add(30*time.Minute))
+
+	// Updating an entry reschedules it.
+	require.NoError(t, cache.SetEntry(newEntry("3", 10*time.Minute, 0)))
+	requireNext("3", now.Add(9*time.Minute))
+	require.NoError(t, cache.SetEntry(newEntry("3", 3*time.Hour, 0)))
+	requireNext("2", now.Add(30*time.Minute))
+
+	// Deleting an entry unschedules it.
+	deleted, err := cache.DeleteEntry(newEntry("2", 0, 0).RegistrationEntry)
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	requireNext("1", now.Add(59*time.Minute))
+	require.NoError(t, cache.SetEntry(newEntry("2", time.Hour, 0.5)))
+
+	assert.Empty(t, cache.PopRotated(now))
+	assert.Equal(t, []string{"2", "1"}, poppedIDs(cache.PopRotated(now.Add(time.Hour))))
+	requireNext("3", now.Add(179*time.Minute))
+
+	// Popped entries are scheduled again when set.
+	require.NoError(t, cache.SetEntry(newEntry("1", 2*time.Hour, 0)))
+	assert.Equal(t, []string{"1", "3"}, poppedIDs(cache.PopRotated(now.Add(3*time.Hour))))
+	_, _, ok = cache.PeekNextRotation()
+	assert.False(t, ok)
+}
+
+func TestRotationScheduleReset(t *testing.T) {
+	cache := New(logger, nil)
+	now := time.Now()
+	entry := &Entry{
+		RegistrationEntry: &common.RegistrationEntry{
+			Selectors: Selectors{&common.Selector{Type: "unix", Value: "uid:1111"}},
+			EntryId:   "1",
+		},
+		SVID: &x509.Certificate{NotAfter: now.Add(time.Hour)},
+	}
+	require.NoError(t, cache.SetEntry(entry))
+
+	cache.Reset(nil, nil)
+	_, _, ok := cache.PeekNextRotation()
+	assert.False(t, ok)
+
+	cache.Reset([]*Entry{entry}, nil)
+	_, next, ok := cache.PeekNextRotation()
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(time.Hour), next)
+}
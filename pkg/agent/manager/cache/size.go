@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+
+	"github.com/spiffe/spire/proto/common"
+)
+
+func (c *cacheImpl) EstimatedSizeBytes() int64 {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	var size int64
+	for key, entry := range c.cache {
+		size += int64(len(key)) + entrySize(entry)
+	}
+	size += certsSize(c.bundle)
+	for td, bundle := range c.federatedBundles {
+		size += int64(len(td)) + certsSize(bundle)
+	}
+	for td, keys := range c.jwtBundles {
+		size += int64(len(td))
+		for kid, key := range keys {
+			size += int64(len(kid))
+			if der, err := x509.MarshalPKIXPublicKey(key); err == nil {
+				size += int64(len(der))
+			}
+		}
+	}
+	return size
+}
+
+// entrySize returns an estimate of the bytes held by the entry.
+func entrySize(e *Entry) int64 {
+	size := regEntrySize(e.RegistrationEntry)
+	if e.SVID != nil {
+		size += int64(len(e.SVID.Raw))
+	}
+	size += privateKeySize(e.PrivateKey)
+	for id, bundle := range e.Bundles {
+		size += int64(len(id) + len(bundle))
+	}
+	for _, td := range e.FederatesWith {
+		size += int64(len(td))
+	}
+	size += int64(len(e.IssuerKeyID) + len(e.IssuerDN))
+	return size
+}
+
+// regEntrySize returns an estimate of the bytes held by the registration
+// entry strings.
+func regEntrySize(regEntry *common.RegistrationEntry) int64 {
+	if regEntry == nil {
+		return 0
+	}
+	size := int64(len(regEntry.EntryId) + len(regEntry.SpiffeId) + len(regEntry.ParentId))
+	for _, s := range regEntry.Selectors {
+		size += int64(len(s.Type) + len(s.Value))
+	}
+	for _, id := range regEntry.FbSpiffeIds {
+		size += int64(len(id))
+	}
+	return size
+}
+
+// privateKeySize returns the size of the private scalar and the public point
+// coordinates of the key.
+func privateKeySize(key *ecdsa.PrivateKey) int64 {
+	if key == nil || key.Curve == nil {
+		return 0
+	}
+	return int64((key.Curve.Params().BitSize+7)/8) * 3
+}
+
+func certsSize(certs []*x509.Certificate) int64 {
+	var size int64
+	for _, cert := range certs {
+		size += int64(len(cert.Raw))
+	}
+	return size
+}
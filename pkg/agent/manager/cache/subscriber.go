@@ -1,49 +1,272 @@
 package cache
 
 import (
+	"crypto"
 	"crypto/x509"
+	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/satori/go.uuid"
 	"github.com/spiffe/spire/pkg/common/selector"
 )
 
+// lastSubscriberID holds the last ID assigned to a subscriber. It must only
+// be accessed atomically.
+var lastSubscriberID uint64
+
 type Subscriber interface {
 	Updates() <-chan *WorkloadUpdate
 	Finish()
 }
 
 type WorkloadUpdate struct {
+	// TrustDomain is the trust domain the update pertains to, if the cache
+	// was created with WithTrustDomain.
+	TrustDomain string
+
 	Entries []*Entry
-	Bundle  []*x509.Certificate
+	// Bundle is shared with the cache and the other updates, like the
+	// bundle returned by Cache.Bundle, and must not be modified. Appending
+	// to it reallocates.
+	Bundle []*x509.Certificate
+
+	// SVIDPEM and BundlePEM hold the SVIDs of Entries and the Bundle roots
+	// as concatenated PEM blocks, in the same order. They are only set for
+	// subscribers created with WithPEM. BundlePEM is shared and must not be
+	// modified.
+	SVIDPEM   []byte
+	BundlePEM []byte
+
+	// FederatedBundles holds the bundle of every federated trust domain,
+	// keyed by trust domain.
+	FederatedBundles map[string][]*x509.Certificate
+
+	// RefreshHints holds, for every federated trust domain the update
+	// entries federate with, the time its bundle should be refreshed by,
+	// which is when its first root expires.
+	RefreshHints map[string]time.Time
+
+	// BundleMetadata holds the bundle attributes set with SetBundleMetadata.
+	BundleMetadata map[string]string
+
+	// JWTBundles holds the JWT signing keys, keyed by key ID, for every
+	// trust domain with a JWT bundle.
+	JWTBundles map[string]map[string]crypto.PublicKey
+
+	// Stale is true when the cache is degraded and its data may be out of
+	// date, StaleReason tells why.
+	Stale       bool
+	StaleReason string
+
+	// Bootstrapped is true once the initial sync of the cache is finished.
+	// Until then, missing entries may not have been synced yet.
+	Bootstrapped bool
+
+	// Epoch identifies the content of the update. Updates with the same
+	// entries, bundles, staleness and bootstrap state have the same epoch,
+	// once the fields the subscriber doesn't want are left out. Delta updates
+	// have the epoch of the whole content they bring the subscriber to.
+	Epoch uint64
+
+	// Delta is true for the updates sent to delta subscribers after the
+	// first one. Entries is then empty, and the changes since the last update
+	// the subscriber received are reported in AddedEntries, ChangedEntries
+	// and RemovedEntryIDs, sorted by entry ID. RemovedEntryIDs holds the
+	// cache keys of the removed entries, their IDs by default.
+	Delta           bool
+	AddedEntries    []*Entry
+	ChangedEntries  []*Entry
+	RemovedEntryIDs []string
+}
+
+// WorkloadUpdateView is a copy of an update sent to a subscriber, without the
+// entries' private keys.
+type WorkloadUpdateView struct {
+	WorkloadUpdate
+	// SentAt is the time the update was sent.
+	SentAt time.Time
+}
+
+// UpdateFields is a set of WorkloadUpdate fields.
+type UpdateFields int
+
+const (
+	// WantEntries covers the entries, including the delta fields.
+	WantEntries UpdateFields = 1 << iota
+	// WantBundle covers the bundle and its metadata.
+	WantBundle
+	// WantFederatedBundles covers the federated bundles and their refresh
+	// hints.
+	WantFederatedBundles
+)
+
+// SubscribeOption configures optional subscriber behavior.
+type SubscribeOption func(*subscriber)
+
+// WithDeltaUpdates makes the subscriber receive only the changes since the
+// last update it received, instead of all its entries on every update.
+func WithDeltaUpdates() SubscribeOption {
+	return func(sub *subscriber) {
+		sub.delta = true
+	}
+}
+
+// WithExpiryOnly makes the subscriber be notified only when the expiration of
+// its entries' SVIDs changes, i.e. when entries with an SVID are added or
+// removed or their SVID is rotated. The first update is always sent.
+func WithExpiryOnly() SubscribeOption {
+	return func(sub *subscriber) {
+		sub.expiryOnly = true
+	}
+}
+
+// WithExpirySort makes the subscriber receive the update entries sorted by
+// SVID expiration, the first to expire first. Entries without an SVID are
+// sorted last. By default entries are sorted by entry ID.
+func WithExpirySort() SubscribeOption {
+	return func(sub *subscriber) {
+		sub.expirySort = true
+	}
+}
+
+// WithLastGoodBundle makes the subscriber receive the last non-empty bundle it
+// was sent instead of an empty bundle, so it keeps running on the last good
+// bundle while the cache bundle is empty. By default the empty bundle is
+// delivered.
+func WithLastGoodBundle() SubscribeOption {
+	return func(sub *subscriber) {
+		sub.keepBundle = true
+	}
+}
+
+// WithPEM makes the subscriber receive updates with the SVIDs and the bundle
+// also encoded as PEM, in SVIDPEM and BundlePEM. The encodings are kept until
+// the certificates change. By default updates don't carry them.
+func WithPEM() SubscribeOption {
+	return func(sub *subscriber) {
+		sub.pem = true
+	}
+}
+
+// WithMaxSVIDAge makes the subscriber receive only the entries without an SVID
+// or with an SVID issued at most maxAge ago, according to the cache clock. By
+// default entries are delivered regardless of the age of their SVID.
+func WithMaxSVIDAge(maxAge time.Duration) SubscribeOption {
+	return func(sub *subscriber) {
+		sub.maxSVIDAge = maxAge
+	}
+}
+
+// WithUpdateFields makes the subscriber receive updates populating only the
+// given fields, leaving the others empty. By default all the fields are
+// populated.
+func WithUpdateFields(fields UpdateFields) SubscribeOption {
+	return func(sub *subscriber) {
+		sub.fields = fields
+	}
 }
 
 type subscriber struct {
 	c      chan *WorkloadUpdate
 	m      sync.Mutex
 	sel    Selectors
-	sid    uuid.UUID
+	id     uint64
 	active bool
+	// Whether updates are held until the subscriber is resumed.
+	paused bool
+	// Version of the cache state last sent to the subscriber.
+	version uint64
+	// callback, if set, is called with the updates instead of sending them
+	// on the channel.
+	callback func(*WorkloadUpdate)
+	// Last update sent to the subscriber, if any.
+	lastUpdate *WorkloadUpdate
+	// Ring of the last updates sent to the subscriber, the oldest at
+	// historyNext once the ring is full.
+	history     []WorkloadUpdateView
+	historyNext int
+
+	// SPIFFE ID of the entries sent to the subscriber, which then ignores
+	// its selectors, or empty to match entries by selectors.
+	spiffeID string
+
+	delta bool
+	// Entries, keyed by entry ID, in the last update sent to the subscriber
+	// and in the last update known to be received by it.
+	sentEntries     map[string]*Entry
+	receivedEntries map[string]*Entry
+
+	expiryOnly bool
+	expirySort bool
+	// Fields populated in the updates, or zero for all of them.
+	fields UpdateFields
+	// Maximum age of the delivered SVIDs, or zero for any age.
+	maxSVIDAge time.Duration
+	// Last non-empty bundle sent to the subscriber, kept when keepBundle is
+	// set.
+	keepBundle bool
+	lastBundle []*x509.Certificate
+	// Whether updates carry the PEM encoding of the SVIDs and the bundle.
+	pem bool
+	// SVID expiration, keyed by entry ID, of the entries in the last update
+	// sent to the subscriber. Nil until an update is sent.
+	sentExpiries map[string]time.Time
 }
 
 type subscribers struct {
-	selMap map[string][]uuid.UUID // map of selector to UID
-	sidMap map[uuid.UUID]*subscriber
+	selMap map[string][]uint64 // map of selector to subscriber ID
+	sidMap map[uint64]*subscriber
+	idMap  map[string][]uint64 // map of SPIFFE ID to subscriber ID
 	m      sync.Mutex
 }
 
-func NewSubscriber(selectors Selectors) (*subscriber, error) {
-	id, err := uuid.NewV4()
-	if err != nil {
-		return nil, err
-	}
-
-	return &subscriber{
+func NewSubscriber(selectors Selectors, opts ...SubscribeOption) *subscriber {
+	sub := &subscriber{
 		c:      make(chan *WorkloadUpdate, 1),
 		sel:    selectors,
-		sid:    id,
+		id:     atomic.AddUint64(&lastSubscriberID, 1),
 		active: true,
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(sub)
+	}
+	return sub
+}
+
+// options returns the options reproducing the delivery behavior of the
+// subscriber.
+func (sub *subscriber) options() []SubscribeOption {
+	var opts []SubscribeOption
+	if sub.delta {
+		opts = append(opts, WithDeltaUpdates())
+	}
+	if sub.expiryOnly {
+		opts = append(opts, WithExpiryOnly())
+	}
+	if sub.expirySort {
+		opts = append(opts, WithExpirySort())
+	}
+	if sub.keepBundle {
+		opts = append(opts, WithLastGoodBundle())
+	}
+	if sub.pem {
+		opts = append(opts, WithPEM())
+	}
+	if sub.maxSVIDAge != 0 {
+		opts = append(opts, WithMaxSVIDAge(sub.maxSVIDAge))
+	}
+	if sub.fields != 0 {
+		opts = append(opts, WithUpdateFields(sub.fields))
+	}
+	return opts
+}
+
+// ID returns the subscriber's unique ID. IDs are assigned in increasing
+// order when subscribers are created and never change.
+func (sub *subscriber) ID() uint64 {
+	return sub.id
 }
 
 // Updates is the channel where the updates are received.
@@ -57,27 +280,230 @@ func (sub *subscriber) Updates() <-chan *WorkloadUpdate {
 }
 
 // Finish finishes subscriber's updates subscription. Hence no more updates
-// will be received on Updates() channel.
+// will be received on Updates() channel. Calling Finish more than once
+// has no effect.
 func (sub *subscriber) Finish() {
 	sub.m.Lock()
 	defer sub.m.Unlock()
+	if !sub.active {
+		return
+	}
 	sub.active = false
 	close(sub.c)
 }
 
+// setDelta turns update into a delta against the last update received by the
+// subscriber, matching entries by keyFunc. received tells whether the last
+// update sent was received. Until the subscriber receives an update, updates
+// hold all its entries. Must be called with the subscriber lock held.
+func (sub *subscriber) setDelta(update *WorkloadUpdate, received bool, keyFunc func(*Entry) string) {
+	if received && sub.sentEntries != nil {
+		sub.receivedEntries = sub.sentEntries
+	}
+
+	current := make(map[string]*Entry, len(update.Entries))
+	for _, e := range update.Entries {
+		current[keyFunc(e)] = e
+	}
+	sub.sentEntries = current
+	if sub.receivedEntries == nil {
+		return
+	}
+
+	update.Delta = true
+	update.Entries = nil
+	for id, e := range current {
+		previous, ok := sub.receivedEntries[id]
+		switch {
+		case !ok:
+			update.AddedEntries = append(update.AddedEntries, e)
+		case !previous.Equal(e):
+			update.ChangedEntries = append(update.ChangedEntries, e)
+		}
+	}
+	for id := range sub.receivedEntries {
+		if _, ok := current[id]; !ok {
+			update.RemovedEntryIDs = append(update.RemovedEntryIDs, id)
+		}
+	}
+	sortEntries(update.AddedEntries)
+	sortEntries(update.ChangedEntries)
+	sort.Strings(update.RemovedEntryIDs)
+}
+
+// freshEntries returns the entries whose SVID isn't older than the subscriber
+// allows at the given time.
+func (sub *subscriber) freshEntries(entries []*Entry, now time.Time) []*Entry {
+	if sub.maxSVIDAge <= 0 {
+		return entries
+	}
+	oldest := now.Add(-sub.maxSVIDAge)
+	var fresh []*Entry
+	for _, e := range entries {
+		if e.SVID == nil || !e.SVID.NotBefore.Before(oldest) {
+			fresh = append(fresh, e)
+		}
+	}
+	return fresh
+}
+
+// matchKey returns a key identifying the entries the subscriber matches,
+// which are the same for subscribers with the same key.
+func (sub *subscriber) matchKey() string {
+	if sub.spiffeID != "" {
+		return "\x00spiffe_id:" + sub.spiffeID
+	}
+	return selectorsKey(sub.sel)
+}
+
+// wants returns true if the subscriber's updates populate the given fields.
+func (sub *subscriber) wants(fields UpdateFields) bool {
+	return sub.fields == 0 || sub.fields&fields == fields
+}
+
+// keepLastBundle replaces an empty update bundle with the last non-empty one
+// sent to the subscriber, if it keeps it.
+func (sub *subscriber) keepLastBundle(update *WorkloadUpdate) {
+	if !sub.keepBundle {
+		return
+	}
+	if len(update.Bundle) == 0 {
+		update.Bundle = sub.lastBundle
+	} else {
+		sub.lastBundle = update.Bundle
+	}
+}
+
+// filterFields empties the update fields not wanted by the subscriber.
+func (sub *subscriber) filterFields(update *WorkloadUpdate) {
+	if !sub.wants(WantEntries) {
+		update.Entries = nil
+		update.AddedEntries = nil
+		update.ChangedEntries = nil
+		update.RemovedEntryIDs = nil
+	}
+	if !sub.wants(WantBundle) {
+		update.Bundle = nil
+		update.BundleMetadata = nil
+	}
+	if !sub.wants(WantFederatedBundles) {
+		update.FederatedBundles = nil
+		update.RefreshHints = nil
+	}
+}
+
+// recordDelivery adds the update to the history ring, replacing the oldest
+// update once size updates are recorded. Must be called with the subscriber
+// lock held.
+func (sub *subscriber) recordDelivery(update *WorkloadUpdate, sentAt time.Time, size int) {
+	view := WorkloadUpdateView{WorkloadUpdate: *update, SentAt: sentAt}
+	view.Entries = withoutPrivateKeys(update.Entries)
+	view.AddedEntries = withoutPrivateKeys(update.AddedEntries)
+	view.ChangedEntries = withoutPrivateKeys(update.ChangedEntries)
+
+	if len(sub.history) < size {
+		sub.history = append(sub.history, view)
+		return
+	}
+	sub.history[sub.historyNext] = view
+	sub.historyNext = (sub.historyNext + 1) % size
+}
+
+// deliveryHistory returns the recorded updates, the oldest first. Must be
+// called with the subscriber lock held.
+func (sub *subscriber) deliveryHistory() []WorkloadUpdateView {
+	history := make([]WorkloadUpdateView, 0, len(sub.history))
+	history = append(history, sub.history[sub.historyNext:]...)
+	return append(history, sub.history[:sub.historyNext]...)
+}
+
+func withoutPrivateKeys(entries []*Entry) []*Entry {
+	if entries == nil {
+		return nil
+	}
+	stripped := make([]*Entry, 0, len(entries))
+	for _, e := range entries {
+		c := *e
+		c.PrivateKey = nil
+		stripped = append(stripped, &c)
+	}
+	return stripped
+}
+
+// expiryChanged returns true if the expiration of the SVIDs of entries differs
+// from the one in the last update sent, recording it as sent. Entries are
+// matched by keyFunc. Must be called with the subscriber lock held.
+func (sub *subscriber) expiryChanged(entries []*Entry, keyFunc func(*Entry) string) bool {
+	expiries := make(map[string]time.Time)
+	for _, e := range entries {
+		if e.SVID != nil {
+			expiries[keyFunc(e)] = e.SVID.NotAfter
+		}
+	}
+
+	changed := sub.sentExpiries == nil || len(expiries) != len(sub.sentExpiries)
+	for id, notAfter := range expiries {
+		if sent, ok := sub.sentExpiries[id]; !ok || !sent.Equal(notAfter) {
+			changed = true
+		}
+	}
+	sub.sentExpiries = expiries
+	return changed
+}
+
 func (s *subscribers) add(sub *subscriber) error {
 	s.m.Lock()
 	defer s.m.Unlock()
-	s.sidMap[sub.sid] = sub
+	s.sidMap[sub.id] = sub
+	s.index(sub)
+	if sub.spiffeID != "" {
+		s.idMap[sub.spiffeID] = append(s.idMap[sub.spiffeID], sub.id)
+	}
+	return nil
+}
 
+// setSelectors replaces the selectors of the subscriber, indexing it under the
+// new ones. Returns false, without replacing them, if the subscriber is not
+// registered. The subscriber lock must be held.
+func (s *subscribers) setSelectors(sub *subscriber, selectors Selectors) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, ok := s.sidMap[sub.id]; !ok {
+		return false
+	}
+	s.unindex(sub)
+	sub.sel = selectors
+	s.index(sub)
+	return true
+}
+
+// index indexes the subscriber under every subset of its selectors. Must be
+// called with the subscribers lock held.
+func (s *subscribers) index(sub *subscriber) {
 	selSet := selector.NewSetFromRaw(sub.sel)
 	selPSet := selSet.Power()
 	for sel := range selPSet {
-		selStr := sel.String()
-		s.selMap[selStr] = append(s.selMap[selStr], sub.sid)
+		selStr := selectorsKey(sel.Raw())
+		s.selMap[selStr] = append(s.selMap[selStr], sub.id)
 	}
+}
 
-	return nil
+// unindex removes the subscriber from the selector index. Must be called
+// with the subscribers lock held.
+func (s *subscribers) unindex(sub *subscriber) {
+	for sel, sids := range s.selMap {
+		for i, id := range sids {
+			if id == sub.id {
+				sids = append(sids[:i], sids[i+1:]...)
+				break
+			}
+		}
+		if len(sids) == 0 {
+			delete(s.selMap, sel)
+		} else {
+			s.selMap[sel] = sids
+		}
+	}
 }
 
 func (s *subscribers) get(sels Selectors) (subs []*subscriber) {
@@ -90,6 +516,29 @@ func (s *subscribers) get(sels Selectors) (subs []*subscriber) {
 	return
 }
 
+// getBySPIFFEID returns the subscribers for the entries with the given SPIFFE
+// ID.
+func (s *subscribers) getBySPIFFEID(spiffeID string) (subs []*subscriber) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, id := range s.idMap[spiffeID] {
+		subs = append(subs, s.sidMap[id])
+	}
+	return
+}
+
+func (s *subscribers) getByID(id uint64) *subscriber {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.sidMap[id]
+}
+
+func (s *subscribers) count() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return len(s.sidMap)
+}
+
 func (s *subscribers) getAll() (subs []*subscriber) {
 	s.m.Lock()
 	defer s.m.Unlock()
@@ -103,41 +552,78 @@ func (s *subscribers) getAll() (subs []*subscriber) {
 func (s *subscribers) remove(sub *subscriber) {
 	s.m.Lock()
 	defer s.m.Unlock()
-	delete(s.sidMap, sub.sid)
-	for sel, sids := range s.selMap {
-		for i, uid := range sids {
-			if uid == sub.sid {
-				s.selMap[sel] = append(sids[:i], sids[i+1:]...)
+	delete(s.sidMap, sub.id)
+	s.unindex(sub)
+	if sids, ok := s.idMap[sub.spiffeID]; ok {
+		for i, id := range sids {
+			if id == sub.id {
+				sids = append(sids[:i], sids[i+1:]...)
+				break
 			}
 		}
+		if len(sids) == 0 {
+			delete(s.idMap, sub.spiffeID)
+		} else {
+			s.idMap[sub.spiffeID] = sids
+		}
 	}
 }
 
-func (s *subscribers) getSubIds(sels Selectors) []uuid.UUID {
-	subIds := []uuid.UUID{}
-
-	selSet := selector.NewSetFromRaw(sels)
-	selPSet := selSet.Power()
+// checkInvariants verifies that the selector index is consistent with the
+// registered subscribers.
+func (s *subscribers) checkInvariants() error {
+	s.m.Lock()
+	defer s.m.Unlock()
 
-	for sel := range selPSet {
-		selStr := sel.String()
-		subIds = append(subIds, s.selMap[selStr]...)
+	indexed := make(map[uint64]int)
+	for sel, sids := range s.selMap {
+		if len(sids) == 0 {
+			return fmt.Errorf("selector index bucket %s is empty", sel)
+		}
+		for _, id := range sids {
+			if _, ok := s.sidMap[id]; !ok {
+				return fmt.Errorf("selector index bucket %s references unknown subscriber %d", sel, id)
+			}
+			indexed[id]++
+		}
 	}
 
-	subIds = dedupe(subIds)
+	for id, sub := range s.sidMap {
+		if sub.id != id {
+			return fmt.Errorf("subscriber %d is registered under ID %d", sub.id, id)
+		}
+		if id > atomic.LoadUint64(&lastSubscriberID) {
+			return fmt.Errorf("subscriber %d has an ID that was never assigned", id)
+		}
+		// A subscriber is indexed under every non-empty subset of its selectors.
+		expected := 1<<uint(selector.NewSetFromRaw(sub.sel).Size()) - 1
+		if indexed[id] != expected {
+			return fmt.Errorf("subscriber %d is indexed under %d selector sets, expected %d", id, indexed[id], expected)
+		}
+	}
+	return nil
+}
 
-	return subIds
+// getSubIds returns the IDs of the subscribers whose selectors include all the
+// given selectors. Subscribers are indexed under every subset of their
+// selectors, so looking up the whole set is enough.
+func (s *subscribers) getSubIds(sels Selectors) []uint64 {
+	if len(sels) == 0 {
+		return []uint64{}
+	}
+	return dedupe(s.selMap[selectorsKey(sels)])
 }
 
 func NewSubscribers() *subscribers {
 	return &subscribers{
-		selMap: make(map[string][]uuid.UUID),
-		sidMap: make(map[uuid.UUID]*subscriber),
+		selMap: make(map[string][]uint64),
+		sidMap: make(map[uint64]*subscriber),
+		idMap:  make(map[string][]uint64),
 	}
 }
 
-func dedupe(ids []uuid.UUID) (deduped []uuid.UUID) {
-	uniqueMap := map[uuid.UUID]bool{}
+func dedupe(ids []uint64) (deduped []uint64) {
+	uniqueMap := map[uint64]bool{}
 	for i := range ids {
 		uniqueMap[ids[i]] = true
 	}
@@ -146,3 +632,22 @@ func dedupe(ids []uuid.UUID) (deduped []uuid.UUID) {
 	}
 	return
 }
+
+// sortEntriesByExpiry sorts the entries by SVID expiration, keeping the
+// order of entries expiring at the same time. Entries without an SVID are
+// sorted last.
+func sortEntriesByExpiry(entries []*Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i].SVID, entries[j].SVID
+		if a == nil || b == nil {
+			return b == nil && a != nil
+		}
+		return a.NotAfter.Before(b.NotAfter)
+	})
+}
+
+func sortEntries(entries []*Entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].RegistrationEntry.EntryId < entries[j].RegistrationEntry.EntryId
+	})
+}
@@ -46,7 +46,7 @@ func New(c *Config) (*manager, error) {
 	}
 
 	m := &manager{
-		cache: cache.New(c.Log, c.Bundle),
+		cache: cache.New(c.Log, c.Bundle, cache.WithTrustDomain("spiffe://"+c.TrustDomain.Host)),
 		c:     c,
 		t:     new(tomb.Tomb),
 		mtx:   new(sync.RWMutex),
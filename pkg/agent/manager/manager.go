@@ -116,11 +116,11 @@ func (m *manager) Subscribe(selectors cache.Selectors) cache.Subscriber {
 	// creates a subscriber
 	// adds it to the manager
 	// returns the added subscriber
-	sub, err := cache.NewSubscriber(selectors)
-	if err != nil {
-		m.c.Log.Error(err)
+	sub := cache.NewSubscriber(selectors)
+	if err := m.cache.Subscribe(sub); err != nil {
+		m.c.Log.Errorf("could not subscribe: %v", err)
+		sub.Finish()
 	}
-	m.cache.Subscribe(sub)
 	return sub
 }
 
@@ -231,11 +231,16 @@ func (m *manager) setBundle(bundle []*x509.Certificate) {
 	if err != nil {
 		m.c.Log.Errorf("could not store bundle: %v", err)
 	}
-	m.cache.SetBundle(bundle)
+	if err := m.cache.SetBundle(bundle); err != nil {
+		m.c.Log.Errorf("could not set bundle: %v", err)
+	}
 }
 
 func (m *manager) bundleAlreadyCached(bundle []*x509.Certificate) bool {
 	currentBundle := m.cache.Bundle()
+	// The cache returns the bundle sorted, so sort the given one the same way
+	// to ignore differences in ordering.
+	bundle = cache.SortedBundle(bundle)
 
 	if currentBundle == nil {
 		return bundle == nil
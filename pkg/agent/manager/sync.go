@@ -125,7 +125,15 @@ func (m *manager) updateEntriesSVIDs(entryRequestsMap map[string]*entryRequest,
 			}
 			// Complete the pre-built cache entry with the SVID and put it on the cache.
 			ce.SVID = cert
-			m.cache.SetEntry(ce)
+			err = m.cache.SetEntry(ce)
+			if err == cache.ErrTrustDomainMismatch {
+				// Skip the entry, so the others are still updated.
+				m.c.Log.Warnf("SVID for %s is not in the agent trust domain, entry skipped", ce.RegistrationEntry.SpiffeId)
+				continue
+			}
+			if err != nil {
+				return err
+			}
 			// This entry is an agent alias, collect it
 			if m.isAgentAlias(ce.RegistrationEntry) {
 				m.c.Log.Debugf("Agent alias detected: %s", ce.RegistrationEntry.SpiffeId)
@@ -140,12 +148,11 @@ func (m *manager) checkExpiredCacheEntries(cEntryRequests entryRequests) error {
 	defer m.c.Tel.MeasureSince([]string{"cache_manager", "expiry_check_duration"}, time.Now())
 
 	for _, entry := range m.cache.Entries() {
-		ttl := entry.SVID.NotAfter.Sub(time.Now())
 		lifetime := entry.SVID.NotAfter.Sub(entry.SVID.NotBefore)
-		// If the cached SVID has a remaining lifetime less than 50%, prepare a
-		// new entryRequest.
-		if ttl < lifetime/2 {
-			m.c.Log.Debugf("cache entry ttl for spiffeId %s is less than a half its lifetime", entry.RegistrationEntry.SpiffeId)
+		// If the cached SVID reached its rotation time, by default when its
+		// remaining lifetime is less than 50%, prepare a new entryRequest.
+		if time.Now().After(entry.RotationTime(lifetime / 2)) {
+			m.c.Log.Debugf("cache entry for spiffeId %s reached its rotation time", entry.RegistrationEntry.SpiffeId)
 			privateKey, csr, err := m.newCSR(entry.RegistrationEntry.SpiffeId)
 			if err != nil {
 				return err
@@ -157,6 +164,8 @@ func (m *manager) checkExpiredCacheEntries(cEntryRequests entryRequests) error {
 				SVID:              nil,
 				PrivateKey:        privateKey,
 				Bundles:           bundles,
+				FederatesWith:     entry.RegistrationEntry.FbSpiffeIds,
+				RotationThreshold: entry.RotationThreshold,
 			}
 			cEntryRequests.add(&entryRequest{csr, cacheEntry})
 		}
@@ -180,6 +189,7 @@ func (m *manager) checkForNewCacheEntries(regEntries map[string]*proto.Registrat
 				SVID:              nil,
 				PrivateKey:        privateKey,
 				Bundles:           bundles,
+				FederatesWith:     regEntry.FbSpiffeIds,
 			}
 			cEntryRequests.add(&entryRequest{csr, cacheEntry})
 		} else if m.isAgentAlias(regEntry) {
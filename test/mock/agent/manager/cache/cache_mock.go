@@ -46,10 +46,11 @@ func (_mr *MockCacheMockRecorder) DeleteEntries(arg0 interface{}) *gomock.Call {
 }
 
 // DeleteEntry mocks base method
-func (_m *MockCache) DeleteEntry(_param0 *common.RegistrationEntry) bool {
+func (_m *MockCache) DeleteEntry(_param0 *common.RegistrationEntry) (bool, error) {
 	ret := _m.ctrl.Call(_m, "DeleteEntry", _param0)
 	ret0, _ := ret[0].(bool)
-	return ret0
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
 // DeleteEntry indicates an expected call of DeleteEntry
@@ -94,8 +95,10 @@ func (_mr *MockCacheMockRecorder) IsEmpty() *gomock.Call {
 }
 
 // SetEntry mocks base method
-func (_m *MockCache) SetEntry(_param0 *cache.Entry) {
-	_m.ctrl.Call(_m, "SetEntry", _param0)
+func (_m *MockCache) SetEntry(_param0 *cache.Entry) error {
+	ret := _m.ctrl.Call(_m, "SetEntry", _param0)
+	ret0, _ := ret[0].(error)
+	return ret0
 }
 
 // SetEntry indicates an expected call of SetEntry